@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"api/src/config"
+	"api/src/lib/audit"
+	"api/src/lib/diagnostics"
 	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/queue"
+	"api/src/lib/scheduler"
+	"api/src/lib/tracing"
+	"api/src/middleware"
 	"api/src/routes"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/joho/godotenv"
 )
@@ -20,7 +31,7 @@ func main() {
 	// Load environment variables from .env file
 	err := godotenv.Load(".env")
 	if err != nil {
-		config.Log(fmt.Sprintf("No .env file found in current directory: %v", err), 3, true, false)
+		config.Fatal("No .env file found in current directory", logging.Err(err))
 	}
 
 	// Enviornment loading
@@ -30,27 +41,112 @@ func main() {
 	frontendUrl := general.GetEnv("FRONTEND_URL", "http://localhost:3000")
 	socketIoUrl := general.GetEnv("SOCKETIO_URL", "ws://localhost:4000")
 
+	// Prefork defaults to on in production, each child process keeps its own metrics (see README)
+	defaultPrefork := "false"
+	if nodeEnv == "production" {
+		defaultPrefork = "true"
+	}
+	prefork := general.GetEnv("PREFORK", defaultPrefork) == "true"
+
 	if nodeEnv == "development" {
-		log.SetLevel(log.LevelTrace)
-		config.Log("You are in development mode!", 0, false, false)
+		config.Logger.Debug("You are in development mode!")
 	} else {
-		log.SetLevel(log.LevelInfo) // Changed from LevelWarn to LevelInfo so we can see INFO logs
-		config.Log("You are in production mode!", 1, false, false)
+		config.Logger.Info("You are in production mode!")
+	}
+
+	// Tracing first, so the database & Redis clients pick up the tracer provider
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Enabled:        general.GetEnv("TRACING_ENABLED", "false") == "true",
+		Endpoint:       general.GetEnv("TRACING_ENDPOINT", ""),
+		Insecure:       general.GetEnv("TRACING_INSECURE", "true") == "true",
+		SampleRatio:    general.GetEnv("TRACING_SAMPLE_RATIO", 1.0),
+		ServiceName:    general.GetEnv("TRACING_SERVICE_NAME", "accord-api"),
+		ServiceVersion: apiVersion,
+		Environment:    nodeEnv,
+	})
+	if err != nil {
+		config.Fatal("Could not set up tracing", logging.Err(err))
+		shutdownTracing = func(context.Context) error { return nil }
 	}
 
 	config.ConnectToDatabase()
 	config.ConnectToRedis()
+	config.StartLogWriter()
+
+	// Scheduled jobs run in the prefork parent (or the only process), job_runs picks one replica for each run
+	maintenanceCtx, stopMaintenance := context.WithCancel(context.Background())
+	defer stopMaintenance()
+
+	var jobScheduler *scheduler.Scheduler
+	if !fiber.IsChild() && config.DB != nil && general.GetEnv("SCHEDULER_ENABLED", "true") == "true" {
+		jobScheduler = scheduler.New(config.DB, config.Logger)
+		for _, job := range scheduler.BuiltinJobs() {
+			if err := jobScheduler.Register(job); err != nil {
+				config.Fatal("Could not register scheduled job", logging.Err(err))
+			}
+		}
+		jobScheduler.Start(maintenanceCtx)
+	}
+
+	// Every process enqueues jobs, the workers run in the prefork parent (or the only process) like scheduled jobs
+	if err := queue.RegisterBuiltinHandlers(); err != nil {
+		config.Fatal("Could not register job handlers", logging.Err(err))
+	}
+
+	var jobWorkers *queue.Pool
+	if workers := general.GetEnv("QUEUE_WORKERS", 4); !fiber.IsChild() && config.RedisClient != nil && workers > 0 {
+		jobWorkers = queue.NewPool(config.RedisClient, config.Logger, workers)
+		if err := jobWorkers.Start(maintenanceCtx); err != nil {
+			config.Logger.Error("Could not start job queue workers, jobs wait until another replica works them", logging.Err(err))
+			jobWorkers = nil
+		}
+	}
+
+	// /metrics is on the public app port, so production shouldn't serve it without a token by accident
+	if nodeEnv == "production" && general.GetEnv("METRICS_TOKEN", "") == "" && !fiber.IsChild() {
+		if middleware.MetricsUnprotected() {
+			config.Logger.Warn("/metrics is served to anyone in production, METRICS_ALLOW_UNAUTHENTICATED is set without METRICS_TOKEN")
+		} else {
+			config.Logger.Warn("/metrics refuses every scrape in production until METRICS_TOKEN is set")
+		}
+	}
+
+	// Diagnostics (pprof, goroutines, build & runtime stats) on a separate port, off by default in production
+	var diagnosticsServer *diagnostics.Server
+	if general.GetEnv("DIAGNOSTICS_ENABLED", fmt.Sprint(nodeEnv != "production")) == "true" {
+		if prefork {
+			// The prefork parent only supervises, and children can't share one diagnostics port
+			if !fiber.IsChild() {
+				config.Logger.Warn("Diagnostics server is not available with PREFORK=true, skipping")
+			}
+		} else {
+			diagnosticsToken := general.GetEnv("DIAGNOSTICS_TOKEN", "")
+			if diagnosticsToken == "" && nodeEnv == "production" {
+				config.Logger.Warn("Diagnostics server enabled in production without DIAGNOSTICS_TOKEN")
+			}
+			diagnosticsServer = diagnostics.NewServer(diagnostics.Config{
+				Addr:    general.GetEnv("DIAGNOSTICS_ADDRESS", "127.0.0.1:6060"),
+				Token:   diagnosticsToken,
+				Version: apiVersion,
+			}, config.Logger)
+			diagnosticsServer.Start()
+		}
+	}
 
 	app := fiber.New(fiber.Config{
-		Prefork:       nodeEnv == "production",
+		Prefork:       prefork,
 		CaseSensitive: true,
 		StrictRouting: true,
 		ServerHeader:  "Accord /w Fiber",
 		AppName:       fmt.Sprintf("Accord API v%s", apiVersion),
+		ErrorHandler:  general.ErrorHandler,
 	})
 
 	// Middleware setup
-	app.Use(logger.New())
+	app.Use(middleware.RequestID())
+	app.Use(middleware.Tracing())
+	app.Use(middleware.Metrics())
+	app.Use(middleware.AccessLog())
 	app.Use(recover.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: fmt.Sprintf("%s, %s", frontendUrl, socketIoUrl),
@@ -58,10 +154,52 @@ func main() {
 
 	routes.SetupRoutes(app)
 
-	config.Log(fmt.Sprintf("Server started on port %d", hostingPort), 1, false, false)
+	// Graceful shutdown, stop accepting requests then flush anything still buffered
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+
+		config.Logger.Info("Shutting down server...")
+		if err := app.ShutdownWithTimeout(10 * time.Second); err != nil {
+			config.Logger.Error("Server did not shut down cleanly", logging.Err(err))
+		}
+	}()
+
+	config.Logger.Info("Server started", slog.Int("port", hostingPort))
 
 	if err := app.Listen(fmt.Sprintf(":%d", hostingPort)); err != nil {
-		config.Log(fmt.Sprintf("Failed to start server: %v", err), 3, true, false)
+		config.Fatal("Failed to start server", logging.Err(err))
+	}
+
+	stopMaintenance()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if jobScheduler != nil {
+		if err := jobScheduler.Wait(shutdownCtx); err != nil {
+			config.Logger.Warn("Scheduled jobs still running at shutdown", logging.Err(err))
+		}
+	}
+	if jobWorkers != nil {
+		if err := jobWorkers.Drain(shutdownCtx); err != nil {
+			config.Logger.Warn("Queued jobs still running at shutdown, they're retried once their visibility timeout passes", logging.Err(err))
+		}
+	}
+
+	if err := audit.StopWriter(shutdownCtx); err != nil {
+		config.Logger.Error("Could not record queued audit events", logging.Err(err))
+	}
+	if err := config.StopLogWriter(shutdownCtx); err != nil {
+		config.Logger.Error("Could not flush buffered logs", logging.Err(err))
+	}
+	if diagnosticsServer != nil {
+		diagnosticsServer.Shutdown(shutdownCtx)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		config.Logger.Error("Could not flush buffered spans", logging.Err(err))
 	}
+	config.CloseRedisConnection()
 
 }
@@ -1,27 +1,139 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
 	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/queue"
+	"api/src/lib/security"
 	"api/src/tools"
 )
 
 func main() {
 	var generateModels bool
+	var calibrateHashCost bool
+	var targetMs int
+	var keyUsage bool
+	var oidcCheck bool
+	var oidcCheckConfig tools.OIDCCheckConfig
+	var queueStats bool
+	var queueCount int64
+	var queueRetry string
+	var queuePurge string
 	flag.BoolVar(&generateModels, "generate-models", false, "Generate models from existing postgres database")
+	flag.BoolVar(&calibrateHashCost, "calibrate-hash-cost", false, "Find the highest ARGON2_TIME that hashes within -target-ms on this machine")
+	flag.IntVar(&targetMs, "target-ms", 250, "Target hashing latency in milliseconds, used by -calibrate-hash-cost")
+	flag.BoolVar(&keyUsage, "key-usage", false, "Report how many password hashes still use retired pepper keys, exits 2 if any do")
+	flag.BoolVar(&oidcCheck, "oidc-check", false, "Run a client app's sign in flow against a running API's OpenID Connect provider")
+	flag.StringVar(&oidcCheckConfig.Issuer, "issuer", general.GetEnv("OIDC_PROVIDER_ISSUER", "http://localhost:8080"), "Issuer URL, used by -oidc-check")
+	flag.StringVar(&oidcCheckConfig.ClientID, "client-id", "", "Registered client_id, used by -oidc-check")
+	flag.StringVar(&oidcCheckConfig.ClientSecret, "client-secret", os.Getenv("OIDC_CHECK_CLIENT_SECRET"), "Client secret (empty for public clients), used by -oidc-check (or OIDC_CHECK_CLIENT_SECRET)")
+	flag.StringVar(&oidcCheckConfig.RedirectURI, "redirect-uri", "", "A redirect URI registered for the client, used by -oidc-check")
+	flag.StringVar(&oidcCheckConfig.Username, "username", "", "User to sign in as, used by -oidc-check")
+	flag.StringVar(&oidcCheckConfig.Password, "password", os.Getenv("OIDC_CHECK_PASSWORD"), "Their password, used by -oidc-check (or OIDC_CHECK_PASSWORD)")
+	flag.BoolVar(&queueStats, "queue-stats", false, "Show the background job queue's counts and its oldest dead jobs")
+	flag.Int64Var(&queueCount, "count", 20, "How many dead jobs to list, used by -queue-stats")
+	flag.StringVar(&queueRetry, "queue-retry", "", "Queue a dead job again by its entry id, or every dead job with all")
+	flag.StringVar(&queuePurge, "queue-purge", "", "Delete a dead job by its entry id, or every dead job with all")
 	flag.Parse()
 
-	// Connect to database
-	config.ConnectToDatabase()
+	if queueStats || queueRetry != "" || queuePurge != "" {
+		config.ConnectToRedis()
+		defer config.CloseRedisConnection()
+
+		// Registered so sensitive payloads are known & left out
+		if err := queue.RegisterBuiltinHandlers(); err != nil {
+			config.Logger.Error("Failed to register job handlers", logging.Err(err))
+			os.Exit(1)
+		}
+
+		ctx := context.Background()
+		switch {
+		case queueRetry != "":
+			retried, err := tools.RetryDeadJobs(ctx, queueRetry)
+			if err != nil {
+				config.Logger.Error("Failed to retry dead jobs", logging.Err(err))
+				os.Exit(1)
+			}
+			config.Logger.Info("Dead jobs queued again", slog.Int64("count", retried))
+		case queuePurge != "":
+			purged, err := tools.PurgeDeadJobs(ctx, queuePurge)
+			if err != nil {
+				config.Logger.Error("Failed to purge dead jobs", logging.Err(err))
+				os.Exit(1)
+			}
+			config.Logger.Info("Dead jobs purged", slog.Int64("count", purged))
+		default:
+			if err := tools.InspectQueue(ctx, queueCount); err != nil {
+				config.Logger.Error("Failed to inspect the job queue", logging.Err(err))
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if oidcCheck {
+		oidcCheckConfig.APIBase = fmt.Sprintf("%s/api/v%s", strings.TrimSuffix(oidcCheckConfig.Issuer, "/"), general.GetEnv("VERSION", "0"))
+
+		if err := tools.CheckOIDCProvider(context.Background(), oidcCheckConfig); err != nil {
+			config.Logger.Error("OpenID Connect provider check failed", logging.Err(err))
+			os.Exit(1)
+		}
+		config.Logger.Info("OpenID Connect provider check passed")
+		return
+	}
+
+	if calibrateHashCost {
+		params := security.CurrentArgon2Params()
+		config.Logger.Info("Calibrating Argon2id iterations...",
+			slog.Int("target_ms", targetMs),
+			slog.Int("memory_kib", int(params.Memory)),
+			slog.Int("threads", int(params.Threads)),
+		)
+		iterations, elapsed := security.CalibrateArgon2Time(time.Duration(targetMs)*time.Millisecond, 20)
+		config.Logger.Info("Calibration completed, set ARGON2_TIME accordingly",
+			slog.Int("iterations", int(iterations)),
+			slog.Float64("elapsed_ms", float64(elapsed.Microseconds())/1000),
+		)
+		return
+	}
+
+	if keyUsage {
+		config.ConnectToDatabase()
+
+		outstanding, err := tools.ReportKeyUsage()
+		if err != nil {
+			config.Logger.Error("Failed to report key usage", logging.Err(err))
+			os.Exit(1)
+		}
+		if outstanding > 0 {
+			config.Logger.Warn("Records still use retired or unknown keys, they are upgraded as users log in",
+				slog.Int64("records", outstanding),
+			)
+			os.Exit(2)
+		}
+		config.Logger.Info("No records use retired keys")
+		return
+	}
 
 	if generateModels {
-		log.Println("[NOTICE] Generating models from database...")
+		// Connect to database
+		config.ConnectToDatabase()
+
+		config.Logger.Info("Generating models from database...")
 		if err := tools.GenerateModelsFromDatabase(); err != nil {
-			log.Fatal("[ERROR] Failed to generate models:", err)
+			config.Logger.Error("Failed to generate models", logging.Err(err))
+			os.Exit(1)
 		}
-		log.Println("[NOTICE] Model generation completed!")
+		config.Logger.Info("Model generation completed!")
 		return
 	}
 }
@@ -2,8 +2,13 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+	"api/src/lib/tracing"
 
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -18,7 +23,7 @@ func ConnectToDatabase() {
 
 	err := godotenv.Load(".env")
 	if err != nil {
-		Log("Could not find .env file", 3, true, false)
+		Fatal("Could not find .env file", logging.Err(err))
 		return
 	}
 
@@ -40,18 +45,28 @@ func ConnectToDatabase() {
 	)
 
 	gormConfig := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger: logging.NewGormLogger(Logger, logger.Info, 200*time.Millisecond, general.GetEnv("LOG_SQL_PARAMS", "false") == "true"),
 	}
 
 	// Database connection
 	DB, err = gorm.Open(postgres.Open(dbConnectionString), gormConfig)
 	if err != nil {
-		Log("Could not open connection to Postgres", 3, true, false)
+		Fatal("Could not open connection to Postgres", logging.Err(err))
 		return
 	}
 
-	notice := fmt.Sprintf("Database connection successful to %s:%d | via user (%s)",
-		pgAddr, pgPort, pgUser,
+	// Child spans for every statement, no-ops unless tracing is enabled
+	if err := DB.Use(tracing.NewGormPlugin()); err != nil {
+		Logger.Warn("Could not register GORM tracing", logging.Err(err))
+	}
+
+	// Expose connection pool statistics on /metrics
+	if sqlDB, err := DB.DB(); err == nil {
+		metrics.RegisterDB(sqlDB)
+	}
+
+	Logger.Info("Database connection successful",
+		slog.String("address", fmt.Sprintf("%s:%d", pgAddr, pgPort)),
+		slog.String("user", pgUser),
 	)
-	Log(notice, 1, false, false)
 }
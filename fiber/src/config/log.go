@@ -1,63 +1,131 @@
 package config
 
 import (
+	"context"
 	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
 	"api/src/lib/general"
+	"api/src/lib/keyring"
+	"api/src/lib/logging"
 	"api/src/models"
 
-	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 var env = general.GetEnv("NODE_ENV", "development")
 
-// @level: can be be between the ranges 0-3 inclusive, representing: DEBUG, NOTICE, WARNING & ERROR.
-// Any log at level 0 will be ignored in produciton.
-// @isFatal: if decalred as true it will return an error OR if the log level is 4 & the ENV is developement, it will OS exit instead.
-// @saveLog: determines whether to log the output to the database
-func Log(msg string, level uint8, isFatal bool, saveLog bool) error {
+// Logger is the application wide structured logger.
+// Output is JSON in production and human readable in development, unless overridden with LOG_FORMAT.
+// Attach logging.Persist() to a call to also save the record to the logs table, and log with a request's
+// context (c.UserContext()) so its request ID and user are attached automatically.
+var Logger, outputLogger = newLoggers()
 
-	if env == "" {
-		return errors.New("no ENV found")
+// LogWriter batches persisted log rows into the database, started by StartLogWriter once connected.
+var LogWriter *logging.BatchWriter
+
+func newLoggers() (*slog.Logger, *slog.Logger) {
+	defaultLevel, defaultFormat := slog.LevelDebug, "pretty"
+	if env == "production" {
+		defaultLevel, defaultFormat = slog.LevelInfo, "json"
 	}
 
-	// Ignore DEBUG logs in produciton
-	if env == "production" && level == 0 {
-		return nil
+	level := logging.ParseLevel(general.GetEnv("LOG_LEVEL", ""), defaultLevel)
+	format := general.GetEnv("LOG_FORMAT", defaultFormat)
+
+	handler := logging.NewHandler(os.Stdout, format, level)
+
+	redactor, redactErr := newRedactor()
+	if redactErr != nil {
+		redactor, _ = logging.NewRedactor(logging.DefaultRedactKeys, logging.DefaultRedactPatterns, secretLiterals())
 	}
 
-	if saveLog && DB != nil {
-		logx := models.Logs{
-			Message: msg,
-			Level:   int16(level),
-		}
-		if err := DB.Create(&logx).Error; err != nil {
-			log.Error("[ERROR] | Could not create database entry for log")
-		}
+	// Redaction runs after context attributes are added & before anything is written or persisted.
+	// outputLogger only writes to stdout, used by the log writer to report on itself without recursing.
+	logger := slog.New(logging.NewContextHandler(logging.NewRedactHandler(logging.NewPersistHandler(handler, saveLog), redactor)))
+	output := slog.New(logging.NewContextHandler(logging.NewRedactHandler(handler, redactor)))
+
+	if redactErr != nil {
+		logger.Error("Invalid LOG_REDACT_PATTERNS, using default redaction only", logging.Err(redactErr))
+	}
+
+	return logger, output
+}
+
+// newRedactor extends the default redaction with LOG_REDACT_KEYS (comma separated) &
+// LOG_REDACT_PATTERNS (whitespace separated regular expressions).
+func newRedactor() (*logging.Redactor, error) {
+	keys := append([]string{}, logging.DefaultRedactKeys...)
+	keys = append(keys, strings.Split(general.GetEnv("LOG_REDACT_KEYS", ""), ",")...)
+
+	patterns := append([]string{}, logging.DefaultRedactPatterns...)
+	patterns = append(patterns, strings.Fields(general.GetEnv("LOG_REDACT_PATTERNS", ""))...)
+
+	return logging.NewRedactor(keys, patterns, secretLiterals())
+}
+
+// Configured secret values, redacted verbatim if they ever end up in a log line.
+func secretLiterals() []string {
+	literals := []string{
+		general.GetEnv("JWT_SECRET", ""),
+		general.GetEnv("HASH_PEPPER", ""),
+		general.GetEnv("POSTGRES_PASSWORD", ""),
 	}
 
-	switch level {
-	case 0:
-		log.Debug(msg)
-	case 1:
-		log.Info(msg)
-	case 2:
-		log.Warn(msg)
-	case 3:
-		if isFatal {
-			if env == "development" {
-				log.Fatal(msg)
-				return nil
-			} else {
-				log.Error(msg)
-				return errors.New(msg)
-			}
-		} else {
-			log.Error(msg)
+	// Every key of the rotation keyrings, invalid lists are reported when security loads them
+	for _, list := range []string{"JWT_SECRETS", "HASH_PEPPERS"} {
+		if ring, err := keyring.Parse(general.GetEnv(list, "")); err == nil {
+			literals = append(literals, ring.Secrets()...)
 		}
-	default:
-		log.Debug(msg)
 	}
+	return literals
+}
+
+// StartLogWriter starts the asynchronous writer for persisted logs, DB must already be connected.
+func StartLogWriter() {
+	if DB == nil || LogWriter != nil {
+		return
+	}
+
+	LogWriter = logging.NewBatchWriter(logging.BatchWriterConfig{
+		BufferSize:    general.GetEnv("LOG_BUFFER_SIZE", 4096),
+		BatchSize:     general.GetEnv("LOG_BATCH_SIZE", 256),
+		FlushInterval: time.Duration(general.GetEnv("LOG_FLUSH_INTERVAL", 2000)) * time.Millisecond,
+	}, outputLogger, insertLogs)
+}
 
+// StopLogWriter flushes any queued log rows, waiting until ctx is done at the latest.
+func StopLogWriter(ctx context.Context) error {
+	if LogWriter == nil {
+		return nil
+	}
+	return LogWriter.Close(ctx)
+}
+
+// saveLog hands a persisted log record to the writer, it never blocks the caller.
+// Rows are silently dropped before the writer has started, drops under load are counted & reported by the writer.
+func saveLog(_ context.Context, entry models.Logs) error {
+	if LogWriter != nil {
+		LogWriter.Enqueue(entry)
+	}
 	return nil
 }
+
+// insertLogs writes a batch as a multi-row insert, bypassing the GORM logger so a failing
+// insert can not recurse back into the logging pipeline.
+func insertLogs(ctx context.Context, batch []models.Logs) error {
+	return DB.Session(&gorm.Session{Logger: gormlogger.Discard}).WithContext(ctx).Create(&batch).Error
+}
+
+// Fatal logs msg at error level. In development the process exits, otherwise the error is returned to the caller.
+func Fatal(msg string, args ...any) error {
+	Logger.Error(msg, args...)
+	if env == "development" {
+		os.Exit(1)
+	}
+	return errors.New(msg)
+}
@@ -3,12 +3,16 @@ package config
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"api/src/constants"
 	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
 
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -18,7 +22,7 @@ func ConnectToRedis() {
 	// Load environment variables
 	err := godotenv.Load(".env")
 	if err != nil {
-		Log("Could not find .env file", 3, true, false)
+		Fatal("Could not find .env file", logging.Err(err))
 		return
 	}
 
@@ -37,6 +41,12 @@ func ConnectToRedis() {
 		PoolSize:     10,
 		MinIdleConns: 10,
 	})
+	RedisClient.AddHook(logging.NewRedisHook(Logger))
+	metrics.RegisterRedis(RedisClient)
+	// Command arguments hold cached sessions & users, only the command name goes on spans
+	if err := redisotel.InstrumentTracing(RedisClient, redisotel.WithDBStatement(false)); err != nil {
+		Logger.Warn("Could not register Redis tracing", logging.Err(err))
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
@@ -44,16 +54,14 @@ func ConnectToRedis() {
 
 	pong, err := RedisClient.Ping(ctx).Result()
 	if err != nil {
-		Log("Could not connect to Redis Service", 3, true, false)
+		Fatal("Could not connect to Redis Service", logging.Err(err))
 		return
 	}
 
-	notice := fmt.Sprintf("Redis connection successful at %s:%d | Response: %s",
-		redisAddr,
-		redisPort,
-		pong,
+	Logger.Info("Redis connection successful",
+		slog.String("address", fmt.Sprintf("%s:%d", redisAddr, redisPort)),
+		slog.String("response", pong),
 	)
-	Log(notice, 1, false, false)
 }
 
 func CloseRedisConnection() error {
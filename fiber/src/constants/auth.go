@@ -3,7 +3,98 @@ package constants
 import "time"
 
 const (
-	JWT_DURATION          = 5 * time.Minute     // Short lived JWT expiry (2 Minute)
-	JWT_REFRESH_THRESHOLD = 30 * time.Second    // If the JWT is due to expire in <= (30 Seconds) then re-issue
-	SESSION_DURATION      = 28 * 24 * time.Hour // Long-lived session (28 Days)
+	JWT_DURATION          = 5 * time.Minute  // Short lived JWT expiry (2 Minute)
+	JWT_REFRESH_THRESHOLD = 30 * time.Second // If the JWT is due to expire in <= (30 Seconds) then re-issue
+	JWT_LEEWAY            = 10 * time.Second // Clock skew tolerated on exp, nbf & iat
+)
+
+// Long-lived sessions end after their idle timeout without activity, and at their absolute lifetime however
+// active they are. Logging in with "remember_me" picks the long policy.
+const (
+	SESSION_IDLE_TIMEOUT               = 12 * time.Hour
+	SESSION_ABSOLUTE_LIFETIME          = 24 * time.Hour
+	SESSION_REMEMBER_IDLE_TIMEOUT      = 7 * 24 * time.Hour
+	SESSION_REMEMBER_ABSOLUTE_LIFETIME = 28 * 24 * time.Hour
+	SESSION_ACTIVITY_THROTTLE          = 5 * time.Minute // expires_at is slid forward at most this often per session
+)
+
+const (
+	HASH_QUEUE_TIMEOUT = 10 * time.Second // Longest a login / registration waits on the hashing pool before giving up
+	HASH_RETRY_AFTER   = 5                // Retry-After (seconds) sent when the hashing pool is saturated
+)
+
+// Login client types, browsers authenticate with the jwt_token cookie, native clients with a bearer token
+const (
+	CLIENT_TYPE_BROWSER = "browser"
+	CLIENT_TYPE_NATIVE  = "native"
+)
+
+// API key scopes, sessions (cookie / bearer JWT) are never restricted by scope
+const (
+	SCOPE_USERS_READ  = "users:read"
+	SCOPE_USERS_WRITE = "users:write"
+)
+
+var API_KEY_SCOPES = []string{SCOPE_USERS_READ, SCOPE_USERS_WRITE}
+
+const (
+	API_KEY_MAX_PER_USER       = 25
+	API_KEY_LAST_USED_THROTTLE = time.Minute // last_used_at is written at most this often per key
+	API_KEY_MAX_EXPIRY_DAYS    = 365
+)
+
+const (
+	OIDC_FLOW_TTL         = 10 * time.Minute // How long a user has to finish logging in at an identity provider
+	OIDC_EXCHANGE_TIMEOUT = 10 * time.Second // Code exchange & ID token verification, including key fetches
+)
+
+// Acting as an OpenID Connect provider for other apps
+const (
+	OIDC_AUTH_REQUEST_TTL      = 10 * time.Minute // How long the user has to consent before the client must start over
+	OIDC_AUTH_CODE_TTL         = time.Minute      // Authorization codes are redeemed immediately by the client's backend
+	OIDC_ID_TOKEN_DURATION     = time.Hour
+	OIDC_ACCESS_TOKEN_DURATION = 10 * time.Minute // Client access tokens, only accepted by userinfo
+)
+
+// Scopes a client can request, refresh tokens are only issued with offline_access
+const (
+	OIDC_SCOPE_OPENID         = "openid"
+	OIDC_SCOPE_PROFILE        = "profile"
+	OIDC_SCOPE_OFFLINE_ACCESS = "offline_access"
+)
+
+var OIDC_PROVIDER_SCOPES = []string{OIDC_SCOPE_OPENID, OIDC_SCOPE_PROFILE, OIDC_SCOPE_OFFLINE_ACCESS}
+
+const (
+	MAGIC_LINK_TTL          = 15 * time.Minute
+	MAGIC_LINK_MAX_PER_HOUR = 5                // Links sent per user per hour, requests past it are silently dropped
+	MAGIC_LINK_SEND_TIMEOUT = 30 * time.Second // Lookup & delivery, run after the response is sent
+)
+
+// What CoreMiddleware does when a session is used from a different client than it was created on (SESSION_BINDING_POLICY)
+const (
+	SESSION_BINDING_IGNORE  = "ignore"
+	SESSION_BINDING_WARN    = "warn"    // Log & audit, at most once per SESSION_ANOMALY_THROTTLE for each session & client
+	SESSION_BINDING_STEP_UP = "step_up" // Refuse requests until the password is confirmed at /auth/step-up
+	SESSION_BINDING_REVOKE  = "revoke"  // Delete the session
+)
+
+const SESSION_ANOMALY_THROTTLE = time.Hour
+
+const (
+	IMPERSONATION_DURATION = 30 * time.Minute // Admin impersonation sessions end after this, never extended
+)
+
+// What a magic link does when opened, sign in links are only sent to verified addresses
+const (
+	MAGIC_LINK_PURPOSE_SIGN_IN      = "sign_in"
+	MAGIC_LINK_PURPOSE_VERIFY_EMAIL = "verify_email" // Confirms a newly set email address, never signs in
+)
+
+// How a magic link is bound to the request that asked for it (MAGIC_LINK_BINDING)
+const (
+	MAGIC_LINK_BINDING_NONE       = "none"
+	MAGIC_LINK_BINDING_IP         = "ip"
+	MAGIC_LINK_BINDING_USER_AGENT = "user_agent"
+	MAGIC_LINK_BINDING_BOTH       = "ip_and_user_agent"
 )
@@ -0,0 +1,18 @@
+package constants
+
+import "time"
+
+const (
+	JOB_RUN_RETENTION = 30 * 24 * time.Hour // Scheduled job run history (job_runs) is kept this long
+)
+
+// Background job queue (lib/queue)
+const (
+	QUEUE_VISIBILITY_TIMEOUT   = 5 * time.Minute // A job delivered this long ago without an ack is assumed lost with its worker, and retried
+	QUEUE_DEFAULT_TIMEOUT      = time.Minute
+	QUEUE_DEFAULT_MAX_ATTEMPTS = 5
+	QUEUE_RETRY_BASE_DELAY     = 5 * time.Second // Doubles with every failed attempt, with jitter
+	QUEUE_RETRY_MAX_DELAY      = 30 * time.Minute
+	QUEUE_IDEMPOTENCY_TTL      = 24 * time.Hour
+	QUEUE_DEAD_LETTER_MAX      = 10_000 // Oldest dead jobs are trimmed past this
+)
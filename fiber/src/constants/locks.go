@@ -0,0 +1,9 @@
+package constants
+
+// Postgres advisory lock keys, one per purpose. Arbitrary but fixed & distinct, a new lock gets the next value.
+const (
+	LOCK_LOG_RETENTION = 7_301_001 // One process at a time maintains the logs partitions
+	LOCK_AUDIT_CHAIN   = 7_301_002 // Serialises audit writers, so each row is chained onto the true latest row
+	LOCK_SCHEDULED_JOB = 7_301_003 // Namespace of the two key lock taken per scheduled job, the second key hashes its name
+	LOCK_USER_API_KEYS = 7_301_004 // Namespace of the two key lock serialising a user's key creation, the second key hashes the user id
+)
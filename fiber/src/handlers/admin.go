@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// - /admin/logs
+// Filters: level (exact), min_level, from & to (RFC 3339), user_id, request_id. Paged with page & page_size.
+func GetAdminLogs(c *fiber.Ctx) error {
+	type LogsQuerySchema struct {
+		Level     *int16 `query:"level"`
+		MinLevel  *int16 `query:"min_level"`
+		From      string `query:"from"`
+		To        string `query:"to"`
+		UserId    string `query:"user_id"`
+		RequestId string `query:"request_id"`
+		Page      int    `query:"page"`
+		PageSize  int    `query:"page_size"`
+	}
+
+	var data LogsQuerySchema
+	if err := c.QueryParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid query parameters")
+	}
+
+	if data.Page < 1 {
+		data.Page = 1
+	}
+	if data.PageSize < 1 || data.PageSize > 200 {
+		data.PageSize = 50
+	}
+
+	query := config.DB.WithContext(c.UserContext()).Model(&models.Logs{})
+
+	if data.Level != nil {
+		query = query.Where("level = ?", *data.Level)
+	}
+	if data.MinLevel != nil {
+		query = query.Where("level >= ?", *data.MinLevel)
+	}
+	if data.From != "" {
+		from, err := time.Parse(time.RFC3339, data.From)
+		if err != nil {
+			return general.SendError(c, fiber.StatusBadRequest, "from must be an RFC 3339 timestamp")
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if data.To != "" {
+		to, err := time.Parse(time.RFC3339, data.To)
+		if err != nil {
+			return general.SendError(c, fiber.StatusBadRequest, "to must be an RFC 3339 timestamp")
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	if data.UserId != "" {
+		if _, err := uuid.Parse(data.UserId); err != nil {
+			return general.SendError(c, fiber.StatusBadRequest, "Invalid user_id")
+		}
+		query = query.Where("user_id = ?", data.UserId)
+	}
+	if data.RequestId != "" {
+		query = query.Where("request_id = ?", data.RequestId)
+	}
+
+	// Fetch one extra row to know if there is a next page without counting the whole (partitioned) table
+	var logs []models.Logs
+	if err := query.Order("created_at DESC, id DESC").
+		Offset((data.Page - 1) * data.PageSize).
+		Limit(data.PageSize + 1).
+		Find(&logs).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	hasMore := len(logs) > data.PageSize
+	if hasMore {
+		logs = logs[:data.PageSize]
+	}
+
+	type LogResponse struct {
+		models.Logs
+		Attributes json.RawMessage `json:"attributes"`
+	}
+
+	results := make([]LogResponse, len(logs))
+	for i, entry := range logs {
+		results[i] = LogResponse{Logs: entry, Attributes: json.RawMessage(entry.Attributes)}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"logs":      results,
+		"page":      data.Page,
+		"page_size": data.PageSize,
+		"has_more":  hasMore,
+	})
+}
+
+// - /admin/audit/verify
+// Re-walks the full audit chain, reporting the first row that fails verification if any.
+func GetAdminAuditVerify(c *fiber.Ctx) error {
+	result, err := audit.Verify(c.UserContext())
+	if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not verify audit trail")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// - /admin/audit/export
+// Streams audit events (oldest first) as NDJSON (default) or CSV with format=csv, filtered by from, to & kind.
+// Every row carries prev_hash & hash so the export can be verified independently.
+func GetAdminAuditExport(c *fiber.Ctx) error {
+	type AuditExportSchema struct {
+		From   string `query:"from"`
+		To     string `query:"to"`
+		Kind   string `query:"kind"`
+		Format string `query:"format"`
+	}
+
+	var data AuditExportSchema
+	if err := c.QueryParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid query parameters")
+	}
+
+	if data.Format == "" {
+		data.Format = "ndjson"
+	}
+	if data.Format != "ndjson" && data.Format != "csv" {
+		return general.SendError(c, fiber.StatusBadRequest, "format must be ndjson or csv")
+	}
+
+	query := config.DB.Model(&models.AuditEvents{})
+
+	if data.From != "" {
+		from, err := time.Parse(time.RFC3339, data.From)
+		if err != nil {
+			return general.SendError(c, fiber.StatusBadRequest, "from must be an RFC 3339 timestamp")
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if data.To != "" {
+		to, err := time.Parse(time.RFC3339, data.To)
+		if err != nil {
+			return general.SendError(c, fiber.StatusBadRequest, "to must be an RFC 3339 timestamp")
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	if data.Kind != "" {
+		query = query.Where("kind = ?", data.Kind)
+	}
+
+	// The stream outlives the handler, so the request context can't be used here
+	ctx := context.WithoutCancel(c.UserContext())
+	filename := fmt.Sprintf("audit-events-%s.%s", time.Now().UTC().Format("20060102T150405Z"), data.Format)
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if data.Format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var csvWriter *csv.Writer
+		if data.Format == "csv" {
+			csvWriter = csv.NewWriter(w)
+			csvWriter.Write([]string{
+				"id", "kind", "outcome", "actor_id", "target_id", "ip", "user_agent",
+				"request_id", "metadata", "created_at", "prev_hash", "hash",
+			})
+		}
+
+		var rows []models.AuditEvents
+		err := query.WithContext(ctx).FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				if csvWriter != nil {
+					csvWriter.Write([]string{
+						strconv.FormatInt(row.Id, 10), row.Kind, row.Outcome, derefString(row.ActorId),
+						derefString(row.TargetId), row.Ip, row.UserAgent, row.RequestId, row.Metadata,
+						row.CreatedAt.UTC().Format(time.RFC3339Nano), row.PrevHash, row.Hash,
+					})
+					continue
+				}
+
+				type AuditExportRow struct {
+					models.AuditEvents
+					Metadata json.RawMessage `json:"metadata"`
+				}
+				line, err := json.Marshal(AuditExportRow{AuditEvents: row, Metadata: json.RawMessage(row.Metadata)})
+				if err != nil {
+					return err
+				}
+				w.Write(line)
+				w.WriteByte('\n')
+			}
+
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			return w.Flush()
+		}).Error
+
+		if err != nil {
+			config.Logger.ErrorContext(ctx, "Audit export failed part way through", logging.Err(err))
+		}
+	})
+
+	return nil
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// - /admin/tokens/:jti
+// Revokes a single access token by its jti. The expiry isn't known here, so the denial outlives any token.
+func DeleteAdminToken(c *fiber.Ctx) error {
+	jti := c.Params("jti")
+	if _, err := uuid.Parse(jti); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid token id")
+	}
+
+	if err := caching.DenyToken(c.UserContext(), jti, time.Now().Add(constants.JWT_DURATION+constants.JWT_LEEWAY)); err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not revoke access token", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not revoke token")
+	}
+
+	admin, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindTokenRevoked, audit.OutcomeSuccess).
+		WithActor(admin.Id).
+		With("jti", jti),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Token revoked",
+	})
+}
+
+// Public view of an OAuth client, the secret digest & salt never leave the server
+func oauthClientResponse(client models.OauthClients) fiber.Map {
+	return fiber.Map{
+		"id":            client.Id,
+		"client_id":     client.ClientId,
+		"name":          client.Name,
+		"public":        client.SecretDigest == "",
+		"redirect_uris": strings.Fields(client.RedirectUris),
+		"scopes":        strings.Fields(client.Scopes),
+		"skip_consent":  client.SkipConsent,
+		"created_at":    client.CreatedAt,
+	}
+}
+
+// - /admin/oauth-clients
+func GetAdminOAuthClients(c *fiber.Ctx) error {
+	var clients []models.OauthClients
+	if err := config.DB.WithContext(c.UserContext()).Order("created_at DESC").Find(&clients).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	response := make([]fiber.Map, len(clients))
+	for i, client := range clients {
+		response[i] = oauthClientResponse(client)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"oauth_clients": response,
+	})
+}
+
+// - /admin/oauth-clients
+// Registers an app that signs users in with us. The client_secret (confidential clients) is only part of this response.
+func PostAdminOAuthClient(c *fiber.Ctx) error {
+	admin, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	type OAuthClientSchema struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"`       // SPAs & native apps that can't keep a secret
+		SkipConsent  bool     `json:"skip_consent"` // Our own tools, users aren't asked to approve them
+	}
+
+	var data OAuthClientSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if len(data.Name) < 1 || len(data.Name) > 100 {
+		return general.SendError(c, fiber.StatusBadRequest, "Name must be between 1 and 100 characters")
+	}
+
+	if len(data.RedirectURIs) == 0 {
+		return general.SendError(c, fiber.StatusBadRequest, "At least one redirect URI is required")
+	}
+	for _, redirectURI := range data.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			return general.SendError(c, fiber.StatusBadRequest, "Redirect URIs must be absolute https URLs (http for localhost) without a fragment: "+redirectURI)
+		}
+	}
+
+	if !slices.Contains(data.Scopes, constants.OIDC_SCOPE_OPENID) {
+		data.Scopes = append(data.Scopes, constants.OIDC_SCOPE_OPENID)
+	}
+	for _, scope := range data.Scopes {
+		if !slices.Contains(constants.OIDC_PROVIDER_SCOPES, scope) {
+			return general.SendError(c, fiber.StatusBadRequest, "Unknown scope: "+scope)
+		}
+	}
+	slices.Sort(data.Scopes)
+	data.Scopes = slices.Compact(data.Scopes)
+
+	clientIDBytes := make([]byte, 16)
+	if _, err := rand.Read(clientIDBytes); err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not create OAuth client")
+	}
+
+	client := models.OauthClients{
+		ClientId:     hex.EncodeToString(clientIDBytes),
+		Name:         data.Name,
+		RedirectUris: strings.Join(data.RedirectURIs, " "),
+		Scopes:       strings.Join(data.Scopes, " "),
+		SkipConsent:  data.SkipConsent,
+	}
+
+	var secret string
+	if !data.Public {
+		if secret, _, err = security.GenerateOpaqueToken(); err != nil {
+			return general.SendError(c, fiber.StatusInternalServerError, "Could not create OAuth client")
+		}
+		digest, err := security.Hash512(secret, nil)
+		if err != nil {
+			config.Logger.ErrorContext(c.UserContext(), "Could not hash client secret", logging.Err(err))
+			return general.SendError(c, fiber.StatusInternalServerError, "Could not create OAuth client")
+		}
+		client.SecretDigest, client.SecretSalt = digest.HashHex, *digest.Salt
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Create(&client).Error; err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not store OAuth client", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not create OAuth client")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindOAuthClientCreated, audit.OutcomeSuccess).
+		WithActor(admin.Id).
+		With("client_id", client.ClientId).
+		With("name", client.Name),
+	)
+
+	response := oauthClientResponse(client)
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// - /admin/oauth-clients/:id
+// Deleting a client also deletes its consents & refresh tokens, access tokens run out within minutes.
+func DeleteAdminOAuthClient(c *fiber.Ctx) error {
+	admin, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	id := c.Params("id")
+	if _, err := uuid.Parse(id); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid OAuth client id")
+	}
+
+	var client models.OauthClients
+	if err := config.DB.WithContext(c.UserContext()).First(&client, "id = ?", id).Error; err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "OAuth client not found")
+	}
+	if err := config.DB.WithContext(c.UserContext()).Delete(&client).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindOAuthClientDeleted, audit.OutcomeSuccess).
+		WithActor(admin.Id).
+		With("client_id", client.ClientId),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "OAuth client deleted",
+	})
+}
+
+// Redirect URIs are compared exactly, so they must be absolute. Plain http is only allowed for local development.
+func validRedirectURI(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
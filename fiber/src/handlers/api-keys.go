@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errAPIKeyLimit = errors.New("api key limit reached")
+
+// Public view of an API key, the digest & salt never leave the server
+func apiKeyResponse(key models.ApiKeys) fiber.Map {
+	return fiber.Map{
+		"id":           key.Id,
+		"name":         key.Name,
+		"prefix":       security.APIKeyMarker + key.Prefix,
+		"scopes":       strings.Fields(key.Scopes),
+		"expires_at":   key.ExpiresAt,
+		"last_used_at": key.LastUsedAt,
+		"created_at":   key.CreatedAt,
+	}
+}
+
+// - /api-keys
+func GetApiKeys(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	var keys []models.ApiKeys
+	if err := config.DB.WithContext(c.UserContext()).
+		Where("user_id = ?", user.Id).
+		Order("created_at DESC").
+		Find(&keys).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	response := make([]fiber.Map, len(keys))
+	for i, key := range keys {
+		response[i] = apiKeyResponse(key)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"api_keys": response,
+	})
+}
+
+// - /api-keys
+// The raw key is only part of this response, it can't be recovered afterwards.
+func PostApiKey(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	type ApiKeySchema struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays *int     `json:"expires_in_days"` // Omit for a key that never expires
+	}
+
+	var data ApiKeySchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if len(data.Name) < 1 || len(data.Name) > 100 {
+		return general.SendError(c, fiber.StatusBadRequest, "Name must be between 1 and 100 characters")
+	}
+
+	if len(data.Scopes) == 0 {
+		return general.SendError(c, fiber.StatusBadRequest, "At least one scope is required")
+	}
+	for _, scope := range data.Scopes {
+		if !slices.Contains(constants.API_KEY_SCOPES, scope) {
+			return general.SendError(c, fiber.StatusBadRequest, "Unknown scope: "+scope)
+		}
+	}
+	slices.Sort(data.Scopes)
+	data.Scopes = slices.Compact(data.Scopes)
+
+	var expiresAt *time.Time
+	if data.ExpiresInDays != nil {
+		if *data.ExpiresInDays < 1 || *data.ExpiresInDays > constants.API_KEY_MAX_EXPIRY_DAYS {
+			return general.SendError(c, fiber.StatusBadRequest, "expires_in_days must be between 1 and 365")
+		}
+		expiry := time.Now().Add(time.Duration(*data.ExpiresInDays) * 24 * time.Hour)
+		expiresAt = &expiry
+	}
+
+	generated, err := security.GenerateAPIKey()
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not generate api key", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not create API key")
+	}
+
+	key := models.ApiKeys{
+		UserId:    user.Id,
+		Name:      data.Name,
+		Prefix:    generated.Prefix,
+		Digest:    generated.Digest,
+		Salt:      generated.Salt,
+		Scopes:    strings.Join(data.Scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+
+	// Counted & created under a per user lock, concurrent creates can't both see room for one more key
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", constants.LOCK_USER_API_KEYS, user.Id).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.ApiKeys{}).Where("user_id = ?", user.Id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= constants.API_KEY_MAX_PER_USER {
+			return errAPIKeyLimit
+		}
+
+		return tx.Create(&key).Error
+
+	}); errors.Is(err, errAPIKeyLimit) {
+		return general.SendError(c, fiber.StatusConflict, "API key limit reached, revoke an existing key first")
+	} else if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not store api key", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not create API key")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindAPIKeyCreated, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("api_key_id", key.Id).
+		With("scopes", data.Scopes),
+	)
+
+	response := apiKeyResponse(key)
+	response["key"] = generated.Raw
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// - /api-keys/:id
+func DeleteApiKey(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	keyId := c.Params("id")
+	if _, err := uuid.Parse(keyId); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid API key id")
+	}
+
+	// Scoped to the requesting user, someone else's key id is simply not found
+	var key models.ApiKeys
+	if err := config.DB.WithContext(c.UserContext()).First(&key, "id = ? AND user_id = ?", keyId, user.Id).Error; err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "API key not found")
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Delete(&key).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	// Revocation is immediate, don't let the cached record keep it alive
+	if err := caching.DropCachedAPIKey(c.UserContext(), key.Prefix); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Failed to drop cached api key", slog.String("api_key_id", key.Id), logging.Err(err))
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindAPIKeyRevoked, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("api_key_id", key.Id),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "API key revoked",
+	})
+}
@@ -1,14 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
 
 	"api/src/config"
 	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
 	"api/src/lib/general"
+	"api/src/lib/logging"
 	"api/src/lib/security"
+	"api/src/middleware"
 	"api/src/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -23,27 +29,22 @@ func PostRegister(c *fiber.Ctx) error {
 	type RegistrationSchema struct {
 		Username    string `json:"username" validate:"required,min=3,max=50"`
 		RawPassword string `json:"raw_password" validate:"required,min=8"`
+		RememberMe  bool   `json:"remember_me"` // Long idle timeout & lifetime, see constants.SESSION_*
 	}
 
 	var data RegistrationSchema
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
 	}
 
 	// Check if username is bewteen 3 & 50 characters
 	if len(data.Username) < 3 || len(data.Username) > 50 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Username must be between 3 and 50 characters",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "Username must be between 3 and 50 characters")
 	}
 
 	// Check that password is mor than 8 characters
 	if len(data.RawPassword) < 8 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Password must be at least 8 characters",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "Password must be at least 8 characters")
 	}
 
 	// Start concurrent password hashing process
@@ -54,32 +55,36 @@ func PostRegister(c *fiber.Ctx) error {
 
 	hashConc := make(chan hashRes, 1)
 
+	// Leaving early (i.e. username taken) cancels the hash if it's still queued
+	hashCtx, cancelHash := context.WithTimeout(c.UserContext(), constants.HASH_QUEUE_TIMEOUT)
+	defer cancelHash()
+
 	go func() {
-		hash, err := security.HashBcrypt(data.RawPassword)
+		hash, err := security.HashPassword(hashCtx, data.RawPassword)
 		hashConc <- hashRes{hash: hash, err: err}
 	}()
 
 	// Check if user already exists in database -----------------
 	var existingUser models.Users
 
-	if err := config.DB.First(&existingUser, "username = ?", data.Username).Error; err == nil {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "Username already taken",
-		})
+	if err := config.DB.WithContext(c.UserContext()).First(&existingUser, "username = ?", data.Username).Error; err == nil {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindRegister, audit.OutcomeFailure).
+			With("username", data.Username).
+			With("reason", "username_taken"),
+		)
+		return general.SendError(c, fiber.StatusConflict, "Username already taken")
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		config.Log("Database error", 2, false, false)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Database error",
-		})
+		config.Logger.WarnContext(c.UserContext(), "Database error while checking for existing user", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
 	}
 
 	// Await Password Hashing
 	hashResult := <-hashConc
-	if hashResult.err != nil {
-		config.Log(fmt.Sprintf("Hashing Process Failure: %s", hashResult.err), 3, false, false)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Hashing process failure",
-		})
+	if isHashingUnavailable(hashResult.err) {
+		return sendHashingUnavailable(c, hashResult.err)
+	} else if hashResult.err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Hashing process failure", logging.Err(hashResult.err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Hashing process failure")
 	}
 
 	// Database transaction for user & session
@@ -87,9 +92,7 @@ func PostRegister(c *fiber.Ctx) error {
 	var session models.Sessions
 	var token string
 
-	expirtyDateTime := time.Now().Add(constants.SESSION_DURATION)
-
-	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
 		// Create user record
 		user = models.Users{
 			Username: data.Username,
@@ -101,13 +104,10 @@ func PostRegister(c *fiber.Ctx) error {
 		}
 
 		// Create session (long-lived) record
-		session = models.Sessions{
-			UserId:    user.Id,
-			ExpiresAt: expirtyDateTime,
-		}
-
-		if err := tx.Create(&session).Error; err != nil {
+		if newSession, err := newSession(tx, c, user.Id, data.RememberMe); err != nil {
 			return err // Transaction rollback
+		} else {
+			session = newSession
 		}
 
 		// Generate JWT token
@@ -120,27 +120,24 @@ func PostRegister(c *fiber.Ctx) error {
 		return nil // Commit transaction
 
 	}); err != nil {
-		config.Log("Could not create user and associated session during registration - database transaction failed.", 1, false, true)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Account registration failure",
-		})
+		config.Logger.InfoContext(c.UserContext(), "Could not create user and associated session during registration - database transaction failed",
+			logging.Err(err), logging.Persist(),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Account registration failure")
 	}
 
-	// Append JWT cookie to response header
-	c.Cookie(&fiber.Cookie{
-		Name:     "jwt_token",
-		Value:    token,
-		Expires:  expirtyDateTime,
-		HTTPOnly: true,
-		Secure:   httpsOn,
-		SameSite: "Strict",
-		Path:     "/",
-	})
+	// Append JWT & CSRF cookies to response header
+	setSessionCookies(c, token, session.ExpiresAt)
 
 	// Unauthorised Route Specific Security Headers
 	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
 	c.Set("Pragma", "no-cache")
 
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindRegister, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id),
+	)
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"id":              user.Id,
 		"username":        user.Username,
@@ -156,66 +153,88 @@ func PostLogin(c *fiber.Ctx) error {
 	type LoginSchema struct {
 		Username    string `json:"username"`
 		RawPassword string `json:"raw_password"`
+		ClientType  string `json:"client_type"` // "browser" (default, cookie) or "native" (token in body)
+		RememberMe  bool   `json:"remember_me"` // Long idle timeout & lifetime, see constants.SESSION_*
 	}
 
 	var data LoginSchema
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
 	}
 
 	// Input validation for username
 	if len(data.Username) < 3 || len(data.Username) > 50 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "A standard username is between 3 and 50 characters",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "A standard username is between 3 and 50 characters")
 	}
 
 	// Input validation for password
 	if len(data.RawPassword) < 8 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "A standard password is at least 8 characters",
-		})
+		return general.SendError(c, fiber.StatusBadRequest, "A standard password is at least 8 characters")
+	}
+
+	// Input validation for client type
+	if data.ClientType == "" {
+		data.ClientType = constants.CLIENT_TYPE_BROWSER
+	} else if data.ClientType != constants.CLIENT_TYPE_BROWSER && data.ClientType != constants.CLIENT_TYPE_NATIVE {
+		return general.SendError(c, fiber.StatusBadRequest, "client_type must be browser or native")
 	}
 
 	// Get user from database
 	var user models.Users
-	if err := config.DB.First(&user, "username = ?", data.Username).Error; err != nil {
+	if err := config.DB.WithContext(c.UserContext()).First(&user, "username = ?", data.Username).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid username or password",
-			})
+			audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+				With("username", data.Username).
+				With("reason", "unknown_username"),
+			)
+			return general.SendError(c, fiber.StatusUnauthorized, "Invalid username or password")
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Database error",
-		})
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
 	}
 
-	// Verify password (bcrypt handles timing-safe comparison)
-	if valid, err := security.CheckHashBcrypt(data.RawPassword, user.Password); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Authentication failed",
-		})
+	// Accounts created through social login have no password until one is set
+	if user.Password == "" {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+			WithTarget(user.Id).
+			With("username", data.Username).
+			With("reason", "no_password"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid username or password")
+	}
+
+	// Verify password (constant time comparison, legacy bcrypt hashes included)
+	hashCtx, cancelHash := context.WithTimeout(c.UserContext(), constants.HASH_QUEUE_TIMEOUT)
+	defer cancelHash()
+
+	valid, needsRehash, err := security.CheckPassword(hashCtx, data.RawPassword, user.Password)
+	if isHashingUnavailable(err) {
+		return sendHashingUnavailable(c, err)
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Authentication failed")
 	} else if !valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid username or password",
-		})
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+			WithTarget(user.Id).
+			With("username", data.Username).
+			With("reason", "invalid_password"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid username or password")
+	}
+
+	// Legacy algorithm or outdated parameters, upgrade while we have the plain password
+	if needsRehash {
+		go rehashPassword(context.WithoutCancel(c.UserContext()), user, data.RawPassword)
 	}
 
 	// Create session and generate JWT
 	var session models.Sessions
 	var token string
 
-	if err := config.DB.Transaction(func(tx *gorm.DB) error {
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
 		// Create session record
-		session = models.Sessions{
-			UserId:    user.Id,
-			ExpiresAt: time.Now().Add(constants.SESSION_DURATION),
-		}
-
-		if err := tx.Create(&session).Error; err != nil {
+		if newSession, err := newSession(tx, c, user.Id, data.RememberMe); err != nil {
 			return err
+		} else {
+			session = newSession
 		}
 
 		// Generate JWT token
@@ -228,64 +247,157 @@ func PostLogin(c *fiber.Ctx) error {
 		return nil
 
 	}); err != nil {
-		fmt.Printf("[ERROR] Login transaction failed for user %s: %v\n", data.Username, err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Login failed",
-		})
+		config.Logger.ErrorContext(c.UserContext(), "Login transaction failed",
+			slog.String("username", data.Username),
+			slog.String(logging.KeyUserID, user.Id),
+			logging.Err(err),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Login failed")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("session_id", session.Id).
+		With("client_type", data.ClientType),
+	)
+	recordNewDevice(c, session)
+
+	return sendLoginResponse(c, user, session, token, data.ClientType)
+}
+
+// - /auth/logout
+func DeleteLogout(c *fiber.Ctx) error {
+	session, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Delete(&session).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	// The session is gone, but the cached copy & the access token itself would otherwise live on until they expire
+	if err := caching.DropCachedSession(c.UserContext(), session.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+	if claims, ok := c.Locals("claims").(*security.JWTClaims); ok {
+		if err := caching.DenyToken(c.UserContext(), claims.ID, claims.ExpiresAt.Time.Add(constants.JWT_LEEWAY)); err != nil {
+			config.Logger.WarnContext(c.UserContext(), "Could not revoke access token on logout", logging.Err(err))
+		}
 	}
 
 	c.Cookie(&fiber.Cookie{
 		Name:     "jwt_token",
-		Value:    token,
-		Expires:  time.Now().Add(constants.SESSION_DURATION),
+		Value:    "",
+		Expires:  time.Now().Add(-(5 * time.Minute)), // In the past.
 		HTTPOnly: true,
 		Secure:   httpsOn,
 		SameSite: "Strict",
 		Path:     "/",
 	})
+	middleware.ClearCSRFToken(c)
 
 	// Unauthorized Route Specific Security Headers
 	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
 	c.Set("Pragma", "no-cache")
 
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogout, audit.OutcomeSuccess).
+		WithActor(session.UserId).
+		WithTarget(session.UserId).
+		With("session_id", session.Id),
+	)
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Successfully logged out & revoked session",
+	})
+
+}
+
+// Responds to a successful login. Browsers get the cookie, native clients (apps, CLIs, services) get the token
+// in the body instead.
+func sendLoginResponse(c *fiber.Ctx, user models.Users, session models.Sessions, token string, clientType string) error {
+	if clientType == constants.CLIENT_TYPE_BROWSER {
+		setSessionCookies(c, token, session.ExpiresAt)
+	}
+
+	// Unauthorized Route Specific Security Headers
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	c.Set("Pragma", "no-cache")
+
+	response := fiber.Map{
 		"id":              user.Id,
 		"username":        user.Username,
 		"is_verified":     user.IsVerified,
 		"created_at":      user.CreatedAt,
 		"last_updated_at": user.LastUpdatedAt,
-	})
-}
-
-// - /auth/logout
-func DeleteLogout(c *fiber.Ctx) error {
-	session, err := general.GetReqSession(c)
-	if err != nil {
-		return err
 	}
-
-	if err := config.DB.Delete(&session).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Database error",
-		})
+	if clientType == constants.CLIENT_TYPE_NATIVE {
+		// Send as "Authorization: Bearer <access_token>", a refreshed token comes back in X-Refreshed-Token
+		response["access_token"] = token
+		response["token_type"] = "Bearer"
+		response["expires_in"] = int(constants.JWT_DURATION.Seconds())
 	}
 
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// Sets the jwt_token cookie for a new browser session, along with its CSRF token
+func setSessionCookies(c *fiber.Ctx, token string, expires time.Time) {
 	c.Cookie(&fiber.Cookie{
 		Name:     "jwt_token",
-		Value:    "",
-		Expires:  time.Now().Add(-(5 * time.Minute)), // In the past.
+		Value:    token,
+		Expires:  expires,
 		HTTPOnly: true,
 		Secure:   httpsOn,
 		SameSite: "Strict",
 		Path:     "/",
 	})
+	if err := middleware.IssueCSRFToken(c, expires); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not issue CSRF token", logging.Err(err))
+	}
+}
 
-	// Unauthorized Route Specific Security Headers
-	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
-	c.Set("Pragma", "no-cache")
+// Replaces a user's password hash with one made by the current hasher. Runs after the login response, a
+// failure (i.e. pool saturated) just leaves the old hash in place until the next login.
+func rehashPassword(parent context.Context, user models.Users, rawPassword string) {
+	ctx, cancel := context.WithTimeout(parent, constants.HASH_QUEUE_TIMEOUT)
+	defer cancel()
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message": "Successfully logged out & revoked session",
-	})
+	hash, err := security.HashPassword(ctx, rawPassword)
+	if err != nil {
+		config.Logger.InfoContext(ctx, "Could not rehash password, will retry on next login",
+			slog.String(logging.KeyUserID, user.Id), logging.Err(err),
+		)
+		return
+	}
+
+	// Only replace the hash we verified against, a password change in the meantime wins
+	result := config.DB.WithContext(ctx).Model(&models.Users{}).
+		Where("id = ? AND password = ?", user.Id, user.Password).
+		Update("password", hash)
+	if result.Error != nil {
+		config.Logger.WarnContext(ctx, "Could not store rehashed password",
+			slog.String(logging.KeyUserID, user.Id), logging.Err(result.Error),
+		)
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		if err := caching.DropCachedUser(ctx, user.Id); err != nil {
+			config.Logger.InfoContext(ctx, "Failed to drop cached user", slog.String(logging.KeyUserID, user.Id), logging.Err(err))
+		}
+		config.Logger.InfoContext(ctx, "Password hash upgraded", slog.String(logging.KeyUserID, user.Id))
+	}
+}
+
+// The hashing pool turned the request away, or it waited too long in the queue
+func isHashingUnavailable(err error) bool {
+	return errors.Is(err, security.ErrHashPoolSaturated) || errors.Is(err, context.DeadlineExceeded)
+}
 
+func sendHashingUnavailable(c *fiber.Ctx, err error) error {
+	config.Logger.WarnContext(c.UserContext(), "Password hashing unavailable, request turned away", logging.Err(err))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(constants.HASH_RETRY_AFTER))
+	return general.SendError(c, fiber.StatusServiceUnavailable, "Server busy, please retry shortly")
 }
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/middleware"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// - /admin/impersonate/:id
+// Starts a session as another user for support staff. Its tokens carry the admin in an act claim, it ends after
+// IMPERSONATION_DURATION (or with the admin's own session), and sensitive routes refuse it (BlockImpersonation).
+func PostAdminImpersonate(c *fiber.Ctx) error {
+	admin, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+	adminSession, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	type ImpersonateSchema struct {
+		Reason     string `json:"reason"`      // Required, kept in the audit trail
+		ClientType string `json:"client_type"` // "browser" (default, replaces the admin's cookie) or "native"
+	}
+
+	var data ImpersonateSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	data.Reason = strings.TrimSpace(data.Reason)
+	if data.Reason == "" || len(data.Reason) > 500 {
+		return general.SendError(c, fiber.StatusBadRequest, "A reason (up to 500 characters) is required")
+	}
+	if data.ClientType == "" {
+		data.ClientType = constants.CLIENT_TYPE_BROWSER
+	} else if data.ClientType != constants.CLIENT_TYPE_BROWSER && data.ClientType != constants.CLIENT_TYPE_NATIVE {
+		return general.SendError(c, fiber.StatusBadRequest, "client_type must be browser or native")
+	}
+
+	targetId := c.Params("id")
+	if _, err := uuid.Parse(targetId); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid user id")
+	}
+
+	var target models.Users
+	if err := config.DB.WithContext(c.UserContext()).First(&target, "id = ?", targetId).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return general.SendError(c, fiber.StatusNotFound, "User not found")
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	// Admins can't be impersonated, it would hand out their admin access (and let impersonation chain)
+	if target.Id == admin.Id || target.IsAdmin {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindImpersonationStart, audit.OutcomeBlocked).
+			WithActor(admin.Id).
+			WithTarget(target.Id).
+			With("reason", data.Reason),
+		)
+		return general.SendError(c, fiber.StatusForbidden, "Admins can not be impersonated")
+	}
+
+	// Never outlives the admin's own session
+	expiresAt := time.Now().Add(constants.IMPERSONATION_DURATION)
+	if adminSession.ExpiresAt.Before(expiresAt) {
+		expiresAt = adminSession.ExpiresAt
+	}
+
+	// The admin's client, it isn't remembered as one of the user's devices
+	fingerprint := security.NewFingerprint(c.IP(), c.Get(fiber.HeaderUserAgent))
+	session := models.Sessions{
+		UserId:                target.Id,
+		ImpersonatorId:        &admin.Id,
+		ImpersonatorSessionId: &adminSession.Id,
+		ExpiresAt:             expiresAt,
+		AbsoluteExpiresAt:     expiresAt,
+		Ip:                    fingerprint.IP,
+		UserAgent:             fingerprint.UserAgent,
+		Device:                fingerprint.Device,
+	}
+	if err := config.DB.WithContext(c.UserContext()).Create(&session).Error; err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not create impersonation session",
+			slog.String(logging.KeyImpersonatorID, admin.Id), logging.Err(err),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	token, err := security.GenerateImpersonationJWT(target.Id, session.Id, admin.Id)
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not generate impersonation JWT", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not start impersonation")
+	}
+
+	config.Logger.WarnContext(c.UserContext(), "Admin started impersonating a user",
+		slog.String(logging.KeyImpersonatorID, admin.Id), slog.String("target_user_id", target.Id), logging.Persist(),
+	)
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindImpersonationStart, audit.OutcomeSuccess).
+		WithActor(admin.Id).
+		WithTarget(target.Id).
+		With("session_id", session.Id).
+		With("reason", data.Reason).
+		With("expires_at", expiresAt),
+	)
+
+	if data.ClientType == constants.CLIENT_TYPE_BROWSER {
+		setSessionCookies(c, token, expiresAt)
+	}
+
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	c.Set("Pragma", "no-cache")
+
+	response := fiber.Map{
+		"user_id":    target.Id,
+		"username":   target.Username,
+		"session_id": session.Id,
+		"expires_at": expiresAt,
+	}
+	if data.ClientType == constants.CLIENT_TYPE_NATIVE {
+		response["access_token"] = token
+		response["token_type"] = "Bearer"
+		response["expires_in"] = int(constants.JWT_DURATION.Seconds())
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// - /auth/impersonation
+// Ends the impersonation session the request is made with, and hands back the admin's own session when it's
+// still alive (as a cookie or a token, the way the request came in).
+func DeleteImpersonation(c *fiber.Ctx) error {
+	session, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	impersonatorID := middleware.GetImpersonatorID(c)
+	if impersonatorID == "" {
+		return general.SendError(c, fiber.StatusBadRequest, "Not impersonating")
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Delete(&session).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+	if err := caching.DropCachedSession(c.UserContext(), session.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+	if claims, ok := c.Locals("claims").(*security.JWTClaims); ok {
+		if err := caching.DenyToken(c.UserContext(), claims.ID, claims.ExpiresAt.Time.Add(constants.JWT_LEEWAY)); err != nil {
+			config.Logger.WarnContext(c.UserContext(), "Could not revoke impersonation token", logging.Err(err))
+		}
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindImpersonationEnd, audit.OutcomeSuccess).
+		WithActor(impersonatorID).
+		WithTarget(session.UserId).
+		With("session_id", session.Id),
+	)
+
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	c.Set("Pragma", "no-cache")
+
+	// Back to the admin's session, if they haven't logged out of it meanwhile
+	var adminSession models.Sessions
+	restored := session.ImpersonatorSessionId != nil && config.DB.WithContext(c.UserContext()).
+		First(&adminSession, "id = ? AND user_id = ? AND expires_at > ?", *session.ImpersonatorSessionId, impersonatorID, time.Now()).Error == nil
+
+	var token string
+	if restored {
+		if token, err = security.GenerateJWT(adminSession.UserId, adminSession.Id); err != nil {
+			config.Logger.WarnContext(c.UserContext(), "Could not restore admin session after impersonation", logging.Err(err))
+			restored = false
+		}
+	}
+
+	response := fiber.Map{
+		"message":  "Impersonation ended",
+		"restored": restored,
+	}
+
+	if middleware.GetCredentialKind(c) == middleware.CredentialBearer {
+		if restored {
+			response["access_token"] = token
+			response["token_type"] = "Bearer"
+			response["expires_in"] = int(constants.JWT_DURATION.Seconds())
+		}
+	} else if restored {
+		setSessionCookies(c, token, adminSession.ExpiresAt)
+	} else {
+		c.Cookie(&fiber.Cookie{
+			Name:     "jwt_token",
+			Value:    "",
+			Expires:  time.Now().Add(-(5 * time.Minute)), // In the past.
+			HTTPOnly: true,
+			Secure:   httpsOn,
+			SameSite: "Strict",
+			Path:     "/",
+		})
+		middleware.ClearCSRFToken(c)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
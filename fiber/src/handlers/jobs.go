@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"api/src/config"
+	"api/src/lib/audit"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/queue"
+	"api/src/lib/scheduler"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// - /admin/scheduled-jobs
+// Every built-in scheduled job with its schedule, next run & latest run.
+func GetAdminScheduledJobs(c *fiber.Ctx) error {
+	jobs := scheduler.BuiltinJobs()
+
+	names := make([]string, len(jobs))
+	for i, job := range jobs {
+		names[i] = job.Name
+	}
+
+	var latest []models.JobRuns
+	if err := config.DB.WithContext(c.UserContext()).
+		Raw(`SELECT DISTINCT ON (job) * FROM job_runs WHERE job IN ? ORDER BY job, started_at DESC`, names).
+		Scan(&latest).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	latestByJob := make(map[string]models.JobRuns, len(latest))
+	for _, run := range latest {
+		latestByJob[run.Job] = run
+	}
+
+	now := time.Now()
+	results := make([]fiber.Map, 0, len(jobs))
+	for _, job := range jobs {
+		next, _ := scheduler.NextRun(job, now)
+		result := fiber.Map{
+			"name":           job.Name,
+			"schedule":       job.Schedule,
+			"next_run_at":    next,
+			"run_at_startup": job.RunAtStartup,
+			"last_run":       nil,
+		}
+		if run, ok := latestByJob[job.Name]; ok {
+			result["last_run"] = run
+		}
+		results = append(results, result)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"jobs": results,
+	})
+}
+
+// - /admin/scheduled-jobs/runs
+// Run history, newest first. Filters: job, status. Paged with page & page_size.
+func GetAdminScheduledJobRuns(c *fiber.Ctx) error {
+	type RunsQuerySchema struct {
+		Job      string `query:"job"`
+		Status   string `query:"status"`
+		Page     int    `query:"page"`
+		PageSize int    `query:"page_size"`
+	}
+
+	var data RunsQuerySchema
+	if err := c.QueryParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid query parameters")
+	}
+
+	if data.Page < 1 {
+		data.Page = 1
+	}
+	if data.PageSize < 1 || data.PageSize > 200 {
+		data.PageSize = 50
+	}
+
+	query := config.DB.WithContext(c.UserContext()).Model(&models.JobRuns{})
+	if data.Job != "" {
+		query = query.Where("job = ?", data.Job)
+	}
+	if data.Status != "" {
+		query = query.Where("status = ?", data.Status)
+	}
+
+	var runs []models.JobRuns
+	if err := query.Order("started_at DESC, id DESC").
+		Offset((data.Page - 1) * data.PageSize).
+		Limit(data.PageSize + 1).
+		Find(&runs).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	hasMore := len(runs) > data.PageSize
+	if hasMore {
+		runs = runs[:data.PageSize]
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"runs":      runs,
+		"page":      data.Page,
+		"page_size": data.PageSize,
+		"has_more":  hasMore,
+	})
+}
+
+// - /admin/queue
+// Background job queue counts, with the next jobs waiting out a retry backoff.
+func GetAdminQueue(c *fiber.Ctx) error {
+	stats, err := queue.GetStats(c.UserContext())
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not read job queue stats", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Queue error")
+	}
+
+	delayed, err := queue.DelayedJobs(c.UserContext(), 50)
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not list delayed jobs", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Queue error")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"stats":   stats,
+		"delayed": delayed,
+	})
+}
+
+// - /admin/queue/dead
+// Dead letter queue, oldest first. Paged with after (the last entry_id seen) & count.
+func GetAdminQueueDead(c *fiber.Ctx) error {
+	type DeadQuerySchema struct {
+		After string `query:"after"`
+		Count int64  `query:"count"`
+	}
+
+	var data DeadQuerySchema
+	if err := c.QueryParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid query parameters")
+	}
+	if data.After != "" && !queue.ValidEntryID(data.After) {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid after entry id")
+	}
+	if data.Count < 1 || data.Count > 200 {
+		data.Count = 50
+	}
+
+	jobs, err := queue.DeadJobs(c.UserContext(), data.After, data.Count)
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not list dead jobs", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Queue error")
+	}
+
+	var next any
+	if len(jobs) == int(data.Count) {
+		next = jobs[len(jobs)-1].EntryID
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"jobs": jobs,
+		"next": next,
+	})
+}
+
+// - /admin/queue/dead/retry
+// - /admin/queue/dead/:id/retry
+// Queues one dead job again (or all of them without an id), with its attempts reset.
+func PostAdminQueueRetry(c *fiber.Ctx) error {
+	return settleDeadJobs(c, audit.KindQueueJobsRetried, queue.RetryDead, func(ctx context.Context) (int64, error) {
+		retried, err := queue.RetryAllDead(ctx)
+		return int64(retried), err
+	})
+}
+
+// - /admin/queue/dead
+// - /admin/queue/dead/:id
+// Deletes one dead job (or all of them without an id) for good.
+func DeleteAdminQueueDead(c *fiber.Ctx) error {
+	return settleDeadJobs(c, audit.KindQueueJobsPurged, queue.PurgeDead, queue.PurgeAllDead)
+}
+
+// settleDeadJobs applies a retry or purge to the dead job in the route's id, or every dead job without one.
+func settleDeadJobs(c *fiber.Ctx, kind audit.Kind, one func(context.Context, string) error, all func(context.Context) (int64, error)) error {
+	admin, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	id := c.Params("id")
+	var count int64 = 1
+	if id == "" {
+		count, err = all(c.UserContext())
+	} else if !queue.ValidEntryID(id) {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid entry id")
+	} else {
+		err = one(c.UserContext(), id)
+	}
+	if errors.Is(err, queue.ErrNotFound) {
+		return general.SendError(c, fiber.StatusNotFound, "Dead job not found")
+	} else if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not settle dead jobs", slog.String("kind", string(kind)), logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Queue error")
+	}
+
+	event := audit.NewEvent(c, kind, audit.OutcomeSuccess).WithActor(admin.Id).With("count", count)
+	if id != "" {
+		event = event.With("entry_id", id)
+	}
+	audit.RecordAsync(c.UserContext(), event)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"count": count,
+	})
+}
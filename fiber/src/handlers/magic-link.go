@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/mailer"
+	"api/src/lib/queue"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	// Frontend page the emailed link opens, it POSTs the token to /auth/magic-link/consume. Consuming on a GET
+	// would let mail scanners that prefetch links burn (or use) them.
+	magicLinkURL = general.GetEnv("MAGIC_LINK_URL", general.GetEnv("FRONTEND_URL", "http://localhost:3000")+"/auth/magic-link")
+
+	// What a link must be consumed from, compared to the request that asked for it (see constants.MAGIC_LINK_BINDING_*)
+	magicLinkBinding = general.GetEnv("MAGIC_LINK_BINDING", constants.MAGIC_LINK_BINDING_USER_AGENT)
+
+	// Frontend page an email verification link opens, it POSTs the token to /auth/email/verify
+	emailVerifyURL = general.GetEnv("EMAIL_VERIFY_URL", general.GetEnv("FRONTEND_URL", "http://localhost:3000")+"/auth/verify-email")
+)
+
+var (
+	errMagicLinkUsed        = errors.New("magic link already used")
+	errMagicLinkStale       = errors.New("magic link sent to an address the account no longer has")
+	errMagicLinkRateLimited = errors.New("too many magic links sent")
+	errMagicLinkUndelivered = errors.New("magic link email could not be sent")
+)
+
+// - /auth/magic-link
+// No user attached to this request, this is a non authenticated route. The response is the same whether or not
+// the email belongs to an account, and the lookup & delivery happen after it's sent so timing doesn't tell either.
+func PostMagicLink(c *fiber.Ctx) error {
+	type MagicLinkSchema struct {
+		Email string `json:"email"`
+	}
+
+	var data MagicLinkSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	email, ok := mailer.NormaliseAddress(data.Email)
+	if !ok {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid email address")
+	}
+
+	// Captured now, the request context doesn't survive the response
+	event := audit.NewEvent(c, audit.KindMagicLinkRequested, audit.OutcomeSuccess)
+	ip, userAgent := c.IP(), c.Get(fiber.HeaderUserAgent)
+
+	go func(parent context.Context) {
+		ctx, cancel := context.WithTimeout(parent, constants.MAGIC_LINK_SEND_TIMEOUT)
+		defer cancel()
+		sendMagicLink(ctx, email, ip, userAgent, event)
+	}(context.WithoutCancel(c.UserContext()))
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If an account uses that email address, a sign in link is on its way",
+	})
+}
+
+func sendMagicLink(ctx context.Context, email string, ip string, userAgent string, event audit.Event) {
+	var user models.Users
+	if err := config.DB.WithContext(ctx).First(&user, "email = ?", email).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			config.Logger.WarnContext(ctx, "Database error while looking up magic link email", logging.Err(err))
+		}
+		event.Outcome = audit.OutcomeFailure
+		audit.RecordAsync(ctx, event.With("reason", "unknown_email"))
+		return
+	}
+	event = event.WithActor(user.Id).WithTarget(user.Id)
+
+	// Until the address is confirmed it may not be theirs, a sign in link sent there could take the account over
+	if !user.IsVerified {
+		event.Outcome = audit.OutcomeBlocked
+		audit.RecordAsync(ctx, event.With("reason", "unverified_email"))
+		return
+	}
+
+	linkID, err := deliverMagicLink(ctx, user, email, constants.MAGIC_LINK_PURPOSE_SIGN_IN, ip, userAgent)
+	if errors.Is(err, errMagicLinkRateLimited) {
+		event.Outcome = audit.OutcomeBlocked
+		audit.RecordAsync(ctx, event.With("reason", "rate_limited"))
+		return
+	} else if errors.Is(err, errMagicLinkUndelivered) {
+		event.Outcome = audit.OutcomeFailure
+		audit.RecordAsync(ctx, event.With("reason", "delivery_failed"))
+		return
+	} else if err != nil {
+		return
+	}
+
+	audit.RecordAsync(ctx, event.With("magic_link_id", linkID))
+}
+
+// sendEmailVerification mails a confirmation link to an address just set on the account, it stays unverified
+// (& gets no sign in links) until that link is opened.
+func sendEmailVerification(ctx context.Context, user models.Users, email string, ip string, userAgent string) {
+	if _, err := deliverMagicLink(ctx, user, email, constants.MAGIC_LINK_PURPOSE_VERIFY_EMAIL, ip, userAgent); errors.Is(err, errMagicLinkRateLimited) {
+		config.Logger.InfoContext(ctx, "Email verification link not sent, too many links sent recently", slog.String(logging.KeyUserID, user.Id))
+	}
+}
+
+// deliverMagicLink stores a link for purpose & emails it to email, returning the link's ID. Internal failures are
+// logged here, callers only need to tell errMagicLinkRateLimited & errMagicLinkUndelivered apart.
+func deliverMagicLink(ctx context.Context, user models.Users, email string, purpose string, ip string, userAgent string) (string, error) {
+	// Caps how many emails anyone can make us send to one inbox
+	var recent int64
+	if err := config.DB.WithContext(ctx).Model(&models.MagicLinks{}).
+		Where("user_id = ? AND created_at > ?", user.Id, time.Now().Add(-time.Hour)).
+		Count(&recent).Error; err != nil {
+		config.Logger.WarnContext(ctx, "Database error while counting magic links", logging.Err(err))
+		return "", err
+	}
+	if recent >= constants.MAGIC_LINK_MAX_PER_HOUR {
+		return "", errMagicLinkRateLimited
+	}
+
+	token, digest, err := security.GenerateOpaqueToken()
+	if err != nil {
+		config.Logger.ErrorContext(ctx, "Could not generate magic link token", logging.Err(err))
+		return "", err
+	}
+
+	link := models.MagicLinks{
+		UserId:      user.Id,
+		Purpose:     purpose,
+		Email:       email,
+		TokenDigest: digest,
+		Ip:          ip,
+		UserAgent:   userAgent,
+		ExpiresAt:   time.Now().Add(constants.MAGIC_LINK_TTL),
+	}
+	if err := config.DB.WithContext(ctx).Create(&link).Error; err != nil {
+		config.Logger.ErrorContext(ctx, "Could not store magic link", slog.String(logging.KeyUserID, user.Id), logging.Err(err))
+		return "", err
+	}
+
+	msg := mailer.Message{To: email}
+	minutes := int(constants.MAGIC_LINK_TTL.Minutes())
+	if purpose == constants.MAGIC_LINK_PURPOSE_VERIFY_EMAIL {
+		target := fmt.Sprintf("%s?token=%s", emailVerifyURL, url.QueryEscape(token))
+		msg.Subject = "Confirm your email address"
+		msg.Text = fmt.Sprintf("Hi %s,\n\nOpen this link within the next %d minutes to confirm this is your email address:\n\n%s\n\n"+
+			"If you didn't add it to an account, you can ignore this email.\n", user.Username, minutes, target)
+	} else {
+		target := fmt.Sprintf("%s?token=%s", magicLinkURL, url.QueryEscape(token))
+		msg.Subject = "Your sign in link"
+		msg.Text = fmt.Sprintf("Hi %s,\n\nUse this link to sign in, it works once within the next %d minutes:\n\n%s\n\n"+
+			"If you didn't ask for it, you can ignore this email.\n", user.Username, minutes, target)
+	}
+
+	// Delivery is retried by the job queue, sent directly only when the queue can't take it
+	if _, err := queue.Enqueue(ctx, queue.TypeSendEmail, msg, queue.EnqueueOptions{IdempotencyKey: "magic-link:" + link.Id}); err != nil {
+		config.Logger.WarnContext(ctx, "Could not queue magic link email, sending it directly", slog.String(logging.KeyUserID, user.Id), logging.Err(err))
+
+		if err := mailer.Send(ctx, msg); err != nil {
+			config.Logger.ErrorContext(ctx, "Could not send magic link email",
+				slog.String(logging.KeyUserID, user.Id), logging.Err(err), logging.Persist(),
+			)
+			return "", errMagicLinkUndelivered
+		}
+	}
+
+	return link.Id, nil
+}
+
+// - /auth/magic-link/consume
+// No user attached to this request, this is a non authenticated route.
+func PostMagicLinkConsume(c *fiber.Ctx) error {
+	type ConsumeSchema struct {
+		Token      string `json:"token"`
+		ClientType string `json:"client_type"` // "browser" (default, cookie) or "native" (token in body)
+		RememberMe bool   `json:"remember_me"`
+	}
+
+	var data ConsumeSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	if data.ClientType == "" {
+		data.ClientType = constants.CLIENT_TYPE_BROWSER
+	} else if data.ClientType != constants.CLIENT_TYPE_BROWSER && data.ClientType != constants.CLIENT_TYPE_NATIVE {
+		return general.SendError(c, fiber.StatusBadRequest, "client_type must be browser or native")
+	}
+
+	// Email verification links only confirm the address, they never sign in
+	var link models.MagicLinks
+	if err := config.DB.WithContext(c.UserContext()).First(&link, "token_digest = ? AND purpose = ?",
+		security.DigestOpaqueToken(data.Token), constants.MAGIC_LINK_PURPOSE_SIGN_IN).Error; err != nil {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+			With("method", "magic_link").
+			With("reason", "unknown_token"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired sign in link")
+	}
+
+	if link.UsedAt != nil || time.Now().After(link.ExpiresAt) {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+			WithTarget(link.UserId).
+			With("method", "magic_link").
+			With("reason", "used_or_expired"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired sign in link")
+	}
+
+	// Not burnt on a mismatch, the user can still open it where they asked for it
+	if !magicLinkBindingMatches(link, c.IP(), c.Get(fiber.HeaderUserAgent)) {
+		config.Logger.WarnContext(c.UserContext(), "Magic link used from a different client than requested it",
+			slog.String(logging.KeyUserID, link.UserId), slog.String("binding", magicLinkBinding), logging.Persist(),
+		)
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeBlocked).
+			WithTarget(link.UserId).
+			With("method", "magic_link").
+			With("reason", "binding_mismatch"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Open the sign in link on the device & browser that asked for it")
+	}
+
+	var user models.Users
+	var session models.Sessions
+	var token string
+
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		// Only one request can mark the link used, a concurrent one loses
+		result := tx.Model(&models.MagicLinks{}).
+			Where("id = ? AND used_at IS NULL", link.Id).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return errMagicLinkUsed
+		}
+
+		if err := tx.First(&user, "id = ?", link.UserId).Error; err != nil {
+			return err
+		}
+
+		// The address was changed (& so unverified) since the link was sent
+		if !user.IsVerified || user.Email == nil || *user.Email != link.Email {
+			return errMagicLinkStale
+		}
+
+		// Create session (long-lived) record
+		if newSession, err := newSession(tx, c, user.Id, data.RememberMe); err != nil {
+			return err
+		} else {
+			session = newSession
+		}
+
+		// Generate JWT token
+		if newToken, err := security.GenerateJWT(user.Id, session.Id); err != nil {
+			return err
+		} else {
+			token = newToken
+		}
+
+		return nil
+
+	}); errors.Is(err, errMagicLinkUsed) || errors.Is(err, errMagicLinkStale) {
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired sign in link")
+	} else if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Magic link login transaction failed",
+			slog.String(logging.KeyUserID, link.UserId),
+			logging.Err(err),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Login failed")
+	}
+
+	if err := caching.DropCachedUser(c.UserContext(), user.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached user", slog.String(logging.KeyUserID, user.Id), logging.Err(err))
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("session_id", session.Id).
+		With("method", "magic_link").
+		With("client_type", data.ClientType),
+	)
+	recordNewDevice(c, session)
+
+	return sendLoginResponse(c, user, session, token, data.ClientType)
+}
+
+// - /auth/email/verify
+// No user attached to this request, this is a non authenticated route. Confirms the address an email verification
+// link was sent to, without signing in (so it isn't bound to the browser that changed the address).
+func PostEmailVerify(c *fiber.Ctx) error {
+	type VerifySchema struct {
+		Token string `json:"token"`
+	}
+
+	var data VerifySchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	var link models.MagicLinks
+	if err := config.DB.WithContext(c.UserContext()).First(&link, "token_digest = ? AND purpose = ?",
+		security.DigestOpaqueToken(data.Token), constants.MAGIC_LINK_PURPOSE_VERIFY_EMAIL).Error; err != nil {
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired verification link")
+	}
+	if link.UsedAt != nil || time.Now().After(link.ExpiresAt) {
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired verification link")
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.MagicLinks{}).
+			Where("id = ? AND used_at IS NULL", link.Id).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return errMagicLinkUsed
+		}
+
+		// Only the address the link went to, the account may have moved on to another since
+		result = tx.Model(&models.Users{}).
+			Where("id = ? AND email = ?", link.UserId, link.Email).
+			Update("is_verified", true)
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return errMagicLinkStale
+		}
+		return nil
+
+	}); errors.Is(err, errMagicLinkUsed) || errors.Is(err, errMagicLinkStale) {
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid or expired verification link")
+	} else if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Email verification transaction failed",
+			slog.String(logging.KeyUserID, link.UserId),
+			logging.Err(err),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Verification failed")
+	}
+
+	if err := caching.DropCachedUser(c.UserContext(), link.UserId); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached user", slog.String(logging.KeyUserID, link.UserId), logging.Err(err))
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindEmailVerified, audit.OutcomeSuccess).
+		WithActor(link.UserId).
+		WithTarget(link.UserId).
+		With("magic_link_id", link.Id),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Email address verified",
+	})
+}
+
+func magicLinkBindingMatches(link models.MagicLinks, ip string, userAgent string) bool {
+	switch magicLinkBinding {
+	case constants.MAGIC_LINK_BINDING_NONE:
+		return true
+	case constants.MAGIC_LINK_BINDING_IP:
+		return link.Ip == ip
+	case constants.MAGIC_LINK_BINDING_BOTH:
+		return link.Ip == ip && link.UserAgent == userAgent
+	default:
+		return link.UserAgent == userAgent
+	}
+}
@@ -0,0 +1,562 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// The frontend page that asks the user to approve a client, it's sent ?request=<id> & answers through
+// /oauth/requests/:id. It's also where a logged out user is sent to log in first.
+var oidcConsentURL = general.GetEnv("OIDC_CONSENT_URL", general.GetEnv("FRONTEND_URL", "http://localhost:3000")+"/oauth/consent")
+
+// - /.well-known/openid-configuration
+// Discovery document for apps signing users in with us, see OIDC_PROVIDER_ISSUER.
+func GetOpenIDConfiguration(c *fiber.Ctx) error {
+	if !security.OIDCProviderEnabled() {
+		return general.SendError(c, fiber.StatusNotFound, "OpenID Connect provider is not configured")
+	}
+
+	algs := []string{}
+	for _, key := range security.SigningKeys {
+		if !slices.Contains(algs, key.Method.Alg()) {
+			algs = append(algs, key.Method.Alg())
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"issuer":                                security.OIDCIssuer,
+		"authorization_endpoint":                security.OIDCIssuer + "/oauth2/authorize",
+		"token_endpoint":                        security.OIDCIssuer + "/oauth2/token",
+		"userinfo_endpoint":                     security.OIDCIssuer + "/oauth2/userinfo",
+		"jwks_uri":                              security.OIDCIssuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"scopes_supported":                      constants.OIDC_PROVIDER_SCOPES,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "sid", "preferred_username"},
+	})
+}
+
+// - /oauth2/authorize
+// No user attached to this request, the user logs in (if needed) & consents on the frontend's consent page.
+func GetOAuthAuthorize(c *fiber.Ctx) error {
+	if !security.OIDCProviderEnabled() {
+		return general.SendError(c, fiber.StatusNotFound, "OpenID Connect provider is not configured")
+	}
+
+	// Until the redirect_uri is known to be the client's, errors can't be sent back to it
+	var client models.OauthClients
+	if err := config.DB.WithContext(c.UserContext()).First(&client, "client_id = ?", c.Query("client_id")).Error; err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Unknown client_id")
+	}
+	redirectURI := c.Query("redirect_uri")
+	if !slices.Contains(strings.Fields(client.RedirectUris), redirectURI) {
+		return general.SendError(c, fiber.StatusBadRequest, "redirect_uri is not registered for this client")
+	}
+
+	state := c.Query("state")
+	redirectError := func(code string, description string) error {
+		return c.Redirect(oauthRedirectURL(redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {state},
+		}), fiber.StatusFound)
+	}
+
+	if c.Query("response_type") != "code" {
+		return redirectError("unsupported_response_type", "only the code response type is supported")
+	}
+
+	scopes := strings.Fields(c.Query("scope"))
+	if !slices.Contains(scopes, constants.OIDC_SCOPE_OPENID) {
+		return redirectError("invalid_scope", "the openid scope is required")
+	}
+	allowedScopes := strings.Fields(client.Scopes)
+	for _, scope := range scopes {
+		if !slices.Contains(constants.OIDC_PROVIDER_SCOPES, scope) || !slices.Contains(allowedScopes, scope) {
+			return redirectError("invalid_scope", "scope not allowed: "+scope)
+		}
+	}
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	// PKCE is required of every client, confidential ones included
+	if c.Query("code_challenge") == "" || c.Query("code_challenge_method") != "S256" {
+		return redirectError("invalid_request", "a S256 code_challenge is required")
+	}
+
+	requestID, _, err := security.GenerateOpaqueToken()
+	if err != nil {
+		return redirectError("server_error", "could not start authorization")
+	}
+	if err := caching.SaveOIDCAuthRequest(c.UserContext(), requestID, caching.OIDCAuthRequest{
+		ClientID:      client.Id,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         state,
+		Nonce:         c.Query("nonce"),
+		CodeChallenge: c.Query("code_challenge"),
+	}, constants.OIDC_AUTH_REQUEST_TTL); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not store OIDC authorization request", logging.Err(err))
+		return redirectError("server_error", "could not start authorization")
+	}
+
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	return c.Redirect(oauthRedirectURL(oidcConsentURL, url.Values{"request": {requestID}}), fiber.StatusFound)
+}
+
+// - /oauth/requests/:id
+// What the consent page shows, consent_required is false when the user already approved these scopes.
+func GetOAuthRequest(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+
+	request, err := caching.GetOIDCAuthRequest(c.UserContext(), c.Params("id"))
+	if errors.Is(err, redis.Nil) {
+		return general.SendError(c, fiber.StatusNotFound, "Authorization request not found or expired")
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not load authorization request")
+	}
+
+	var client models.OauthClients
+	if err := config.DB.WithContext(c.UserContext()).First(&client, "id = ?", request.ClientID).Error; err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "Client no longer exists")
+	}
+
+	consented, err := hasOAuthConsent(c, user.Id, client, request.Scopes)
+	if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"client": fiber.Map{
+			"client_id": client.ClientId,
+			"name":      client.Name,
+		},
+		"scopes":           request.Scopes,
+		"consent_required": !consented,
+	})
+}
+
+// - /oauth/requests/:id
+// Answers an authorization request, responding with where to send the browser back to the client.
+func PostOAuthRequest(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+	session, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	type ConsentSchema struct {
+		Approve bool `json:"approve"`
+	}
+
+	var data ConsentSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	request, err := caching.TakeOIDCAuthRequest(c.UserContext(), c.Params("id"))
+	if errors.Is(err, redis.Nil) {
+		return general.SendError(c, fiber.StatusNotFound, "Authorization request not found or expired")
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not load authorization request")
+	}
+
+	var client models.OauthClients
+	if err := config.DB.WithContext(c.UserContext()).First(&client, "id = ?", request.ClientID).Error; err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "Client no longer exists")
+	}
+
+	if !data.Approve {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindOAuthConsent, audit.OutcomeFailure).
+			WithActor(user.Id).
+			WithTarget(user.Id).
+			With("client_id", client.ClientId).
+			With("reason", "denied"),
+		)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"redirect_to": oauthRedirectURL(request.RedirectURI, url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"the user denied the request"},
+				"state":             {request.State},
+			}),
+		})
+	}
+
+	if !client.SkipConsent {
+		if err := saveOAuthConsent(c, user.Id, client.Id, request.Scopes); err != nil {
+			config.Logger.ErrorContext(c.UserContext(), "Could not store OAuth consent", logging.Err(err))
+			return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+		}
+	}
+
+	code, digest, err := security.GenerateOpaqueToken()
+	if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not issue authorization code")
+	}
+	if err := caching.SaveOIDCAuthCode(c.UserContext(), digest, caching.OIDCAuthCode{
+		ClientID:      client.Id,
+		UserID:        user.Id,
+		SessionID:     session.Id,
+		RedirectURI:   request.RedirectURI,
+		Scopes:        request.Scopes,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		AuthTime:      session.CreatedAt,
+	}, constants.OIDC_AUTH_CODE_TTL); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not store OIDC authorization code", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not issue authorization code")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindOAuthConsent, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("client_id", client.ClientId).
+		With("scopes", request.Scopes),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"redirect_to": oauthRedirectURL(request.RedirectURI, url.Values{
+			"code":  {code},
+			"state": {request.State},
+		}),
+	})
+}
+
+// - /oauth2/token
+// Client authenticated (client_secret_basic / client_secret_post, none for public clients). Errors follow RFC 6749.
+func PostOAuthToken(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	if !security.OIDCProviderEnabled() {
+		return sendOAuthError(c, fiber.StatusNotFound, "invalid_request", "OpenID Connect provider is not configured")
+	}
+
+	client, err := authenticateOAuthClient(c)
+	if err != nil {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth2"`)
+		return sendOAuthError(c, fiber.StatusUnauthorized, "invalid_client", err.Error())
+	}
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		return redeemAuthorizationCode(c, client)
+	case "refresh_token":
+		return redeemRefreshToken(c, client)
+	default:
+		return sendOAuthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+	}
+}
+
+func redeemAuthorizationCode(c *fiber.Ctx, client models.OauthClients) error {
+	code, err := caching.TakeOIDCAuthCode(c.UserContext(), security.DigestOpaqueToken(c.FormValue("code")))
+	if errors.Is(err, redis.Nil) {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "authorization code is invalid, used or expired")
+	} else if err != nil {
+		return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not load authorization code")
+	}
+
+	if code.ClientID != client.Id || code.RedirectURI != c.FormValue("redirect_uri") {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "authorization code was issued to another client or redirect_uri")
+	}
+	if !security.VerifyPKCE(c.FormValue("code_verifier"), code.CodeChallenge) {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+	}
+
+	// The user may have logged out since consenting
+	user, session, err := loadOAuthSession(c, code.UserID, code.SessionID)
+	if err != nil {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "the session that authorised this code has ended")
+	}
+
+	return issueOAuthTokens(c, client, user, session, code.Scopes, code.Nonce)
+}
+
+// Refresh tokens rotate, presenting a spent one means it leaked, so the whole chain for that session is revoked
+func redeemRefreshToken(c *fiber.Ctx, client models.OauthClients) error {
+	var refresh models.OauthRefreshTokens
+	if err := config.DB.WithContext(c.UserContext()).
+		First(&refresh, "token_digest = ? AND client_id = ?", security.DigestOpaqueToken(c.FormValue("refresh_token")), client.Id).Error; err != nil {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token is invalid")
+	}
+
+	if time.Now().After(refresh.ExpiresAt) {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token has expired")
+	}
+
+	// Marking it used only succeeds once, a concurrent redemption of the same token loses & counts as reuse
+	result := config.DB.WithContext(c.UserContext()).Model(&models.OauthRefreshTokens{}).
+		Where("id = ? AND used_at IS NULL", refresh.Id).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not redeem refresh token")
+	}
+	if result.RowsAffected == 0 {
+		if err := config.DB.WithContext(c.UserContext()).
+			Where("session_id = ? AND client_id = ?", refresh.SessionId, client.Id).
+			Delete(&models.OauthRefreshTokens{}).Error; err != nil {
+			config.Logger.ErrorContext(c.UserContext(), "Could not revoke reused refresh token chain", logging.Err(err))
+		}
+		config.Logger.WarnContext(c.UserContext(), "Refresh token reused, revoked the client's tokens for the session",
+			slog.String(logging.KeyUserID, refresh.UserId),
+			slog.String(logging.KeySessionID, refresh.SessionId),
+			slog.String("client_id", client.ClientId),
+			logging.Persist(),
+		)
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindTokenTampered, audit.OutcomeBlocked).
+			WithTarget(refresh.UserId).
+			With("client_id", client.ClientId).
+			With("reason", "refresh_token_reuse"),
+		)
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token has already been used")
+	}
+
+	user, session, err := loadOAuthSession(c, refresh.UserId, refresh.SessionId)
+	if err != nil {
+		return sendOAuthError(c, fiber.StatusBadRequest, "invalid_grant", "the session behind this refresh token has ended")
+	}
+
+	return issueOAuthTokens(c, client, user, session, strings.Fields(refresh.Scopes), "")
+}
+
+// Responds with an access & ID token, plus a refresh token when offline_access was granted
+func issueOAuthTokens(c *fiber.Ctx, client models.OauthClients, user models.Users, session models.Sessions, scopes []string, nonce string) error {
+	username := ""
+	if slices.Contains(scopes, constants.OIDC_SCOPE_PROFILE) {
+		username = user.Username
+	}
+
+	idToken, err := security.GenerateIDToken(client.ClientId, user.Id, session.Id, nonce, session.CreatedAt, username)
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not sign ID token", logging.Err(err))
+		return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not issue tokens")
+	}
+	accessToken, err := security.GenerateOIDCAccessToken(client.ClientId, user.Id, session.Id, strings.Join(scopes, " "))
+	if err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not sign OIDC access token", logging.Err(err))
+		return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not issue tokens")
+	}
+
+	response := fiber.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(constants.OIDC_ACCESS_TOKEN_DURATION.Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	if slices.Contains(scopes, constants.OIDC_SCOPE_OFFLINE_ACCESS) {
+		refreshToken, digest, err := security.GenerateOpaqueToken()
+		if err != nil {
+			return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not issue tokens")
+		}
+		if err := config.DB.WithContext(c.UserContext()).Create(&models.OauthRefreshTokens{
+			TokenDigest: digest,
+			ClientId:    client.Id,
+			UserId:      user.Id,
+			SessionId:   session.Id,
+			Scopes:      strings.Join(scopes, " "),
+			ExpiresAt:   session.ExpiresAt, // Never outlives the session
+		}).Error; err != nil {
+			config.Logger.ErrorContext(c.UserContext(), "Could not store refresh token", logging.Err(err))
+			return sendOAuthError(c, fiber.StatusInternalServerError, "server_error", "could not issue tokens")
+		}
+		response["refresh_token"] = refreshToken
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// - /oauth2/userinfo
+// Authenticated by an access token from /oauth2/token, which stops working once the user's session ends.
+func GetOAuthUserInfo(c *fiber.Ctx) error {
+	rawToken, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !found || rawToken == "" {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer`)
+		return sendOAuthError(c, fiber.StatusUnauthorized, "invalid_request", "a bearer access token is required")
+	}
+
+	claims, err := security.ParseOIDCAccessToken(rawToken)
+	if err != nil {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return sendOAuthError(c, fiber.StatusUnauthorized, "invalid_token", "access token is invalid or expired")
+	}
+
+	user, _, err := loadOAuthSession(c, claims.Subject, claims.SID)
+	if err != nil {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return sendOAuthError(c, fiber.StatusUnauthorized, "invalid_token", "the session behind this token has ended")
+	}
+
+	response := fiber.Map{
+		"sub": user.Id,
+	}
+	if slices.Contains(strings.Fields(claims.Scope), constants.OIDC_SCOPE_PROFILE) {
+		response["preferred_username"] = user.Username
+	}
+
+	c.Set("Cache-Control", "no-store")
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// Finds the client a token request is from, checking its secret unless it's a public client
+func authenticateOAuthClient(c *fiber.Ctx) (models.OauthClients, error) {
+	clientID, clientSecret := c.FormValue("client_id"), c.FormValue("client_secret")
+
+	// client_secret_basic, both halves are form encoded (RFC 6749 2.3.1)
+	if username, password, ok := parseBasicAuth(c.Get(fiber.HeaderAuthorization)); ok {
+		clientID, clientSecret = username, password
+	}
+
+	var client models.OauthClients
+	if clientID == "" {
+		return client, errors.New("client authentication is required")
+	}
+	if err := config.DB.WithContext(c.UserContext()).First(&client, "client_id = ?", clientID).Error; err != nil {
+		return client, errors.New("unknown client")
+	}
+
+	if client.SecretDigest == "" {
+		if clientSecret != "" {
+			return client, errors.New("public clients have no secret")
+		}
+		return client, nil
+	}
+
+	valid, err := security.CheckHash512(clientSecret, client.SecretDigest, client.SecretSalt)
+	if err != nil || !valid {
+		return client, errors.New("client authentication failed")
+	}
+	return client, nil
+}
+
+func parseBasicAuth(header string) (string, string, bool) {
+	encoded, found := strings.CutPrefix(header, "Basic ")
+	if !found {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	rawUsername, rawPassword, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+
+	username, err := url.QueryUnescape(rawUsername)
+	if err != nil {
+		return "", "", false
+	}
+	password, err := url.QueryUnescape(rawPassword)
+	if err != nil {
+		return "", "", false
+	}
+	return username, password, true
+}
+
+// Loads the user & session behind a grant, failing if either is gone (logged out, expired or deleted)
+func loadOAuthSession(c *fiber.Ctx, userID string, sessionID string) (models.Users, models.Sessions, error) {
+	var user models.Users
+	var session models.Sessions
+
+	if err := config.DB.WithContext(c.UserContext()).
+		First(&session, "id = ? AND user_id = ? AND expires_at > ?", sessionID, userID, time.Now()).Error; err != nil {
+		return user, session, err
+	}
+	if err := config.DB.WithContext(c.UserContext()).First(&user, "id = ?", userID).Error; err != nil {
+		return user, session, err
+	}
+	return user, session, nil
+}
+
+func hasOAuthConsent(c *fiber.Ctx, userID string, client models.OauthClients, scopes []string) (bool, error) {
+	if client.SkipConsent {
+		return true, nil
+	}
+
+	var consent models.OauthConsents
+	if err := config.DB.WithContext(c.UserContext()).First(&consent, "user_id = ? AND client_id = ?", userID, client.Id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	granted := strings.Fields(consent.Scopes)
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Adds scopes to a user's consent for a client
+func saveOAuthConsent(c *fiber.Ctx, userID string, clientID string, scopes []string) error {
+	return config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		var consent models.OauthConsents
+		err := tx.First(&consent, "user_id = ? AND client_id = ?", userID, clientID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&models.OauthConsents{UserId: userID, ClientId: clientID, Scopes: strings.Join(scopes, " ")}).Error
+		} else if err != nil {
+			return err
+		}
+
+		granted := append(strings.Fields(consent.Scopes), scopes...)
+		slices.Sort(granted)
+		return tx.Model(&consent).Update("scopes", strings.Join(slices.Compact(granted), " ")).Error
+	})
+}
+
+// Appends parameters to a redirect URI that may already have a query
+func oauthRedirectURL(base string, params url.Values) string {
+	for key, values := range params {
+		if len(values) == 1 && values[0] == "" {
+			delete(params, key)
+		}
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + params.Encode()
+}
+
+// RFC 6749 5.2 error response, not our usual envelope, as client libraries parse it
+func sendOAuthError(c *fiber.Ctx, status int, code string, description string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
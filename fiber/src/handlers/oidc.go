@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/mailer"
+	"api/src/lib/security"
+	"api/src/lib/sso"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// Where the browser lands once a social login (or identity link) succeeds
+var oidcSuccessRedirect = general.GetEnv("OIDC_SUCCESS_REDIRECT_URL", general.GetEnv("FRONTEND_URL", "http://localhost:3000"))
+
+// Binds a login flow to the browser that started it, so an attacker can't finish their own flow in a victim's
+// browser (login CSRF). Lax, as the provider's redirect back to us is a cross-site navigation.
+const oidcStateCookie = "oidc_state"
+
+// - /auth/oidc/providers
+// No user attached to this request, this is a non authenticated route.
+func GetOIDCProviders(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"providers": sso.ProviderNames(),
+	})
+}
+
+// - /auth/oidc/:provider/login
+// No user attached to this request, this is a non authenticated route. ?remember_me=true asks for a long session.
+func GetOIDCLogin(c *fiber.Ctx) error {
+	return startOIDCFlow(c, "", c.QueryBool("remember_me"))
+}
+
+// - /auth/oidc/:provider/link
+// Links another identity to the logged in user, sessions only.
+func GetOIDCLink(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+	return startOIDCFlow(c, user.Id, false)
+}
+
+// Sends the browser to the provider with a fresh state, nonce & PKCE verifier, remembered until it comes back
+func startOIDCFlow(c *fiber.Ctx, linkUserID string, rememberMe bool) error {
+	provider, err := sso.GetProvider(c.Params("provider"))
+	if err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "Unknown identity provider")
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not start login")
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not start login")
+	}
+	flow := caching.OIDCFlow{
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		LinkUserID:   linkUserID,
+		RememberMe:   rememberMe,
+	}
+
+	authURL, err := provider.AuthCodeURL(c.UserContext(), state, flow.Nonce, flow.CodeVerifier)
+	if err != nil {
+		return general.SendError(c, fiber.StatusBadGateway, "Identity provider unavailable")
+	}
+
+	if err := caching.SaveOIDCFlow(c.UserContext(), state, flow, constants.OIDC_FLOW_TTL); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not store OIDC login flow", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not start login")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Expires:  time.Now().Add(constants.OIDC_FLOW_TTL),
+		HTTPOnly: true,
+		Secure:   httpsOn,
+		SameSite: "Lax",
+		Path:     "/",
+	})
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// - /auth/oidc/:provider/callback
+// No user attached to this request, this is a non authenticated route.
+func GetOIDCCallback(c *fiber.Ctx) error {
+	providerName := c.Params("provider")
+	provider, err := sso.GetProvider(providerName)
+	if err != nil {
+		return general.SendError(c, fiber.StatusNotFound, "Unknown identity provider")
+	}
+
+	// The state cookie is single use, whatever happens next
+	stateCookie := c.Cookies(oidcStateCookie)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		Expires:  time.Now().Add(-(5 * time.Minute)), // In the past.
+		HTTPOnly: true,
+		Secure:   httpsOn,
+		SameSite: "Lax",
+		Path:     "/",
+	})
+	c.Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	c.Set("Pragma", "no-cache")
+
+	state := c.Query("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(stateCookie)) != 1 {
+		recordOIDCFailure(c, providerName, "state_mismatch")
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid login state")
+	}
+
+	flow, err := caching.TakeOIDCFlow(c.UserContext(), state)
+	if errors.Is(err, redis.Nil) {
+		recordOIDCFailure(c, providerName, "flow_expired")
+		return general.SendError(c, fiber.StatusBadRequest, "Login expired, please try again")
+	} else if err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not load OIDC login flow", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Login failed")
+	} else if flow.Provider != provider.Name {
+		recordOIDCFailure(c, providerName, "provider_mismatch")
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid login state")
+	}
+
+	// The user declined, or the provider refused us
+	if providerErr := c.Query("error"); providerErr != "" {
+		recordOIDCFailure(c, providerName, "provider_error")
+		return general.SendError(c, fiber.StatusUnauthorized, fmt.Sprintf("Identity provider returned %q", providerErr))
+	}
+
+	exchangeCtx, cancel := context.WithTimeout(c.UserContext(), constants.OIDC_EXCHANGE_TIMEOUT)
+	defer cancel()
+
+	identity, err := provider.Exchange(exchangeCtx, c.Query("code"), flow.CodeVerifier, flow.Nonce)
+	if err != nil {
+		config.Logger.WarnContext(c.UserContext(), "OIDC code exchange failed",
+			slog.String("provider", provider.Name), logging.Err(err), logging.Persist(),
+		)
+		recordOIDCFailure(c, providerName, "exchange_failed")
+		return general.SendError(c, fiber.StatusUnauthorized, "Could not verify identity")
+	}
+
+	if flow.LinkUserID != "" {
+		return linkOIDCIdentity(c, provider.Name, identity, flow.LinkUserID)
+	}
+	return loginOIDCIdentity(c, provider.Name, identity, flow.RememberMe)
+}
+
+// Attaches an identity to the user who started the flow, unless another user already has it
+func linkOIDCIdentity(c *fiber.Ctx, providerName string, identity sso.Identity, userID string) error {
+	var existing models.UserIdentities
+	err := config.DB.WithContext(c.UserContext()).
+		First(&existing, "provider = ? AND subject = ?", providerName, identity.Subject).Error
+
+	switch {
+	case err == nil && existing.UserId != userID:
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindIdentityLinked, audit.OutcomeFailure).
+			WithActor(userID).
+			WithTarget(userID).
+			With("provider", providerName).
+			With("reason", "linked_to_another_user"),
+		)
+		return general.SendError(c, fiber.StatusConflict, "This account is already linked to another user")
+	case err == nil:
+		return c.Redirect(oidcSuccessRedirect, fiber.StatusFound) // Already linked
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Create(newUserIdentity(userID, providerName, identity)).Error; err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Could not link identity", slog.String(logging.KeyUserID, userID), logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Could not link account")
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindIdentityLinked, audit.OutcomeSuccess).
+		WithActor(userID).
+		WithTarget(userID).
+		With("provider", providerName),
+	)
+
+	return c.Redirect(oidcSuccessRedirect, fiber.StatusFound)
+}
+
+// Logs in the user an identity belongs to. On first sight the identity is linked to the user whose verified email
+// it shares, when the provider vouches for that email too, and otherwise registers a new (passwordless) user.
+func loginOIDCIdentity(c *fiber.Ctx, providerName string, identity sso.Identity, rememberMe bool) error {
+	var user models.Users
+	var session models.Sessions
+	var token string
+	created, linked := false, false
+
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		var existing models.UserIdentities
+		err := tx.First(&existing, "provider = ? AND subject = ?", providerName, identity.Subject).Error
+
+		if err == nil {
+			if err := tx.First(&user, "id = ?", existing.UserId).Error; err != nil {
+				return err
+			}
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			owner, err := verifiedEmailOwner(tx, identity)
+			if err != nil {
+				return err
+			}
+
+			if owner != nil {
+				user = *owner
+				linked = true
+			} else {
+				username, err := availableUsername(tx, identity)
+				if err != nil {
+					return err
+				}
+
+				user = models.Users{Username: username} // No password, see PostLogin
+				if err := tx.Create(&user).Error; err != nil {
+					return err
+				}
+				created = true
+			}
+
+			if err := tx.Create(newUserIdentity(user.Id, providerName, identity)).Error; err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		// Create session (long-lived) record
+		if newSession, err := newSession(tx, c, user.Id, rememberMe); err != nil {
+			return err
+		} else {
+			session = newSession
+		}
+
+		// Generate JWT token
+		if newToken, err := security.GenerateJWT(user.Id, session.Id); err != nil {
+			return err
+		} else {
+			token = newToken
+		}
+
+		return nil
+
+	}); err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Social login transaction failed",
+			slog.String("provider", providerName),
+			logging.Err(err),
+		)
+		return general.SendError(c, fiber.StatusInternalServerError, "Login failed")
+	}
+
+	setSessionCookies(c, token, session.ExpiresAt)
+
+	if created {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindRegister, audit.OutcomeSuccess).
+			WithActor(user.Id).
+			WithTarget(user.Id).
+			With("provider", providerName),
+		)
+	} else if linked {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindIdentityLinked, audit.OutcomeSuccess).
+			WithActor(user.Id).
+			WithTarget(user.Id).
+			With("provider", providerName).
+			With("reason", "verified_email"),
+		)
+	}
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("session_id", session.Id).
+		With("provider", providerName),
+	)
+	recordNewDevice(c, session)
+
+	return c.Redirect(oidcSuccessRedirect, fiber.StatusFound)
+}
+
+// Finds the user an identity's email belongs to. Both sides must have verified it, otherwise anyone able to put
+// an address on a provider account (or on one of ours) could take over the other.
+func verifiedEmailOwner(tx *gorm.DB, identity sso.Identity) (*models.Users, error) {
+	if !identity.EmailVerified {
+		return nil, nil
+	}
+	email, ok := mailer.NormaliseAddress(identity.Email)
+	if !ok {
+		return nil, nil
+	}
+
+	var owner models.Users
+	err := tx.First(&owner, "email = ? AND is_verified = ?", email, true).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+func recordOIDCFailure(c *fiber.Ctx, providerName string, reason string) {
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindLogin, audit.OutcomeFailure).
+		With("provider", providerName).
+		With("reason", reason),
+	)
+}
+
+func newUserIdentity(userID string, providerName string, identity sso.Identity) *models.UserIdentities {
+	record := &models.UserIdentities{
+		UserId:   userID,
+		Provider: providerName,
+		Subject:  identity.Subject,
+	}
+	if identity.Email != "" {
+		record.Email = &identity.Email
+	}
+	return record
+}
+
+// Picks a username for a new social login user from their preferred username or email, adding a random
+// suffix when it's taken
+func availableUsername(tx *gorm.DB, identity sso.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = sanitiseUsername(base)
+
+	candidate := base
+	for range 5 {
+		var count int64
+		if err := tx.Model(&models.Users{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+
+		suffix, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%s", base, strings.ToLower(suffix[:6]))
+	}
+
+	return "", errors.New("could not find a free username")
+}
+
+// Keeps [A-Za-z0-9._-], within the 3 - 50 characters registration allows (leaving room for a suffix)
+func sanitiseUsername(raw string) string {
+	var b strings.Builder
+	for _, r := range raw {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		}
+	}
+
+	username := b.String()
+	if len(username) > 40 {
+		username = username[:40]
+	}
+	if len(username) < 3 {
+		username = "user" + username
+	}
+	return username
+}
+
+// 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
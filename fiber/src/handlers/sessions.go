@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// - /auth/sessions
+// The user's active sessions, newest activity first, so they can spot & revoke ones they don't recognise.
+func GetSessions(c *fiber.Ctx) error {
+	current, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	var sessions []models.Sessions
+	if err := config.DB.WithContext(c.UserContext()).
+		Where("user_id = ? AND expires_at > ?", current.UserId, time.Now()).
+		Order("last_updated_at DESC").
+		Find(&sessions).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	response := make([]fiber.Map, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, fiber.Map{
+			"id":              session.Id,
+			"device":          session.Device,
+			"ip":              session.Ip,
+			"user_agent":      session.UserAgent,
+			"is_new_device":   session.IsNewDevice,
+			"is_current":      session.Id == current.Id,
+			"impersonated":    session.ImpersonatorId != nil, // Support staff, see /admin/impersonate
+			"created_at":      session.CreatedAt,
+			"last_updated_at": session.LastUpdatedAt,
+			"expires_at":      session.ExpiresAt,
+			"remember_me":     session.RememberMe,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// - /auth/sessions/:id
+// Revokes one of the user's other sessions, the current one is ended with /auth/logout.
+func DeleteSession(c *fiber.Ctx) error {
+	current, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	sessionId := c.Params("id")
+	if _, err := uuid.Parse(sessionId); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid session id")
+	}
+	if sessionId == current.Id {
+		return general.SendError(c, fiber.StatusBadRequest, "Use /auth/logout to end the current session")
+	}
+
+	var session models.Sessions
+	if err := config.DB.WithContext(c.UserContext()).
+		First(&session, "id = ? AND user_id = ?", sessionId, current.UserId).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return general.SendError(c, fiber.StatusNotFound, "Session not found")
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	if err := config.DB.WithContext(c.UserContext()).Delete(&session).Error; err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	// Its access tokens aren't known here, but CoreMiddleware refuses them once the session is gone
+	if err := caching.DropCachedSession(c.UserContext(), session.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindSessionRevoked, audit.OutcomeSuccess).
+		WithActor(current.UserId).
+		WithTarget(current.UserId).
+		With("session_id", session.Id).
+		With("device", session.Device),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Session revoked",
+	})
+}
+
+// - /auth/step-up
+// Confirms the password for a session used from a different client than it was created on, then binds the
+// session to this client. Only needed with SESSION_BINDING_POLICY=step_up.
+func PostStepUp(c *fiber.Ctx) error {
+	user, err := general.GetReqUser(c)
+	if err != nil {
+		return err
+	}
+	session, err := general.GetReqSession(c)
+	if err != nil {
+		return err
+	}
+
+	type StepUpSchema struct {
+		RawPassword string `json:"raw_password"`
+	}
+
+	var data StepUpSchema
+	if err := c.BodyParser(&data); err != nil {
+		return general.SendError(c, fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	// Passwordless accounts (social login, magic links) prove themselves by logging in again
+	if user.Password == "" {
+		return general.SendError(c, fiber.StatusForbidden, "This account has no password, log in again instead")
+	}
+
+	hashCtx, cancelHash := context.WithTimeout(c.UserContext(), constants.HASH_QUEUE_TIMEOUT)
+	defer cancelHash()
+
+	valid, _, err := security.CheckPassword(hashCtx, data.RawPassword, user.Password)
+	if isHashingUnavailable(err) {
+		return sendHashingUnavailable(c, err)
+	} else if err != nil {
+		return general.SendError(c, fiber.StatusInternalServerError, "Authentication failed")
+	} else if !valid {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindStepUp, audit.OutcomeFailure).
+			WithActor(user.Id).
+			WithTarget(user.Id).
+			With("session_id", session.Id).
+			With("reason", "invalid_password"),
+		)
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid password")
+	}
+
+	fingerprint := security.NewFingerprint(c.IP(), c.Get(fiber.HeaderUserAgent))
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		if _, err := rememberDevice(tx, user.Id, fingerprint); err != nil {
+			return err
+		}
+		return tx.Model(&models.Sessions{}).Where("id = ?", session.Id).Updates(map[string]any{
+			"ip":         fingerprint.IP,
+			"user_agent": fingerprint.UserAgent,
+			"device":     fingerprint.Device,
+		}).Error
+	}); err != nil {
+		config.Logger.ErrorContext(c.UserContext(), "Could not bind session to new client", logging.Err(err))
+		return general.SendError(c, fiber.StatusInternalServerError, "Database error")
+	}
+
+	if err := caching.DropCachedSession(c.UserContext(), session.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindStepUp, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("session_id", session.Id).
+		With("previous_device", session.Device).
+		With("device", fingerprint.Device),
+	)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Session confirmed on this device",
+	})
+}
+
+// newSession creates a session fingerprinted with the request's client, noting whether the user has logged in
+// from that device before. Runs inside the login's transaction.
+func newSession(tx *gorm.DB, c *fiber.Ctx, userID string, rememberMe bool) (models.Sessions, error) {
+	expiresAt, absoluteExpiresAt := security.SessionExpiry(rememberMe, time.Now())
+	fingerprint := security.NewFingerprint(c.IP(), c.Get(fiber.HeaderUserAgent))
+
+	isNewDevice, err := rememberDevice(tx, userID, fingerprint)
+	if err != nil {
+		return models.Sessions{}, err
+	}
+
+	session := models.Sessions{
+		UserId:            userID,
+		ExpiresAt:         expiresAt,
+		AbsoluteExpiresAt: absoluteExpiresAt,
+		RememberMe:        rememberMe,
+		Ip:                fingerprint.IP,
+		UserAgent:         fingerprint.UserAgent,
+		Device:            fingerprint.Device,
+		IsNewDevice:       isNewDevice,
+	}
+	return session, tx.Create(&session).Error
+}
+
+// rememberDevice records a user's device, reporting whether it's new for a user who already had others (a first
+// device, i.e. at registration, isn't news).
+func rememberDevice(tx *gorm.DB, userID string, fingerprint security.Fingerprint) (bool, error) {
+	var inserted bool
+	if err := tx.Raw(`
+		INSERT INTO user_devices (user_id, device, last_ip) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, device) DO UPDATE SET last_ip = EXCLUDED.last_ip, last_seen_at = NOW()
+		RETURNING (xmax = 0)
+	`, userID, fingerprint.Device, fingerprint.IP).Scan(&inserted).Error; err != nil {
+		return false, err
+	}
+	if !inserted {
+		return false, nil
+	}
+
+	var others int64
+	if err := tx.Model(&models.UserDevices{}).
+		Where("user_id = ? AND device <> ?", userID, fingerprint.Device).
+		Count(&others).Error; err != nil {
+		return false, err
+	}
+	return others > 0, nil
+}
+
+// recordNewDevice logs & audits a login from a device the user hasn't used before.
+func recordNewDevice(c *fiber.Ctx, session models.Sessions) {
+	if !session.IsNewDevice {
+		return
+	}
+
+	config.Logger.InfoContext(c.UserContext(), "Login from a new device",
+		slog.String(logging.KeyUserID, session.UserId),
+		slog.String(logging.KeySessionID, session.Id),
+		slog.String("device", session.Device),
+		logging.Persist(),
+	)
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindNewDevice, audit.OutcomeSuccess).
+		WithActor(session.UserId).
+		WithTarget(session.UserId).
+		With("session_id", session.Id).
+		With("device", session.Device).
+		With("network", security.IPNetwork(session.Ip)),
+	)
+}
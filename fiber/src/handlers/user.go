@@ -1,10 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"log/slog"
+
 	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
 	lib "api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/mailer"
+	"api/src/middleware"
+	"api/src/models"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // - /users/me
@@ -26,24 +37,75 @@ func PatchMe(c *fiber.Ctx) error {
 
 	type UserPatchSchema struct {
 		Username *string `json:"username"`
+		Email    *string `json:"email"` // Empty string removes it
 	}
 
 	var data UserPatchSchema
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body, could not parse JSON",
-		})
+		return lib.SendError(c, fiber.StatusBadRequest, "Invalid request body, could not parse JSON")
 	}
 
 	if data.Username != nil {
 		user.Username = *data.Username
 	}
 
+	// The email address signs in through magic links, so it's as sensitive as a password
+	if data.Email != nil && middleware.GetImpersonatorID(c) != "" {
+		return lib.SendError(c, fiber.StatusForbidden, "Not allowed while impersonating")
+	}
+	if data.Email != nil && middleware.GetCredentialKind(c) == middleware.CredentialAPIKey {
+		return lib.SendError(c, fiber.StatusForbidden, "Changing the email address requires a logged in session, not an API key")
+	}
+
+	changedEmail := ""
+	if data.Email != nil {
+		if *data.Email == "" {
+			user.Email = nil
+		} else {
+			email, ok := mailer.NormaliseAddress(*data.Email)
+			if !ok {
+				return lib.SendError(c, fiber.StatusBadRequest, "Invalid email address")
+			}
+
+			if user.Email == nil || *user.Email != email {
+				var count int64
+				if err := config.DB.WithContext(c.UserContext()).Model(&models.Users{}).
+					Where("email = ? AND id <> ?", email, user.Id).Count(&count).Error; err != nil {
+					return lib.SendError(c, fiber.StatusInternalServerError, "Failed to update user")
+				} else if count > 0 {
+					return lib.SendError(c, fiber.StatusConflict, "Email address already in use")
+				}
+
+				// Unverified (& sent no sign in links) until the link emailed to it is opened
+				user.Email = &email
+				user.IsVerified = false
+				changedEmail = email
+			}
+		}
+	}
+
 	// Patch updated user
-	if err := config.DB.Save(user).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update user",
-		})
+	if err := config.DB.WithContext(c.UserContext()).Save(user).Error; err != nil {
+		return lib.SendError(c, fiber.StatusInternalServerError, "Failed to update user")
+	}
+
+	if err := caching.DropCachedUser(c.UserContext(), user.Id); err != nil {
+		config.Logger.InfoContext(c.UserContext(), "Failed to drop cached user", slog.String(logging.KeyUserID, user.Id), logging.Err(err))
+	}
+
+	if changedEmail != "" {
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindEmailChanged, audit.OutcomeSuccess).
+			WithActor(user.Id).
+			WithTarget(user.Id),
+		)
+
+		// Sent after the response like magic links, the request context doesn't survive it
+		ip, userAgent := c.IP(), c.Get(fiber.HeaderUserAgent)
+		go func(parent context.Context, user models.Users) {
+			ctx, cancel := context.WithTimeout(parent, constants.MAGIC_LINK_SEND_TIMEOUT)
+			defer cancel()
+			sendEmailVerification(ctx, user, changedEmail, ip, userAgent)
+		}(context.WithoutCancel(c.UserContext()), *user)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(user)
@@ -57,12 +119,33 @@ func DeleteMe(c *fiber.Ctx) error {
 		return err
 	}
 
-	if err := config.DB.Delete(user).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Could not delete user",
-		})
+	// The keys go with the account (ON DELETE CASCADE), their prefixes are needed to drop the cached copies
+	var prefixes []string
+	if err := config.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.ApiKeys{}).Where("user_id = ?", user.Id).Pluck("prefix", &prefixes).Error; err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	}); err != nil {
+		return lib.SendError(c, fiber.StatusInternalServerError, "Could not delete user")
 	}
 
+	// Otherwise the account's API keys keep authenticating until the cache expires
+	if err := caching.DropCachedAPIKeys(c.UserContext(), prefixes); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Failed to drop cached api keys of deleted user",
+			slog.String(logging.KeyUserID, user.Id), logging.Err(err), logging.Persist(),
+		)
+	}
+	if err := caching.DropCachedUser(c.UserContext(), user.Id); err != nil {
+		config.Logger.WarnContext(c.UserContext(), "Failed to drop cached user", slog.String(logging.KeyUserID, user.Id), logging.Err(err), logging.Persist())
+	}
+
+	audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindAccountDeleted, audit.OutcomeSuccess).
+		WithActor(user.Id).
+		WithTarget(user.Id).
+		With("username", user.Username),
+	)
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "User deleted successfully",
 	})
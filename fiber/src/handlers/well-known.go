@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"api/src/lib/security"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// - /.well-known/jwks.json
+// Public keys for verifying our JWTs, empty while tokens are HMAC signed.
+func GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(security.JWKS())
+}
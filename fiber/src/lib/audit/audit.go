@@ -0,0 +1,236 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/general"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type Kind string
+
+const (
+	KindRegister           Kind = "auth.register"
+	KindLogin              Kind = "auth.login"
+	KindLogout             Kind = "auth.logout"
+	KindMagicLinkRequested Kind = "auth.magic_link_requested"
+	KindTokenTampered      Kind = "auth.token_tampered"
+	KindTokenRevoked       Kind = "auth.token_revoked"
+	KindNewDevice          Kind = "auth.new_device"
+	KindSessionAnomaly     Kind = "auth.session_anomaly"
+	KindSessionRevoked     Kind = "auth.session_revoked"
+	KindStepUp             Kind = "auth.step_up"
+	KindImpersonationStart Kind = "admin.impersonation_started"
+	KindImpersonationEnd   Kind = "admin.impersonation_ended"
+	KindImpersonatedAction Kind = "admin.impersonated_request"
+	KindQueueJobsRetried   Kind = "admin.queue_jobs_retried"
+	KindQueueJobsPurged    Kind = "admin.queue_jobs_purged"
+	KindAccountDeleted     Kind = "user.deleted"
+	KindIdentityLinked     Kind = "user.identity_linked"
+	KindEmailChanged       Kind = "user.email_changed"
+	KindEmailVerified      Kind = "user.email_verified"
+	KindAPIKeyCreated      Kind = "api_key.created"
+	KindAPIKeyRevoked      Kind = "api_key.revoked"
+	KindOAuthConsent       Kind = "oauth.consent"
+	KindOAuthClientCreated Kind = "oauth.client_created"
+	KindOAuthClientDeleted Kind = "oauth.client_deleted"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	OutcomeBlocked Outcome = "blocked"
+)
+
+// GenesisHash is the prev_hash of the first event in the chain.
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Event describes a single security relevant action. Actor performed it, Target is the account it affected.
+type Event struct {
+	Kind      Kind
+	Outcome   Outcome
+	ActorId   string
+	TargetId  string
+	Ip        string
+	UserAgent string
+	RequestId string
+	Metadata  map[string]any
+}
+
+// NewEvent builds an event for the current request, capturing its IP, user agent & request ID.
+func NewEvent(c *fiber.Ctx, kind Kind, outcome Outcome) Event {
+	event := Event{
+		Kind:      kind,
+		Outcome:   outcome,
+		Ip:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		RequestId: general.GetReqRequestID(c),
+	}
+
+	// Anything done during impersonation names the admin really behind it
+	if impersonatorID, ok := c.Locals("impersonator_id").(string); ok && impersonatorID != "" {
+		event.Metadata = map[string]any{"impersonator_id": impersonatorID}
+	}
+	return event
+}
+
+func (e Event) WithActor(uid string) Event {
+	e.ActorId = uid
+	return e
+}
+
+func (e Event) WithTarget(uid string) Event {
+	e.TargetId = uid
+	return e
+}
+
+func (e Event) With(key string, value any) Event {
+	metadata := make(map[string]any, len(e.Metadata)+1)
+	for k, v := range e.Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+	e.Metadata = metadata
+	return e
+}
+
+// Record appends the event to the audit trail, chaining it onto the latest row.
+func Record(ctx context.Context, event Event) (*models.AuditEvents, error) {
+	rows, err := recordBatch(ctx, []Event{event})
+	if err != nil {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+// recordBatch appends events to the audit trail in order, in one transaction holding the chain lock.
+func recordBatch(ctx context.Context, events []Event) ([]models.AuditEvents, error) {
+	if config.DB == nil {
+		return nil, errors.New("no database connection")
+	}
+
+	rows := make([]models.AuditEvents, len(events))
+	for i, event := range events {
+		metadata, err := canonicalJSON(event.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode audit metadata: %w", err)
+		}
+
+		rows[i] = models.AuditEvents{
+			Kind:      string(event.Kind),
+			Outcome:   string(event.Outcome),
+			ActorId:   nullableUUID(event.ActorId),
+			TargetId:  nullableUUID(event.TargetId),
+			Ip:        event.Ip,
+			UserAgent: event.UserAgent,
+			RequestId: event.RequestId,
+			Metadata:  metadata,
+			CreatedAt: time.Now().UTC().Truncate(time.Microsecond), // Postgres precision, so the hash can be recomputed
+		}
+	}
+
+	err := config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", constants.LOCK_AUDIT_CHAIN).Error; err != nil {
+			return err
+		}
+
+		var last models.AuditEvents
+		prevHash := GenesisHash
+		if err := tx.Select("hash").Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+			return err
+		} else if last.Hash != "" {
+			prevHash = last.Hash
+		}
+
+		// Inserted in one statement, ids are assigned in slice order so the chain follows id order
+		for i := range rows {
+			rows[i].PrevHash = prevHash
+			rows[i].Hash = ComputeHash(rows[i])
+			prevHash = rows[i].Hash
+		}
+
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// ComputeHash returns the chained SHA-256 of a row, covering every column except id & hash.
+func ComputeHash(row models.AuditEvents) string {
+	metadata, err := canonicalJSON(row.Metadata)
+	if err != nil {
+		metadata = row.Metadata
+	}
+
+	fields := []string{
+		row.PrevHash,
+		row.Kind,
+		row.Outcome,
+		deref(row.ActorId),
+		deref(row.TargetId),
+		row.Ip,
+		row.UserAgent,
+		row.RequestId,
+		metadata,
+		row.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x1f")))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalJSON re-encodes metadata with sorted keys & no whitespace. Postgres normalises JSONB on the way in,
+// so hashes are always computed over this form rather than the stored text.
+func canonicalJSON(value any) (string, error) {
+	if raw, ok := value.(string); ok {
+		if raw == "" {
+			return "{}", nil
+		}
+		var decoded any
+		if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+			return "", err
+		}
+		value = decoded
+	}
+
+	if m, ok := value.(map[string]any); ok && m == nil {
+		return "{}", nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func nullableUUID(id string) *string {
+	if id == "" {
+		return nil
+	}
+	return &id
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,186 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"api/src/config"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+)
+
+const (
+	writerBufferSize  = 1024
+	writerBatchSize   = 64 // Events chained & inserted per transaction
+	dropReportPeriod  = 10 * time.Second
+	unauthenticatedPS = 20 // Unauthenticated events recorded per second, per process
+)
+
+// writer appends events queued by RecordAsync to the chain from a single goroutine. A burst of events costs one
+// chain lock per batch rather than a goroutine & a lock wait each, and the buffer bounds what a flood can queue.
+type writer struct {
+	queue   chan Event
+	done    chan struct{}
+	stop    sync.Once
+	wg      sync.WaitGroup
+	dropped atomic.Uint64 // Events not recorded since the last report
+
+	// Fixed one second window for unauthenticated events
+	windowMu    sync.Mutex
+	windowStart time.Time
+	windowCount int
+}
+
+var (
+	defaultWriter     *writer
+	defaultWriterOnce sync.Once
+)
+
+// getWriter starts the shared writer on first use, so events recorded before main gets to it aren't lost.
+func getWriter() *writer {
+	defaultWriterOnce.Do(func() {
+		defaultWriter = &writer{
+			queue: make(chan Event, writerBufferSize),
+			done:  make(chan struct{}),
+		}
+		defaultWriter.wg.Add(1)
+		go defaultWriter.run()
+	})
+	return defaultWriter
+}
+
+// RecordAsync queues the event for the audit trail without holding up the request. It never blocks: when the
+// queue is full the event is dropped, counted & reported. The event already carries the request's ID.
+func RecordAsync(ctx context.Context, event Event) {
+	getWriter().enqueue(event)
+}
+
+// RecordUnauthenticatedAsync is RecordAsync for events anyone can trigger without credentials (i.e. a forged
+// token). They share a per process rate limit, so a client can't flood the trail or crowd out other events.
+func RecordUnauthenticatedAsync(ctx context.Context, event Event) {
+	w := getWriter()
+	if !w.allowUnauthenticated(time.Now()) {
+		w.drop(metrics.AuditRateLimited)
+		return
+	}
+	w.enqueue(event)
+}
+
+// StopWriter stops accepting events & records those queued, giving up when ctx is done.
+func StopWriter(ctx context.Context) error {
+	w := getWriter()
+	w.stop.Do(func() { close(w.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *writer) enqueue(event Event) {
+	select {
+	case <-w.done:
+		w.drop(metrics.AuditStopped)
+		return
+	default:
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		w.drop(metrics.AuditOverflow)
+	}
+}
+
+func (w *writer) drop(reason string) {
+	metrics.AuditEventsDropped.WithLabelValues(reason).Inc()
+	w.dropped.Add(1)
+}
+
+func (w *writer) allowUnauthenticated(now time.Time) bool {
+	w.windowMu.Lock()
+	defer w.windowMu.Unlock()
+
+	if now.Sub(w.windowStart) >= time.Second {
+		w.windowStart, w.windowCount = now, 0
+	}
+	if w.windowCount >= unauthenticatedPS {
+		return false
+	}
+	w.windowCount++
+	return true
+}
+
+func (w *writer) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(dropReportPeriod)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, writerBatchSize)
+	for {
+		select {
+		case event := <-w.queue:
+			// Whatever else is already queued joins the batch
+			batch = append(batch, event)
+			for len(batch) < writerBatchSize && len(w.queue) > 0 {
+				batch = append(batch, <-w.queue)
+			}
+			batch = w.write(batch)
+		case <-ticker.C:
+			w.reportDrops()
+		case <-w.done:
+			for {
+				select {
+				case event := <-w.queue:
+					batch = append(batch, event)
+					if len(batch) >= writerBatchSize {
+						batch = w.write(batch)
+					}
+				default:
+					w.write(batch)
+					w.reportDrops()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *writer) write(batch []Event) []Event {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := recordBatch(ctx, batch); err != nil {
+		metrics.AuditEventsDropped.WithLabelValues(metrics.AuditFailed).Add(float64(len(batch)))
+		config.Logger.ErrorContext(ctx, "Could not record audit events",
+			slog.Int("events", len(batch)), slog.String("kind", string(batch[0].Kind)), logging.Err(err),
+		)
+	}
+
+	clear(batch)
+	return batch[:0]
+}
+
+func (w *writer) reportDrops() {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		config.Logger.Warn("Audit events were not recorded, the writer is under pressure or stopped",
+			slog.Uint64("dropped", dropped), logging.Persist(),
+		)
+	}
+}
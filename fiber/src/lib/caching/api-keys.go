@@ -0,0 +1,93 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"api/src/config"
+	"api/src/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Sets last_used_at on a cached key only if it's still cached, so a touch racing a revocation can't bring it back
+var touchScript = redis.NewScript(`
+local cached = redis.call('GET', KEYS[1])
+if not cached then
+	return 0
+end
+local key = cjson.decode(cached)
+key['last_used_at'] = ARGV[1]
+redis.call('SET', KEYS[1], cjson.encode(key), 'KEEPTTL')
+return 1
+`)
+
+// CacheAPIKey stores an API key record (digest, not the raw key) in Redis, by prefix
+func CacheAPIKey(parent context.Context, prefix string, key models.ApiKeys) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key: %w", err)
+	}
+
+	cacheKey := fmt.Sprintf("apikey:%s", prefix)
+	return config.RedisClient.Set(ctx, cacheKey, keyJSON, ttlMinutes).Err()
+}
+
+// GetCachedAPIKey retrieves an API key record from Redis
+func GetCachedAPIKey(parent context.Context, prefix string) (*models.ApiKeys, error) {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("apikey:%s", prefix)
+	keyJSON, err := config.RedisClient.Get(ctx, cacheKey).Result()
+	recordLookup("api_key", err)
+	if err != nil {
+		return nil, err // Could be redis.Nil (cache miss) or connection error
+	}
+
+	var key models.ApiKeys
+	if err := json.Unmarshal([]byte(keyJSON), &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached api key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// DropCachedAPIKey removes an API key record from Redis cache, i.e. once revoked
+func DropCachedAPIKey(parent context.Context, prefix string) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("apikey:%s", prefix)
+	return config.RedisClient.Del(ctx, cacheKey).Err()
+}
+
+// DropCachedAPIKeys removes several API key records at once, i.e. every key of a deleted account
+func DropCachedAPIKeys(parent context.Context, prefixes []string) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKeys := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		cacheKeys[i] = fmt.Sprintf("apikey:%s", prefix)
+	}
+	return config.RedisClient.Del(ctx, cacheKeys...).Err()
+}
+
+// TouchCachedAPIKey records the last use on the cached copy of an API key, leaving it uncached when it isn't.
+func TouchCachedAPIKey(parent context.Context, prefix string, at time.Time) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("apikey:%s", prefix)
+	return touchScript.Run(ctx, config.RedisClient, []string{cacheKey}, at.Format(time.RFC3339Nano)).Err()
+}
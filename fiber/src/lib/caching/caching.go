@@ -3,25 +3,41 @@ package caching
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"api/src/config"
 	"api/src/constants"
 	"api/src/lib/general"
+	"api/src/lib/metrics"
 	"api/src/models"
+
+	"github.com/redis/go-redis/v9"
 )
 
 var ttlMinutes = time.Duration(general.GetEnv("CACHE_TTL", 900)) * time.Second // Default 15 minutes
 
-// Helper function to get Redis client context with timeout
-func GetRedisContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+// Counts a cache lookup as a hit, miss or error
+func recordLookup(entity string, err error) {
+	switch {
+	case err == nil:
+		metrics.CacheOperations.WithLabelValues(entity, metrics.CacheHit).Inc()
+	case errors.Is(err, redis.Nil):
+		metrics.CacheOperations.WithLabelValues(entity, metrics.CacheMiss).Inc()
+	default:
+		metrics.CacheOperations.WithLabelValues(entity, metrics.CacheError).Inc()
+	}
+}
+
+// Helper function to get Redis client context with timeout, derived from the caller's (request) context
+func GetRedisContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
 }
 
 // CacheSession stores a session in Redis
-func CacheSession(sid string, session models.Sessions) error {
-	ctx, cancel := GetRedisContext()
+func CacheSession(parent context.Context, sid string, session models.Sessions) error {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	// Convert session to JSON
@@ -36,12 +52,13 @@ func CacheSession(sid string, session models.Sessions) error {
 }
 
 // GetCachedSession retrieves a session from Redis
-func GetCachedSession(sid string) (*models.Sessions, error) {
-	ctx, cancel := GetRedisContext()
+func GetCachedSession(parent context.Context, sid string) (*models.Sessions, error) {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	cacheKey := fmt.Sprintf("session:%s", sid)
 	sessionJSON, err := config.RedisClient.Get(ctx, cacheKey).Result()
+	recordLookup("session", err)
 	if err != nil {
 		return nil, err // Could be redis.Nil (cache miss) or connection error
 	}
@@ -56,8 +73,8 @@ func GetCachedSession(sid string) (*models.Sessions, error) {
 }
 
 // CacheUser stores a user in Redis
-func CacheUser(uid string, user models.Users) error {
-	ctx, cancel := GetRedisContext()
+func CacheUser(parent context.Context, uid string, user models.Users) error {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	// Convert user to JSON
@@ -72,12 +89,13 @@ func CacheUser(uid string, user models.Users) error {
 }
 
 // GetCachedUser retrieves a user from Redis
-func GetCachedUser(uid string) (*models.Users, error) {
-	ctx, cancel := GetRedisContext()
+func GetCachedUser(parent context.Context, uid string) (*models.Users, error) {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	cacheKey := fmt.Sprintf("user:%s", uid)
 	userJSON, err := config.RedisClient.Get(ctx, cacheKey).Result()
+	recordLookup("user", err)
 	if err != nil {
 		return nil, err // Could be redis.Nil (cache miss) or connection error
 	}
@@ -92,8 +110,8 @@ func GetCachedUser(uid string) (*models.Users, error) {
 }
 
 // DropCachedUser removes a user from Redis cache
-func DropCachedUser(uid string) error {
-	ctx, cancel := GetRedisContext()
+func DropCachedUser(parent context.Context, uid string) error {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	cacheKey := fmt.Sprintf("user:%s", uid)
@@ -101,8 +119,8 @@ func DropCachedUser(uid string) error {
 }
 
 // DropCachedSession removes a session from Redis cache
-func DropCachedSession(sid string) error {
-	ctx, cancel := GetRedisContext()
+func DropCachedSession(parent context.Context, sid string) error {
+	ctx, cancel := GetRedisContext(parent)
 	defer cancel()
 
 	cacheKey := fmt.Sprintf("session:%s", sid)
@@ -0,0 +1,36 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"api/src/config"
+)
+
+// DenyToken revokes a single access token by its jti until it would have expired anyway.
+func DenyToken(parent context.Context, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil // Already expired, nothing to deny
+	}
+
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("jwt:denied:%s", jti)
+	return config.RedisClient.Set(ctx, cacheKey, 1, ttl).Err()
+}
+
+// IsTokenDenied reports whether a token's jti has been revoked.
+func IsTokenDenied(parent context.Context, jti string) (bool, error) {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("jwt:denied:%s", jti)
+	count, err := config.RedisClient.Exists(ctx, cacheKey).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,52 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"api/src/config"
+)
+
+// OIDCFlow is what we remember between sending a browser to an identity provider & it coming back.
+type OIDCFlow struct {
+	Provider     string `json:"provider"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	LinkUserID   string `json:"link_user_id,omitempty"` // Set when a logged in user is linking an identity
+	RememberMe   bool   `json:"remember_me,omitempty"`
+}
+
+// SaveOIDCFlow stores a login flow under its state parameter until it's used or ttl passes
+func SaveOIDCFlow(parent context.Context, state string, flow OIDCFlow, ttl time.Duration) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	flowJSON, err := json.Marshal(flow)
+	if err != nil {
+		return fmt.Errorf("failed to marshal oidc flow: %w", err)
+	}
+
+	cacheKey := fmt.Sprintf("oidc:flow:%s", state)
+	return config.RedisClient.Set(ctx, cacheKey, flowJSON, ttl).Err()
+}
+
+// TakeOIDCFlow retrieves & deletes a login flow, so a state can only ever be redeemed once
+func TakeOIDCFlow(parent context.Context, state string) (*OIDCFlow, error) {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("oidc:flow:%s", state)
+	flowJSON, err := config.RedisClient.GetDel(ctx, cacheKey).Result()
+	if err != nil {
+		return nil, err // Could be redis.Nil (unknown / expired state) or connection error
+	}
+
+	var flow OIDCFlow
+	if err := json.Unmarshal([]byte(flowJSON), &flow); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal oidc flow: %w", err)
+	}
+
+	return &flow, nil
+}
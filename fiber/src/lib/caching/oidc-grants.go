@@ -0,0 +1,103 @@
+package caching
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"api/src/config"
+)
+
+// OIDCAuthRequest is a client's validated authorize request, waiting on the user's consent.
+type OIDCAuthRequest struct {
+	ClientID      string   `json:"client_id"` // oauth_clients.id, not the public client_id
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	State         string   `json:"state"`
+	Nonce         string   `json:"nonce"`
+	CodeChallenge string   `json:"code_challenge"`
+}
+
+// OIDCAuthCode is what an authorization code stands for, once the user consented.
+type OIDCAuthCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        string    `json:"user_id"`
+	SessionID     string    `json:"session_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	Nonce         string    `json:"nonce"`
+	CodeChallenge string    `json:"code_challenge"`
+	AuthTime      time.Time `json:"auth_time"`
+}
+
+// SaveOIDCAuthRequest stores an authorize request under its id until the user answers or ttl passes
+func SaveOIDCAuthRequest(parent context.Context, id string, request OIDCAuthRequest, ttl time.Duration) error {
+	return saveJSON(parent, fmt.Sprintf("oidc:authreq:%s", id), request, ttl)
+}
+
+// GetOIDCAuthRequest retrieves an authorize request, leaving it in place (the consent page reads it first)
+func GetOIDCAuthRequest(parent context.Context, id string) (*OIDCAuthRequest, error) {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	requestJSON, err := config.RedisClient.Get(ctx, fmt.Sprintf("oidc:authreq:%s", id)).Result()
+	if err != nil {
+		return nil, err // Could be redis.Nil (unknown / expired request) or connection error
+	}
+
+	var request OIDCAuthRequest
+	if err := json.Unmarshal([]byte(requestJSON), &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal oidc auth request: %w", err)
+	}
+	return &request, nil
+}
+
+// TakeOIDCAuthRequest retrieves & deletes an authorize request, so it's answered only once
+func TakeOIDCAuthRequest(parent context.Context, id string) (*OIDCAuthRequest, error) {
+	var request OIDCAuthRequest
+	if err := takeJSON(parent, fmt.Sprintf("oidc:authreq:%s", id), &request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// SaveOIDCAuthCode stores an authorization code by its digest
+func SaveOIDCAuthCode(parent context.Context, digest string, code OIDCAuthCode, ttl time.Duration) error {
+	return saveJSON(parent, fmt.Sprintf("oidc:code:%s", digest), code, ttl)
+}
+
+// TakeOIDCAuthCode retrieves & deletes an authorization code, codes are single use
+func TakeOIDCAuthCode(parent context.Context, digest string) (*OIDCAuthCode, error) {
+	var code OIDCAuthCode
+	if err := takeJSON(parent, fmt.Sprintf("oidc:code:%s", digest), &code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func saveJSON(parent context.Context, cacheKey string, value any, ttl time.Duration) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", cacheKey, err)
+	}
+	return config.RedisClient.Set(ctx, cacheKey, valueJSON, ttl).Err()
+}
+
+// takeJSON is an atomic get & delete, redis.Nil when the key doesn't exist
+func takeJSON(parent context.Context, cacheKey string, value any) error {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	valueJSON, err := config.RedisClient.GetDel(ctx, cacheKey).Result()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(valueJSON), value); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", cacheKey, err)
+	}
+	return nil
+}
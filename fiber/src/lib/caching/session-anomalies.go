@@ -0,0 +1,19 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+
+	"api/src/config"
+	"api/src/constants"
+)
+
+// MarkSessionAnomaly records that a session was used from an unexpected client, reporting whether that's new
+// within SESSION_ANOMALY_THROTTLE, so a warning isn't repeated on every request the client makes.
+func MarkSessionAnomaly(parent context.Context, sid string, client string) (bool, error) {
+	ctx, cancel := GetRedisContext(parent)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("session:anomaly:%s:%s", sid, client)
+	return config.RedisClient.SetNX(ctx, cacheKey, 1, constants.SESSION_ANOMALY_THROTTLE).Result()
+}
@@ -0,0 +1,54 @@
+package diagnostics
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, i.e. -ldflags "-X api/src/lib/diagnostics.Commit=$(git rev-parse --short HEAD)".
+// Builds of the module (rather than main.go alone) fall back to the VCS details Go stamps into the binary.
+var (
+	Commit    = ""
+	BuildTime = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	Modified  bool   `json:"modified"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// ReadBuildInfo describes the running binary, version is the API version (VERSION env).
+func ReadBuildInfo(version string) BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,172 @@
+package diagnostics
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"time"
+
+	"api/src/lib/logging"
+)
+
+// Config for the diagnostics server. It listens on its own address so it never shares a port (or nginx
+// location) with the public API, bind it to localhost or a private interface.
+type Config struct {
+	Addr    string
+	Token   string // Required as a bearer token when set
+	Version string
+}
+
+// Server exposes pprof, goroutine dumps, build info & runtime stats over plain net/http.
+type Server struct {
+	http   *http.Server
+	logger *slog.Logger
+}
+
+func NewServer(cfg Config, logger *slog.Logger) *Server {
+	mux := http.NewServeMux()
+
+	// net/http/pprof, CPU profiles & traces via /debug/pprof/profile?seconds=N and /debug/pprof/trace
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// Full stack of every goroutine, the same as /debug/pprof/goroutine?debug=2
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1<<20)
+		for {
+			n := runtime.Stack(buf, true)
+			if n < len(buf) {
+				buf = buf[:n]
+				break
+			}
+			buf = make([]byte, len(buf)*2)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf)
+	})
+
+	build := ReadBuildInfo(cfg.Version)
+	mux.HandleFunc("/debug/build", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, build)
+	})
+
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, readRuntimeStats())
+	})
+
+	return &Server{
+		http: &http.Server{
+			Addr:              cfg.Addr,
+			Handler:           requireToken(cfg.Token, mux),
+			ReadHeaderTimeout: 5 * time.Second,
+			// No write timeout, CPU profiles & traces stream for as long as requested
+		},
+		logger: logger,
+	}
+}
+
+// Start listens in the background, a failure to bind is logged rather than taking the API down with it.
+func (s *Server) Start() {
+	go func() {
+		s.logger.Info("Diagnostics server started", slog.String("address", s.http.Addr))
+		if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Diagnostics server stopped", logging.Err(err))
+		}
+	}()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Invalid diagnostics token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type runtimeStats struct {
+	Goroutines int   `json:"goroutines"`
+	GOMAXPROCS int   `json:"gomaxprocs"`
+	NumCPU     int   `json:"num_cpu"`
+	CgoCalls   int64 `json:"cgo_calls"`
+
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	HeapInuse    uint64  `json:"heap_inuse_bytes"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Sys          uint64  `json:"sys_bytes"`
+	TotalAlloc   uint64  `json:"total_alloc_bytes"`
+	StackInuse   uint64  `json:"stack_inuse_bytes"`
+	NextGC       uint64  `json:"next_gc_bytes"`
+	GCPercent    uint64  `json:"gc_percent"`
+	MemoryLimit  uint64  `json:"memory_limit_bytes"`
+	NumGC        uint32  `json:"num_gc"`
+	NumForcedGC  uint32  `json:"num_forced_gc"`
+	GCCPUPercent float64 `json:"gc_cpu_percent"`
+
+	LastGC       *time.Time `json:"last_gc"`
+	PauseTotalMs float64    `json:"gc_pause_total_ms"`
+	LastPauseMs  float64    `json:"gc_last_pause_ms"`
+}
+
+func readRuntimeStats() runtimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// GOGC & GOMEMLIMIT as currently in effect
+	settings := []metrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}}
+	metrics.Read(settings)
+
+	stats := runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		CgoCalls:     runtime.NumCgoCall(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		TotalAlloc:   mem.TotalAlloc,
+		StackInuse:   mem.StackInuse,
+		NextGC:       mem.NextGC,
+		GCPercent:    settings[0].Value.Uint64(),
+		MemoryLimit:  settings[1].Value.Uint64(),
+		NumGC:        mem.NumGC,
+		NumForcedGC:  mem.NumForcedGC,
+		GCCPUPercent: mem.GCCPUFraction * 100,
+		PauseTotalMs: float64(mem.PauseTotalNs) / 1e6,
+	}
+
+	if mem.NumGC > 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC))
+		stats.LastGC = &lastGC
+		stats.LastPauseMs = float64(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6
+	}
+
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -10,7 +10,7 @@ import (
 // Load environment variables from .env file
 var _ = godotenv.Load(".env")
 
-func GetEnv[T string | int](key string, defaultValue T) T {
+func GetEnv[T string | int | float64](key string, defaultValue T) T {
 
 	value := os.Getenv(key)
 	if value == "" {
@@ -27,6 +27,12 @@ func GetEnv[T string | int](key string, defaultValue T) T {
 		} else {
 			result = defaultValue
 		}
+	case float64:
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			result = parsed
+		} else {
+			result = defaultValue
+		}
 	}
 
 	return result.(T)
@@ -1,6 +1,8 @@
 package general
 
 import (
+	"errors"
+
 	"api/src/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -10,16 +12,44 @@ func GetReqUser(c *fiber.Ctx) (*models.Users, error) {
 	if data, ok := c.Locals("user").(models.Users); ok {
 		return &data, nil
 	}
-	return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-		"error": "Could not parse user obj attached to request",
-	})
+	return nil, SendError(c, fiber.StatusInternalServerError, "Could not parse user obj attached to request")
 }
 
 func GetReqSession(c *fiber.Ctx) (*models.Sessions, error) {
 	if data, ok := c.Locals("session").(models.Sessions); ok {
 		return &data, nil
 	}
-	return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-		"error": "Could not parse session obj attached to request",
-	})
+	return nil, SendError(c, fiber.StatusInternalServerError, "Could not parse session obj attached to request")
+}
+
+func GetReqRequestID(c *fiber.Ctx) string {
+	if id, ok := c.Locals("request_id").(string); ok {
+		return id
+	}
+	return ""
+}
+
+// SendError writes the standard error envelope, including the request ID so clients can quote it back to us.
+func SendError(c *fiber.Ctx, status int, msg string) error {
+	body := fiber.Map{
+		"error": msg,
+	}
+	if requestID := GetReqRequestID(c); requestID != "" {
+		body["request_id"] = requestID
+	}
+	return c.Status(status).JSON(body)
+}
+
+// ErrorHandler is the Fiber app level error handler, giving unhandled errors (404s, panics etc.) the same envelope.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	msg := "Internal Server Error"
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+		msg = fiberErr.Message
+	}
+
+	return SendError(c, status, msg)
 }
@@ -0,0 +1,121 @@
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LegacyID is the key id of a secret configured the old way (a single env value), and of hashes made
+// before key ids were recorded.
+const LegacyID = "0"
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring is an ordered set of versioned secrets. The first key is current and used for anything new,
+// the rest are retired: still accepted when verifying, until nothing references them any more.
+type Keyring struct {
+	keys []Key
+	byID map[string]Key
+}
+
+// Parse reads "id:secret,id:secret" with the current key first. Ids are short, made of [A-Za-z0-9_-].
+func Parse(spec string) (*Keyring, error) {
+	ring := &Keyring{byID: map[string]Key{}}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || secret == "" {
+			return nil, fmt.Errorf("keyring entry must be id:secret")
+		}
+		if !validID(id) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if _, exists := ring.byID[id]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+
+		key := Key{ID: id, Secret: []byte(secret)}
+		ring.keys = append(ring.keys, key)
+		ring.byID[id] = key
+	}
+
+	return ring, nil
+}
+
+// FromValues builds a keyring from a "id:secret,..." list, falling back to a single legacy secret (LegacyID)
+// when the list is empty. Both empty gives an empty keyring.
+func FromValues(list string, legacy string) (*Keyring, error) {
+	if strings.TrimSpace(list) == "" {
+		if legacy == "" {
+			return &Keyring{byID: map[string]Key{}}, nil
+		}
+		key := Key{ID: LegacyID, Secret: []byte(legacy)}
+		return &Keyring{keys: []Key{key}, byID: map[string]Key{LegacyID: key}}, nil
+	}
+	return Parse(list)
+}
+
+var ErrEmpty = errors.New("keyring has no keys")
+
+// Current returns the key used for signing & hashing.
+func (r *Keyring) Current() (Key, error) {
+	if len(r.keys) == 0 {
+		return Key{}, ErrEmpty
+	}
+	return r.keys[0], nil
+}
+
+// Get finds a current or retired key by id.
+func (r *Keyring) Get(id string) (Key, bool) {
+	key, ok := r.byID[id]
+	return key, ok
+}
+
+func (r *Keyring) IsCurrent(id string) bool {
+	return len(r.keys) > 0 && r.keys[0].ID == id
+}
+
+func (r *Keyring) Len() int {
+	return len(r.keys)
+}
+
+// IDs lists key ids, current first.
+func (r *Keyring) IDs() []string {
+	ids := make([]string, len(r.keys))
+	for i, key := range r.keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// Secrets lists every secret, i.e. to redact them from logs.
+func (r *Keyring) Secrets() []string {
+	secrets := make([]string, len(r.keys))
+	for i, key := range r.keys {
+		secrets[i] = string(key.Secret)
+	}
+	return secrets
+}
+
+func validID(id string) bool {
+	if len(id) == 0 || len(id) > 16 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
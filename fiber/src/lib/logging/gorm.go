@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// GormLogger routes GORM's query and driver logs through slog.
+// Bound values are left out of logged SQL unless showParams is set, they regularly hold hashes & tokens.
+type GormLogger struct {
+	logger        *slog.Logger
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+	showParams    bool
+}
+
+func NewGormLogger(logger *slog.Logger, level gormlogger.LogLevel, slowThreshold time.Duration, showParams bool) *GormLogger {
+	return &GormLogger{logger: logger, level: level, slowThreshold: slowThreshold, showParams: showParams}
+}
+
+// ParamsFilter is picked up by GORM, dropping the bound values leaves placeholders ($1, $2...) in the logged SQL.
+func (l *GormLogger) ParamsFilter(_ context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if l.showParams {
+		return sql, params
+	}
+	return sql, nil
+}
+
+func (l *GormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	clone := *l
+	clone.level = level
+	return &clone
+}
+
+func (l *GormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		l.logger.InfoContext(ctx, fmt.Sprintf(msg, args...), slog.String("component", "gorm"))
+	}
+}
+
+func (l *GormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		l.logger.WarnContext(ctx, fmt.Sprintf(msg, args...), slog.String("component", "gorm"))
+	}
+}
+
+func (l *GormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		l.logger.ErrorContext(ctx, fmt.Sprintf(msg, args...), slog.String("component", "gorm"))
+	}
+}
+
+func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	slow := l.slowThreshold > 0 && elapsed > l.slowThreshold
+
+	var level slog.Level
+	switch {
+	case err != nil && !errors.Is(err, gormlogger.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		level = slog.LevelError
+	case slow && l.level >= gormlogger.Warn:
+		level = slog.LevelWarn
+	case l.level >= gormlogger.Info:
+		level = slog.LevelDebug
+	default:
+		return
+	}
+
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	sql, rows := fc()
+	attrs := []slog.Attr{
+		slog.String("component", "gorm"),
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("elapsed_ms", float64(elapsed.Microseconds())/1000),
+	}
+	if err != nil {
+		attrs = append(attrs, Err(err))
+	}
+
+	msg := "Query executed"
+	if level == slog.LevelError {
+		msg = "Query failed"
+	} else if slow {
+		msg = "Slow query"
+	}
+
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Common attribute keys, kept consistent so log lines can be filtered & correlated.
+const (
+	KeyUserID    = "user_id"
+	KeySessionID = "session_id"
+	KeyIP        = "ip"
+	KeyRequestID = "request_id"
+	KeyRoute     = "route"
+	KeyTraceID   = "trace_id"
+	KeyError     = "error"
+
+	// The admin behind an impersonated request, user_id being the impersonated user.
+	KeyImpersonatorID = "impersonator_id"
+
+	// Marker attribute, any record carrying it is also persisted to the logs table.
+	KeyPersist = "persist"
+)
+
+// Persist marks a log record to be saved to the database alongside being written to output.
+func Persist() slog.Attr {
+	return slog.Bool(KeyPersist, true)
+}
+
+// Err wraps an error under the common error key, tolerating nil errors.
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String(KeyError, "")
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+// ParseLevel converts a level name (debug, info/notice, warn/warning, error) to a slog.Level.
+func ParseLevel(name string, fallback slog.Level) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug
+	case "info", "notice":
+		return slog.LevelInfo
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return fallback
+	}
+}
+
+// LevelCode maps a slog.Level onto the 0-3 (DEBUG, NOTICE, WARNING, ERROR) codes stored in the logs table.
+func LevelCode(level slog.Level) int16 {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 2
+	case level >= slog.LevelInfo:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// LevelName returns the display name used by this API for a slog.Level.
+func LevelName(level slog.Level) string {
+	switch LevelCode(level) {
+	case 3:
+		return "ERROR"
+	case 2:
+		return "WARNING"
+	case 1:
+		return "NOTICE"
+	default:
+		return "DEBUG"
+	}
+}
+
+// NewHandler builds the output handler, JSON for "json" and a human readable format for anything else.
+func NewHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.LevelKey {
+					if lvl, ok := a.Value.Any().(slog.Level); ok {
+						a.Value = slog.StringValue(LevelName(lvl))
+					}
+				}
+				return a
+			},
+		})
+	}
+	return NewPrettyHandler(w, level)
+}
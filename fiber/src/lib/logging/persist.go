@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"api/src/models"
+)
+
+// PersistHandler forwards every record to the next handler, additionally handing records
+// marked with Persist() to store so they end up in the logs table. store should not block.
+type PersistHandler struct {
+	next  slog.Handler
+	store func(ctx context.Context, entry models.Logs) error
+	attrs []slog.Attr
+}
+
+func NewPersistHandler(next slog.Handler, store func(ctx context.Context, entry models.Logs) error) *PersistHandler {
+	return &PersistHandler{next: next, store: store}
+}
+
+func (h *PersistHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *PersistHandler) Handle(ctx context.Context, r slog.Record) error {
+	persist := false
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	attrs := append([]slog.Attr{}, h.attrs...)
+
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == KeyPersist {
+			persist = a.Value.Resolve().Bool()
+			return true
+		}
+		out.AddAttrs(a)
+		attrs = append(attrs, a)
+		return true
+	})
+
+	if persist && h.store != nil {
+		if err := h.store(ctx, newLogEntry(r, attrs)); err != nil {
+			failed := slog.NewRecord(r.Time, slog.LevelError, "Could not create database entry for log", r.PC)
+			failed.AddAttrs(Err(err))
+			_ = h.next.Handle(ctx, failed)
+		}
+	}
+
+	return h.next.Handle(ctx, out)
+}
+
+func (h *PersistHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &PersistHandler{
+		next:  h.next.WithAttrs(attrs),
+		store: h.store,
+		attrs: append(append([]slog.Attr{}, h.attrs...), attrs...),
+	}
+}
+
+func (h *PersistHandler) WithGroup(name string) slog.Handler {
+	return &PersistHandler{next: h.next.WithGroup(name), store: h.store, attrs: h.attrs}
+}
+
+// newLogEntry maps a record onto a logs row. Context attributes with their own column are lifted out,
+// everything else is kept in the JSONB attributes column.
+func newLogEntry(r slog.Record, attrs []slog.Attr) models.Logs {
+	entry := models.Logs{
+		Message:   r.Message,
+		Level:     LevelCode(r.Level),
+		CreatedAt: r.Time,
+	}
+
+	rest := make(map[string]any, len(attrs))
+	for _, a := range attrs {
+		a.Value = a.Value.Resolve()
+		switch a.Key {
+		case KeyRequestID:
+			entry.RequestId = a.Value.String()
+		case KeyUserID:
+			if uid := a.Value.String(); uid != "" {
+				entry.UserId = &uid
+			}
+		case KeyIP:
+			entry.Ip = a.Value.String()
+		case KeyRoute:
+			entry.Route = a.Value.String()
+		default:
+			rest[a.Key] = attrValue(a.Value)
+		}
+	}
+
+	entry.Attributes = "{}"
+	if encoded, err := json.Marshal(rest); err == nil {
+		entry.Attributes = string(encoded)
+	}
+
+	return entry
+}
+
+func attrValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindGroup:
+		group := make(map[string]any, len(v.Group()))
+		for _, a := range v.Group() {
+			group[a.Key] = attrValue(a.Value.Resolve())
+		}
+		return group
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return v.String()
+	default:
+		return v.Any()
+	}
+}
@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorGrey   = "\033[90m"
+	colorCyan   = "\033[36m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorRed    = "\033[31m"
+)
+
+// PrettyHandler writes coloured, single line records intended for reading in a development terminal.
+type PrettyHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	level  slog.Leveler
+	prefix string // Group prefix applied to attribute keys
+	attrs  string // Pre-rendered attributes from WithAttrs
+}
+
+func NewPrettyHandler(w io.Writer, level slog.Leveler) *PrettyHandler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &PrettyHandler{w: w, mu: &sync.Mutex{}, level: level}
+}
+
+func (h *PrettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *PrettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+
+	if !r.Time.IsZero() {
+		b.WriteString(colorGrey)
+		b.WriteString(r.Time.Format("15:04:05.000"))
+		b.WriteString(colorReset)
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(levelColor(r.Level))
+	fmt.Fprintf(&b, "%-7s", LevelName(r.Level))
+	b.WriteString(colorReset)
+	b.WriteByte(' ')
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *PrettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		writeAttr(&b, h.prefix, a)
+	}
+
+	clone := *h
+	clone.attrs = b.String()
+	return &clone
+}
+
+func (h *PrettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, groupPrefix, ga)
+		}
+		return
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(colorCyan)
+	b.WriteString(prefix + a.Key)
+	b.WriteString(colorReset)
+	b.WriteByte('=')
+	b.WriteString(formatValue(a.Value))
+}
+
+func formatValue(v slog.Value) string {
+	var s string
+	switch v.Kind() {
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339)
+	case slog.KindDuration:
+		s = v.Duration().String()
+	default:
+		s = v.String()
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func levelColor(level slog.Level) string {
+	switch LevelCode(level) {
+	case 3:
+		return colorRed
+	case 2:
+		return colorYellow
+	case 1:
+		return colorGreen
+	default:
+		return colorGrey
+	}
+}
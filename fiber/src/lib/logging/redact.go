@@ -0,0 +1,141 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const Redacted = "[REDACTED]"
+
+// Attribute keys (case insensitive) whose values are always redacted.
+var DefaultRedactKeys = []string{
+	"password", "raw_password", "new_password", "hash", "pepper", "secret", "jwt_secret", "hash_pepper",
+	"token", "jwt_token", "access_token", "refresh_token", "api_key", "authorization", "cookie", "set-cookie",
+}
+
+// Patterns redacted wherever they appear in messages & string values.
+var DefaultRedactPatterns = []string{
+	`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,           // JWTs (header always starts {" so eyJ)
+	`\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}`,                        // bcrypt hashes
+	`\$argon2(?:id|i|d)\$v=\d+\$[^$\s]+\$[^$\s]+\$[A-Za-z0-9+/]+`, // Argon2 PHC hashes
+	`ak_[0-9a-f]{16}_[A-Za-z0-9_-]+`,                              // Personal API keys
+	`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`,                            // Authorization header values
+}
+
+// Redactor scrubs secrets from log records by key and by value pattern.
+type Redactor struct {
+	keys     map[string]struct{}
+	patterns []*regexp.Regexp
+	literals []string
+}
+
+// NewRedactor builds a redactor. literals are exact secret values (i.e. the pepper), empty ones are ignored.
+func NewRedactor(keys []string, patterns []string, literals []string) (*Redactor, error) {
+	r := &Redactor{keys: make(map[string]struct{}, len(keys))}
+
+	for _, key := range keys {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			r.keys[key] = struct{}{}
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, compiled)
+	}
+
+	for _, literal := range literals {
+		// Very short values would redact half of every line, they aren't worth treating as secrets
+		if len(literal) >= 6 {
+			r.literals = append(r.literals, literal)
+		}
+	}
+
+	return r, nil
+}
+
+// String redacts every pattern & literal secret found in s.
+func (r *Redactor) String(s string) string {
+	for _, literal := range r.literals {
+		s = strings.ReplaceAll(s, literal, Redacted)
+	}
+	for _, pattern := range r.patterns {
+		s = pattern.ReplaceAllString(s, Redacted)
+	}
+	return s
+}
+
+// Attr redacts a single attribute, recursing into groups.
+func (r *Redactor) Attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+
+	if _, ok := r.keys[strings.ToLower(a.Key)]; ok {
+		return slog.String(a.Key, Redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.String(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = r.Attr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, r.String(err.Error()))
+		}
+		// Only rewrite other values when they actually contain something to hide, to keep their structure
+		if text := fmt.Sprint(a.Value.Any()); r.String(text) != text {
+			return slog.String(a.Key, r.String(text))
+		}
+	}
+
+	return a
+}
+
+// RedactHandler applies a Redactor to every record, message included, before passing it on.
+type RedactHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func NewRedactHandler(next slog.Handler, redactor *Redactor) *RedactHandler {
+	return &RedactHandler{next: next, redactor: redactor}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, h.redactor.String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactor.Attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactor.Attr(a)
+	}
+	return &RedactHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook logs go-redis commands through slog, so commands issued with a request's context
+// carry that request's ID. Values are never logged, only the command name & key.
+type RedisHook struct {
+	logger *slog.Logger
+}
+
+func NewRedisHook(logger *slog.Logger) RedisHook {
+	return RedisHook{logger: logger}
+}
+
+func (h RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Redis dial failed", slog.String("component", "redis"), slog.String("address", addr), Err(err))
+		}
+		return conn, err
+	}
+}
+
+func (h RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.log(ctx, start, cmd.FullName(), commandKey(cmd), err)
+		return err
+	}
+}
+
+func (h RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.log(ctx, start, fmt.Sprintf("pipeline(%d)", len(cmds)), "", err)
+		return err
+	}
+}
+
+func (h RedisHook) log(ctx context.Context, start time.Time, name string, key string, err error) {
+	level := slog.LevelDebug
+	msg := "Redis command executed"
+	if err != nil && !errors.Is(err, redis.Nil) {
+		level = slog.LevelError
+		msg = "Redis command failed"
+	}
+
+	if !h.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("component", "redis"),
+		slog.String("command", name),
+		slog.Float64("elapsed_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if key != "" {
+		attrs = append(attrs, slog.String("key", key))
+	}
+	if level == slog.LevelError {
+		attrs = append(attrs, Err(err))
+	}
+
+	h.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+func commandKey(cmd redis.Cmder) string {
+	if args := cmd.Args(); len(args) > 1 {
+		if key, ok := args[1].(string); ok {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"api/src/constants"
+
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy controls the monthly partitions of the logs table.
+type RetentionPolicy struct {
+	Months         int // Whole months of logs to keep, 0 keeps logs forever
+	PartitionAhead int // Months of partitions to create ahead of the current one
+}
+
+// MaintainLogPartitions creates upcoming monthly partitions & drops those entirely older than the retention window,
+// along with rows as old caught by logs_default. It returns the names of any dropped partitions.
+//
+// Each partition is created in its own transaction, apart from the drops, so one that can't be created doesn't
+// hold up retention (or the other partitions).
+func MaintainLogPartitions(ctx context.Context, db *gorm.DB, policy RetentionPolicy, now time.Time) ([]string, error) {
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var errs []error
+	for i := 0; i <= policy.PartitionAhead; i++ {
+		partitionMonth := month.AddDate(0, i, 0)
+		if err := withRetentionLock(ctx, db, func(tx *gorm.DB) error {
+			return tx.Exec("SELECT create_logs_partition(?)", partitionMonth).Error
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to create logs partition for %s: %w", partitionMonth.Format("2006-01"), err))
+		}
+	}
+
+	if policy.Months <= 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	cutoffMonth := month.AddDate(0, -policy.Months, 0)
+
+	var dropped []string
+	if err := withRetentionLock(ctx, db, func(tx *gorm.DB) error {
+		// Partitions named logs_YYYY_MM, lexical order matches chronological order
+		cutoff := fmt.Sprintf("logs_%s", cutoffMonth.Format("2006_01"))
+
+		var partitions []string
+		if err := tx.Raw(`
+			SELECT child.relname
+			FROM pg_inherits
+			JOIN pg_class parent ON pg_inherits.inhparent = parent.oid
+			JOIN pg_class child ON pg_inherits.inhrelid = child.oid
+			WHERE parent.relname = 'logs' AND child.relname ~ '^logs_[0-9]{4}_[0-9]{2}$'
+			ORDER BY child.relname
+		`).Scan(&partitions).Error; err != nil {
+			return err
+		}
+
+		for _, partition := range partitions {
+			if partition >= cutoff {
+				break
+			}
+			if err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %q", partition)).Error; err != nil {
+				return fmt.Errorf("failed to drop logs partition %s: %w", partition, err)
+			}
+			dropped = append(dropped, partition)
+		}
+
+		// Rows from before any partition existed (or whose partition couldn't be created) age out too
+		if err := tx.Exec("DELETE FROM logs_default WHERE created_at < ?", cutoffMonth).Error; err != nil {
+			return fmt.Errorf("failed to prune logs_default: %w", err)
+		}
+		return nil
+	}); err != nil {
+		dropped = nil
+		errs = append(errs, err)
+	}
+
+	return dropped, errors.Join(errs...)
+}
+
+// withRetentionLock runs fn in a transaction holding the retention lock, skipping it when another process
+// (replica or prefork child) holds the lock.
+func withRetentionLock(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", constants.LOCK_LOG_RETENTION).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil // Another process is already on it
+		}
+		return fn(tx)
+	})
+}
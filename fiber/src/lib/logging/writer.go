@@ -0,0 +1,179 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"api/src/models"
+)
+
+// BatchWriter persists log rows off the request path. Entries are queued on a bounded buffer and written
+// in multi-row inserts when a batch fills, on every flush interval, and on Close.
+// Enqueue never blocks: once the buffer passes its high watermark only WARNING & ERROR rows are accepted,
+// and when it is full entries are dropped. Both cases are counted & reported.
+type BatchWriter struct {
+	insert        func(ctx context.Context, batch []models.Logs) error
+	logger        *slog.Logger
+	queue         chan models.Logs
+	batchSize     int
+	flushInterval time.Duration
+	highWatermark int
+
+	dropped  atomic.Uint64 // Rows dropped since the last report
+	sampled  atomic.Uint64 // Low level rows skipped under pressure since the last report
+	total    atomic.Uint64 // Rows dropped or skipped over the writer's lifetime
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type BatchWriterConfig struct {
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// NewBatchWriter starts the writer's flush loop. logger is used to report failures & drops, and must not
+// persist its own records.
+func NewBatchWriter(cfg BatchWriterConfig, logger *slog.Logger, insert func(ctx context.Context, batch []models.Logs) error) *BatchWriter {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 4096
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > cfg.BufferSize {
+		cfg.BatchSize = min(256, cfg.BufferSize)
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 2 * time.Second
+	}
+
+	w := &BatchWriter{
+		insert:        insert,
+		logger:        logger,
+		queue:         make(chan models.Logs, cfg.BufferSize),
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		highWatermark: cfg.BufferSize * 3 / 4,
+		done:          make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w
+}
+
+// Enqueue queues entry for persistence, returning false if it was dropped or sampled out.
+func (w *BatchWriter) Enqueue(entry models.Logs) bool {
+	select {
+	case <-w.done:
+		w.dropped.Add(1)
+		w.total.Add(1)
+		return false
+	default:
+	}
+
+	// Under pressure keep the rows that matter most (WARNING & ERROR)
+	if len(w.queue) >= w.highWatermark && entry.Level < 2 {
+		w.sampled.Add(1)
+		w.total.Add(1)
+		return false
+	}
+
+	select {
+	case w.queue <- entry:
+		return true
+	default:
+		w.dropped.Add(1)
+		w.total.Add(1)
+		return false
+	}
+}
+
+// Dropped returns how many rows have been dropped or sampled out since the writer started.
+func (w *BatchWriter) Dropped() uint64 {
+	return w.total.Load()
+}
+
+// Close stops accepting new rows and flushes what is queued, giving up when ctx is done.
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.stopOnce.Do(func() { close(w.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *BatchWriter) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.Logs, 0, w.batchSize)
+	for {
+		select {
+		case entry := <-w.queue:
+			batch = append(batch, entry)
+			if len(batch) >= w.batchSize {
+				batch = w.flush(batch)
+			}
+		case <-ticker.C:
+			batch = w.flush(batch)
+			w.reportDrops()
+		case <-w.done:
+			// Drain whatever made it onto the queue before shutdown
+			for {
+				select {
+				case entry := <-w.queue:
+					batch = append(batch, entry)
+					if len(batch) >= w.batchSize {
+						batch = w.flush(batch)
+					}
+				default:
+					w.flush(batch)
+					w.reportDrops()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *BatchWriter) flush(batch []models.Logs) []models.Logs {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := w.insert(ctx, batch); err != nil {
+		w.logger.Error("Could not persist batch of logs", slog.Int("rows", len(batch)), Err(err))
+	}
+
+	return batch[:0]
+}
+
+func (w *BatchWriter) reportDrops() {
+	dropped, sampled := w.dropped.Swap(0), w.sampled.Swap(0)
+	if dropped == 0 && sampled == 0 {
+		return
+	}
+	w.logger.Warn("Log persistence under backpressure, rows were not saved",
+		slog.Uint64("dropped", dropped),
+		slog.Uint64("sampled_out", sampled),
+		slog.Uint64("dropped_total", w.total.Load()),
+	)
+}
@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"api/src/config"
+
+	"github.com/google/uuid"
+)
+
+// CaptureMailer writes each message to a .eml file in Dir instead of sending it, for local development.
+// The most recent messages are also kept in memory.
+type CaptureMailer struct {
+	Dir string
+
+	mu     sync.Mutex
+	recent []Message
+}
+
+const captureKeep = 50
+
+func NewCaptureMailer(dir string) (*CaptureMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create MAIL_CAPTURE_DIR: %w", err)
+	}
+	return &CaptureMailer{Dir: dir}, nil
+}
+
+func (m *CaptureMailer) Send(ctx context.Context, msg Message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.NewString()[:8])
+	path := filepath.Join(m.Dir, name)
+
+	if err := os.WriteFile(path, buildMessage(mailFrom, msg.To, msg), 0o600); err != nil {
+		return fmt.Errorf("could not write captured mail: %w", err)
+	}
+
+	m.mu.Lock()
+	m.recent = append(m.recent, msg)
+	if len(m.recent) > captureKeep {
+		m.recent = m.recent[len(m.recent)-captureKeep:]
+	}
+	m.mu.Unlock()
+
+	// The path only, message bodies may hold sign in links
+	config.Logger.InfoContext(ctx, "Mail captured", slog.String("path", path), slog.String("subject", msg.Subject))
+	return nil
+}
+
+// Messages returns the captured messages still held in memory, oldest first.
+func (m *CaptureMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.recent...)
+}
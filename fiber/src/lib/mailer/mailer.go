@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// Mailer delivers email. Backends are picked with MAIL_BACKEND, see New.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Shared mailer, capture in development & smtp in production unless MAIL_BACKEND says otherwise.
+var Default = mustNew(general.GetEnv("MAIL_BACKEND", defaultBackend()))
+
+var mailFrom = general.GetEnv("MAIL_FROM", "Accord <no-reply@localhost>")
+
+func defaultBackend() string {
+	if general.GetEnv("NODE_ENV", "") == "production" {
+		return "smtp"
+	}
+	return "capture"
+}
+
+// New builds the named backend from its environment variables.
+func New(backend string) (Mailer, error) {
+	switch strings.ToLower(backend) {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     general.GetEnv("SMTP_HOST", "localhost"),
+			Port:     general.GetEnv("SMTP_PORT", 587),
+			Username: general.GetEnv("SMTP_USERNAME", ""),
+			Password: general.GetEnv("SMTP_PASSWORD", ""),
+			From:     mailFrom,
+		}, nil
+	case "capture":
+		return NewCaptureMailer(general.GetEnv("MAIL_CAPTURE_DIR", "./tmp/mail"))
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q, expected smtp or capture", backend)
+	}
+}
+
+func mustNew(backend string) Mailer {
+	m, err := New(backend)
+	if err != nil {
+		config.Fatal("Could not set up mailer", slog.String("backend", backend), logging.Err(err))
+		return discardMailer{}
+	}
+	if _, capturing := m.(*CaptureMailer); capturing && general.GetEnv("NODE_ENV", "") == "production" {
+		config.Logger.Warn("MAIL_BACKEND is capture in production, email is written to disk instead of being sent")
+	}
+	return m
+}
+
+// Send delivers with the shared mailer.
+func Send(ctx context.Context, msg Message) error {
+	return Default.Send(ctx, msg)
+}
+
+// Stands in when the configured backend is broken outside development, so sending fails loudly per message
+type discardMailer struct{}
+
+func (discardMailer) Send(context.Context, Message) error {
+	return fmt.Errorf("no working mailer configured")
+}
+
+// NormaliseAddress trims & lower cases a bare email address (no display name), reporting whether it's valid.
+func NormaliseAddress(raw string) (string, bool) {
+	address := strings.ToLower(strings.TrimSpace(raw))
+	if len(address) > 255 {
+		return "", false
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || parsed.Name != "" {
+		return "", false
+	}
+	return address, true
+}
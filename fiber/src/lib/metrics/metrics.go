@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+)
+
+const namespace = "api"
+
+// Registry holds every collector exposed on /metrics. A dedicated registry (rather than the global default)
+// keeps third party packages from registering series we didn't ask for.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by method, route pattern & status.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by method, route pattern & status.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"method", "route", "status"})
+
+	CacheOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_operations_total",
+		Help:      "Redis cache lookups, by cached entity & result (hit, miss, error).",
+	}, []string{"entity", "result"})
+
+	AuthOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_outcomes_total",
+		Help:      "Private route authentication outcomes (valid, missing, expired, tampered, rejected, revoked, refreshed, anomaly).",
+	}, []string{"outcome"})
+
+	PasswordHashDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Time spent hashing & verifying passwords, by algorithm & operation.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16},
+	}, []string{"algorithm", "operation"})
+
+	HashPoolQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hash_pool_queued",
+		Help:      "Password hashing jobs waiting for a worker.",
+	})
+
+	HashPoolBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hash_pool_busy_workers",
+		Help:      "Password hashing workers currently running a job.",
+	})
+
+	HashPoolWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hash_pool_wait_seconds",
+		Help:      "Time password hashing jobs spent queued before a worker picked them up.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8},
+	})
+
+	HashPoolDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hash_pool_dropped_total",
+		Help:      "Password hashing jobs not run, by reason (saturated, canceled).",
+	}, []string{"reason"})
+
+	ScheduledJobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_job_runs_total",
+		Help:      "Scheduled job runs started by this process, by job & status (succeeded, failed, skipped).",
+	}, []string{"job", "status"})
+
+	AuditEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Audit events not recorded, by reason (overflow, rate_limited, stopped, failed).",
+	}, []string{"reason"})
+
+	QueueJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_jobs_total",
+		Help:      "Background jobs worked by this process, by type & outcome (succeeded, retried, dead).",
+	}, []string{"type", "outcome"})
+)
+
+// Cache results
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+// Hash pool drop reasons
+const (
+	HashPoolSaturated = "saturated"
+	HashPoolCanceled  = "canceled"
+)
+
+// Audit event drop reasons
+const (
+	AuditOverflow    = "overflow"     // The writer's buffer was full
+	AuditRateLimited = "rate_limited" // Unauthenticated events past their rate limit
+	AuditStopped     = "stopped"      // Recorded after shutdown began
+	AuditFailed      = "failed"       // The batch insert failed
+)
+
+// Queue job outcomes
+const (
+	QueueSucceeded = "succeeded"
+	QueueRetried   = "retried"
+	QueueDead      = "dead" // Out of attempts (or failed permanently), moved to the dead letter queue
+)
+
+// Auth outcomes
+const (
+	AuthValid     = "valid"
+	AuthMissing   = "missing"
+	AuthExpired   = "expired"
+	AuthTampered  = "tampered"
+	AuthRejected  = "rejected" // Well formed token, but its session or user no longer exists
+	AuthRevoked   = "revoked"  // Token's jti is on the denylist
+	AuthRefreshed = "refreshed"
+	AuthAnomaly   = "anomaly" // Session used from a different client than it was created on, see SESSION_BINDING_POLICY
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		CacheOperations,
+		AuthOutcomes,
+		PasswordHashDuration,
+		HashPoolQueued,
+		HashPoolBusy,
+		HashPoolWait,
+		HashPoolDropped,
+		ScheduledJobRuns,
+		AuditEventsDropped,
+		QueueJobs,
+	)
+}
+
+// ObservePasswordHash records how long a hash or verify call took, use with defer & time.Now().
+func ObservePasswordHash(algorithm string, operation string, start time.Time) {
+	PasswordHashDuration.WithLabelValues(algorithm, operation).Observe(time.Since(start).Seconds())
+}
+
+// RegisterDB exposes the connection pool statistics of the Postgres (GORM) connection.
+func RegisterDB(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+// RegisterRedis exposes the connection pool statistics of the Redis client.
+func RegisterRedis(client *redis.Client) error {
+	return Registry.Register(newRedisPoolCollector(client))
+}
@@ -0,0 +1,268 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/lib/caching"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Moves a dead job back onto the stream, only if it's still dead, so two admins retrying it don't queue it twice
+var retryScript = redis.NewScript(`
+if redis.call('XDEL', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('XADD', KEYS[2], '*', ARGV[2], ARGV[3])
+return 1
+`)
+
+type Stats struct {
+	Queued  int64 `json:"queued"`  // Waiting for a worker
+	Running int64 `json:"running"` // Delivered to a worker & not yet acknowledged
+	Delayed int64 `json:"delayed"` // Waiting out a retry backoff or enqueue delay
+	Dead    int64 `json:"dead"`    // Out of attempts, see RetryDead & PurgeDead
+}
+
+// Entry is a job as listed for admins, a sensitive type's payload is left out.
+type Entry struct {
+	Job
+	EntryID  string     `json:"entry_id,omitempty"` // Dead letter stream entry, what RetryDead & PurgeDead take
+	DueAt    *time.Time `json:"due_at,omitempty"`   // Delayed jobs only
+	Redacted bool       `json:"redacted"`
+}
+
+func GetStats(parent context.Context) (Stats, error) {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	pipe := config.RedisClient.Pipeline()
+	length := pipe.XLen(ctx, streamKey)
+	pending := pipe.XPending(ctx, streamKey, consumerGroup)
+	delayed := pipe.ZCard(ctx, delayedKey)
+	dead := pipe.XLen(ctx, deadKey)
+	pipe.Exec(ctx) // Errors are per command, checked below
+
+	var stats Stats
+	var err error
+	if stats.Running, err = pendingCount(pending); err != nil {
+		return Stats{}, err
+	}
+	if stats.Queued, err = length.Result(); err != nil {
+		return Stats{}, err
+	}
+	// Acknowledged jobs are deleted from the stream, so what's left is either queued or running
+	stats.Queued -= stats.Running
+	if stats.Delayed, err = delayed.Result(); err != nil {
+		return Stats{}, err
+	}
+	if stats.Dead, err = dead.Result(); err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+// The group is only created when workers first start
+func pendingCount(cmd *redis.XPendingCmd) (int64, error) {
+	pending, err := cmd.Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return pending.Count, nil
+}
+
+// DeadJobs lists dead jobs oldest first, starting after the entry ID given (empty for the first page).
+func DeadJobs(parent context.Context, after string, count int64) ([]Entry, error) {
+	return deadJobs(parent, after, "+", count)
+}
+
+// deadJobs lists dead jobs after the entry ID given, up to & including end ("+" for the newest).
+func deadJobs(parent context.Context, after string, end string, count int64) ([]Entry, error) {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	msgs, err := config.RedisClient.XRangeN(ctx, deadKey, start, end, count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(msgs))
+	for _, msg := range msgs {
+		job, err := decodeJob(msg)
+		if err != nil {
+			entries = append(entries, Entry{EntryID: msg.ID, Job: Job{LastError: err.Error()}, Redacted: true})
+			continue
+		}
+		entries = append(entries, redact(Entry{Job: job, EntryID: msg.ID}))
+	}
+	return entries, nil
+}
+
+// DelayedJobs lists jobs waiting to be retried (or to first run), soonest first.
+func DelayedJobs(parent context.Context, count int64) ([]Entry, error) {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	members, err := config.RedisClient.ZRangeWithScores(ctx, delayedKey, 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(members))
+	for _, member := range members {
+		var job Job
+		raw, _ := member.Member.(string)
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			continue
+		}
+		due := time.UnixMilli(int64(member.Score))
+		entries = append(entries, redact(Entry{Job: job, DueAt: &due}))
+	}
+	return entries, nil
+}
+
+// Payloads of sensitive types (and of types this process doesn't know) aren't shown
+func redact(entry Entry) Entry {
+	if h, ok := lookup(entry.Type); !ok || h.Sensitive {
+		entry.Payload = nil
+		entry.Redacted = true
+	}
+	return entry
+}
+
+var ErrNotFound = errors.New("no such dead job")
+
+var entryIDPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// ValidEntryID reports whether id looks like a stream entry ID, as the dead job functions take.
+func ValidEntryID(id string) bool {
+	return entryIDPattern.MatchString(id)
+}
+
+// RetryDead queues a dead job again with its attempts reset, returning ErrNotFound when it's gone (retried or
+// purged already).
+func RetryDead(parent context.Context, entryID string) error {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	msgs, err := config.RedisClient.XRange(ctx, deadKey, entryID, entryID).Result()
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return ErrNotFound
+	}
+
+	job, err := decodeJob(msgs[0])
+	if err != nil {
+		return err
+	}
+	job.Attempts = 0
+	job.FailedAt = nil
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	retried, err := retryScript.Run(ctx, config.RedisClient, []string{deadKey, streamKey}, entryID, jobField, encoded).Int()
+	if err != nil {
+		return err
+	}
+	if retried == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RetryAllDead queues every dead job again, returning how many were. Only jobs already dead when it starts are
+// retried, one failing again meanwhile is dead lettered under a newer entry ID & left for next time.
+func RetryAllDead(ctx context.Context) (int, error) {
+	last, err := lastDeadEntryID(ctx)
+	if err != nil || last == "" {
+		return 0, err
+	}
+
+	retried := 0
+	after := ""
+	for {
+		entries, err := deadJobs(ctx, after, last, 100)
+		if err != nil {
+			return retried, err
+		}
+		if len(entries) == 0 {
+			return retried, nil
+		}
+
+		for _, entry := range entries {
+			if entry.Type == "" {
+				continue // Unreadable, only purging gets rid of it
+			}
+			if err := RetryDead(ctx, entry.EntryID); errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return retried, err
+			}
+			retried++
+		}
+
+		after = entries[len(entries)-1].EntryID
+		if after == last {
+			return retried, nil
+		}
+	}
+}
+
+// lastDeadEntryID is the newest dead job's entry ID, "" when there are none.
+func lastDeadEntryID(parent context.Context) (string, error) {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	msgs, err := config.RedisClient.XRevRangeN(ctx, deadKey, "+", "-", 1).Result()
+	if err != nil || len(msgs) == 0 {
+		return "", err
+	}
+	return msgs[0].ID, nil
+}
+
+// PurgeDead deletes one dead job, returning ErrNotFound when it's already gone.
+func PurgeDead(parent context.Context, entryID string) error {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	deleted, err := config.RedisClient.XDel(ctx, deadKey, entryID).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PurgeAllDead deletes every dead job, returning how many there were.
+func PurgeAllDead(parent context.Context) (int64, error) {
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	var length *redis.IntCmd
+	if _, err := config.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(ctx, deadKey)
+		pipe.Del(ctx, deadKey)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return length.Val(), nil
+}
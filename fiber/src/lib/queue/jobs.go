@@ -0,0 +1,21 @@
+package queue
+
+import (
+	"context"
+
+	"api/src/lib/mailer"
+)
+
+// Built-in job types
+const (
+	TypeSendEmail = "mail.send"
+)
+
+// RegisterBuiltinHandlers registers the handlers for every built-in job type, once at startup.
+func RegisterBuiltinHandlers() error {
+	// Emails can carry sign in links, so their payloads stay out of the admin API & CLI. A few quick attempts
+	// keep retries well within a link's lifetime.
+	return Register(TypeSendEmail, Options{MaxAttempts: 4, Sensitive: true}, func(ctx context.Context, msg mailer.Message) error {
+		return mailer.Send(ctx, msg)
+	})
+}
@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/caching"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys share a hash tag, so the multi key scripts & transactions below also work on a cluster
+const (
+	streamKey      = "{queue}:jobs"    // Jobs ready to run, read by the workers consumer group
+	delayedKey     = "{queue}:delayed" // Jobs waiting out a retry backoff or enqueue delay, scored by when they're due
+	deadKey        = "{queue}:dead"    // Jobs out of attempts, kept for inspection until retried or purged
+	consumerGroup  = "workers"
+	jobField       = "job" // Stream entry field holding the JSON encoded Job
+	idempotencyKey = "{queue}:idempotency:"
+)
+
+// Job is the envelope stored in Redis, Payload is the handler's type encoded as JSON.
+type Job struct {
+	ID             string          `json:"id"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"` // Failed attempts so far
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	EnqueuedAt     time.Time       `json:"enqueued_at"`
+	LastError      string          `json:"last_error,omitempty"`
+	FailedAt       *time.Time      `json:"failed_at,omitempty"`
+}
+
+// Options tune how a job type is run.
+type Options struct {
+	MaxAttempts int           // 0 uses QUEUE_DEFAULT_MAX_ATTEMPTS
+	Timeout     time.Duration // 0 uses QUEUE_DEFAULT_TIMEOUT, must stay under QUEUE_VISIBILITY_TIMEOUT
+	Sensitive   bool          // Payload holds secrets (i.e. a sign in link), hidden from the admin API & CLI
+}
+
+type handler struct {
+	Options
+	run func(ctx context.Context, payload json.RawMessage) error
+}
+
+var (
+	registryMu sync.RWMutex
+	handlers   = map[string]handler{}
+)
+
+var ErrUnknownType = errors.New("unknown job type")
+
+// Register adds the handler for a job type, at startup in every process that enqueues or works jobs. Delivery is
+// at least once, a worker dying between running a job & acknowledging it means it runs again, so handlers must
+// be safe to repeat.
+func Register[T any](jobType string, opts Options, handle func(ctx context.Context, payload T) error) error {
+	if jobType == "" || handle == nil {
+		return errors.New("a job handler needs a type & a handle function")
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = constants.QUEUE_DEFAULT_MAX_ATTEMPTS
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = constants.QUEUE_DEFAULT_TIMEOUT
+	}
+	// Past the visibility timeout a job still running is reclaimed & run a second time alongside itself
+	if opts.Timeout >= constants.QUEUE_VISIBILITY_TIMEOUT {
+		return fmt.Errorf("timeout for job type %s must be under the %s visibility timeout", jobType, constants.QUEUE_VISIBILITY_TIMEOUT)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := handlers[jobType]; exists {
+		return fmt.Errorf("job type %s is already registered", jobType)
+	}
+	handlers[jobType] = handler{
+		Options: opts,
+		run: func(ctx context.Context, raw json.RawMessage) error {
+			var payload T
+			if err := json.Unmarshal(raw, &payload); err != nil {
+				return Permanent(fmt.Errorf("invalid payload: %w", err))
+			}
+			return handle(ctx, payload)
+		},
+	}
+	return nil
+}
+
+func lookup(jobType string) (handler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	h, ok := handlers[jobType]
+	return h, ok
+}
+
+// permanentError marks a failure retrying won't fix, the job goes straight to the dead letter queue.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps a handler error so the job isn't retried (i.e. its payload refers to something deleted since).
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+type EnqueueOptions struct {
+	// Enqueuing the same key again within QUEUE_IDEMPOTENCY_TTL is a no-op returning the first job's ID
+	IdempotencyKey string
+	Delay          time.Duration
+}
+
+// Enqueue adds a job for a registered type, returning its ID. The payload is encoded as JSON.
+func Enqueue(parent context.Context, jobType string, payload any, opts EnqueueOptions) (string, error) {
+	if _, ok := lookup(jobType); !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownType, jobType)
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s payload: %w", jobType, err)
+	}
+
+	job := Job{
+		ID:             uuid.NewString(),
+		Type:           jobType,
+		Payload:        raw,
+		IdempotencyKey: opts.IdempotencyKey,
+		EnqueuedAt:     time.Now(),
+	}
+
+	ctx, cancel := caching.GetRedisContext(parent)
+	defer cancel()
+
+	if opts.IdempotencyKey != "" {
+		key := idempotencyKey + opts.IdempotencyKey
+		claimed, claimErr := config.RedisClient.SetNX(ctx, key, job.ID, constants.QUEUE_IDEMPOTENCY_TTL).Result()
+		if claimErr != nil {
+			return "", claimErr
+		}
+		if !claimed {
+			return config.RedisClient.Get(ctx, key).Result()
+		}
+
+		defer func() {
+			// Nothing was queued, let the caller try the key again
+			if err != nil {
+				releaseCtx, cancelRelease := caching.GetRedisContext(context.WithoutCancel(parent))
+				defer cancelRelease()
+				config.RedisClient.Del(releaseCtx, key)
+			}
+		}()
+	}
+
+	if opts.Delay > 0 {
+		err = schedule(ctx, config.RedisClient, job, time.Now().Add(opts.Delay))
+	} else {
+		err = push(ctx, config.RedisClient, streamKey, job)
+	}
+	if err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// push appends a job to a stream.
+func push(ctx context.Context, client redis.Cmdable, stream string, job Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return client.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: map[string]any{jobField: encoded}}).Err()
+}
+
+// schedule parks a job in the delayed set until due.
+func schedule(ctx context.Context, client redis.Cmdable, job Job, due time.Time) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return client.ZAdd(ctx, delayedKey, redis.Z{Score: float64(due.UnixMilli()), Member: encoded}).Err()
+}
+
+func decodeJob(msg redis.XMessage) (Job, error) {
+	raw, ok := msg.Values[jobField].(string)
+	if !ok {
+		return Job{}, fmt.Errorf("stream entry %s has no %s field", msg.ID, jobField)
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		return Job{}, fmt.Errorf("stream entry %s: %w", msg.ID, err)
+	}
+	return job, nil
+}
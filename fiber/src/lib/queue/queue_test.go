@@ -0,0 +1,333 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"api/src/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type testPayload struct {
+	N int `json:"n"`
+}
+
+// newTestPool points the package at a fresh in memory Redis & returns a pool (not started) on it.
+func newTestPool(t *testing.T) *Pool {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	previous := config.RedisClient
+	config.RedisClient = client
+	t.Cleanup(func() { config.RedisClient = previous })
+
+	pool := NewPool(client, slog.New(slog.NewTextHandler(io.Discard, nil)), 1)
+	if err := pool.ensureGroup(context.Background()); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	return pool
+}
+
+// registerTest adds a handler under a type unique to the test.
+func registerTest(t *testing.T, opts Options, handle func(ctx context.Context, payload testPayload) error) string {
+	t.Helper()
+
+	jobType := "test." + uuid.NewString()
+	if err := Register(jobType, opts, handle); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(handlers, jobType)
+	})
+	return jobType
+}
+
+// deliver reads the next job as a worker would & processes it, failing the test if none is queued.
+func deliver(t *testing.T, p *Pool) {
+	t.Helper()
+
+	ctx := context.Background()
+	streams, err := p.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    consumerGroup,
+		Consumer: "test",
+		Streams:  []string{streamKey, ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	if err != nil || len(streams) == 0 || len(streams[0].Messages) == 0 {
+		t.Fatalf("no job delivered: %v", err)
+	}
+	p.process(ctx, streams[0].Messages[0])
+}
+
+// makeDue brings every delayed job's due time forward to now, as if its backoff had passed.
+func makeDue(t *testing.T, p *Pool) {
+	t.Helper()
+
+	ctx := context.Background()
+	members, err := p.client.ZRange(ctx, delayedKey, 0, -1).Result()
+	if err != nil {
+		t.Fatalf("list delayed: %v", err)
+	}
+	for _, member := range members {
+		p.client.ZAddXX(ctx, delayedKey, redis.Z{Score: 0, Member: member})
+	}
+}
+
+func lengths(t *testing.T, p *Pool) (int64, int64, int64) {
+	t.Helper()
+
+	ctx := context.Background()
+	queued, _ := p.client.XLen(ctx, streamKey).Result()
+	delayed, _ := p.client.ZCard(ctx, delayedKey).Result()
+	dead, _ := p.client.XLen(ctx, deadKey).Result()
+	return queued, delayed, dead
+}
+
+func TestEnqueueIdempotencyKey(t *testing.T) {
+	p := newTestPool(t)
+	jobType := registerTest(t, Options{}, func(context.Context, testPayload) error { return nil })
+	ctx := context.Background()
+
+	first, err := Enqueue(ctx, jobType, testPayload{N: 1}, EnqueueOptions{IdempotencyKey: "same"})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	again, err := Enqueue(ctx, jobType, testPayload{N: 2}, EnqueueOptions{IdempotencyKey: "same"})
+	if err != nil {
+		t.Fatalf("enqueue again: %v", err)
+	}
+	if again != first {
+		t.Fatalf("duplicate key returned job %s, want the first job %s", again, first)
+	}
+	if queued, _, _ := lengths(t, p); queued != 1 {
+		t.Fatalf("%d jobs queued for one idempotency key, want 1", queued)
+	}
+
+	other, err := Enqueue(ctx, jobType, testPayload{N: 3}, EnqueueOptions{IdempotencyKey: "other"})
+	if err != nil || other == first {
+		t.Fatalf("a different key should queue a new job, got %s (%v)", other, err)
+	}
+	if queued, _, _ := lengths(t, p); queued != 2 {
+		t.Fatalf("%d jobs queued, want 2", queued)
+	}
+}
+
+func TestFailedJobIsDelayedThenPromoted(t *testing.T) {
+	p := newTestPool(t)
+	var runs atomic.Int32
+	jobType := registerTest(t, Options{MaxAttempts: 3}, func(context.Context, testPayload) error {
+		runs.Add(1)
+		return errors.New("temporary failure")
+	})
+	ctx := context.Background()
+
+	if _, err := Enqueue(ctx, jobType, testPayload{N: 1}, EnqueueOptions{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	deliver(t, p)
+
+	if queued, delayed, dead := lengths(t, p); queued != 0 || delayed != 1 || dead != 0 {
+		t.Fatalf("after a failure: %d queued, %d delayed, %d dead, want only the delayed retry", queued, delayed, dead)
+	}
+
+	// Not due yet, promotion leaves it
+	p.promote(ctx)
+	if queued, delayed, _ := lengths(t, p); queued != 0 || delayed != 1 {
+		t.Fatalf("a retry was promoted before its backoff passed")
+	}
+
+	makeDue(t, p)
+	p.promote(ctx)
+	if queued, delayed, _ := lengths(t, p); queued != 1 || delayed != 0 {
+		t.Fatalf("after promotion: %d queued, %d delayed, want the retry queued", queued, delayed)
+	}
+
+	msgs, _ := p.client.XRange(ctx, streamKey, "-", "+").Result()
+	job, err := decodeJob(msgs[0])
+	if err != nil || job.Attempts != 1 || job.LastError != "temporary failure" {
+		t.Fatalf("promoted job %+v (%v), want 1 attempt & its error", job, err)
+	}
+	if pending, _ := p.client.XPending(ctx, streamKey, consumerGroup).Result(); pending.Count != 0 {
+		t.Fatalf("%d deliveries left unacknowledged", pending.Count)
+	}
+}
+
+func TestJobOutOfAttemptsIsDead(t *testing.T) {
+	p := newTestPool(t)
+	var runs atomic.Int32
+	jobType := registerTest(t, Options{MaxAttempts: 3}, func(context.Context, testPayload) error {
+		runs.Add(1)
+		return errors.New("still failing")
+	})
+	ctx := context.Background()
+
+	if _, err := Enqueue(ctx, jobType, testPayload{N: 1}, EnqueueOptions{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	for range 3 {
+		deliver(t, p)
+		makeDue(t, p)
+		p.promote(ctx)
+	}
+
+	if queued, delayed, dead := lengths(t, p); queued != 0 || delayed != 0 || dead != 1 {
+		t.Fatalf("after every attempt: %d queued, %d delayed, %d dead, want only the dead job", queued, delayed, dead)
+	}
+	if runs.Load() != 3 {
+		t.Fatalf("ran %d times, want MaxAttempts (3)", runs.Load())
+	}
+
+	entries, err := DeadJobs(ctx, "", 10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("dead jobs: %v (%v)", entries, err)
+	}
+	if entries[0].Attempts != 3 || entries[0].FailedAt == nil {
+		t.Fatalf("dead job %+v, want 3 attempts & a failure time", entries[0].Job)
+	}
+
+	// A permanent error skips the retries
+	permanent := registerTest(t, Options{MaxAttempts: 3}, func(context.Context, testPayload) error {
+		return Permanent(errors.New("gone"))
+	})
+	if _, err := Enqueue(ctx, permanent, testPayload{N: 2}, EnqueueOptions{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	deliver(t, p)
+	if _, delayed, dead := lengths(t, p); delayed != 0 || dead != 2 {
+		t.Fatalf("a permanent failure was retried: %d delayed, %d dead", delayed, dead)
+	}
+}
+
+// addDead dead letters n jobs of a type directly, returning their entry IDs.
+func addDead(t *testing.T, p *Pool, jobType string, n int) []string {
+	t.Helper()
+
+	ids := make([]string, 0, n)
+	for i := range n {
+		now := time.Now()
+		encoded, _ := json.Marshal(Job{
+			ID:       uuid.NewString(),
+			Type:     jobType,
+			Payload:  json.RawMessage(`{"n":1}`),
+			Attempts: 3,
+			FailedAt: &now,
+		})
+		id, err := p.client.XAdd(context.Background(), &redis.XAddArgs{Stream: deadKey, Values: map[string]any{jobField: encoded}}).Result()
+		if err != nil {
+			t.Fatalf("dead letter job %d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestRetryDeadAndPurgeDeadRace(t *testing.T) {
+	p := newTestPool(t)
+	jobType := registerTest(t, Options{}, func(context.Context, testPayload) error { return nil })
+	ctx := context.Background()
+
+	const contenders = 8
+	var totalRetried int64
+	for _, entryID := range addDead(t, p, jobType, 20) {
+		var retried, purged, missing atomic.Int32
+		var wg sync.WaitGroup
+		for i := range contenders {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					if err = RetryDead(ctx, entryID); err == nil {
+						retried.Add(1)
+					}
+				} else if err = PurgeDead(ctx, entryID); err == nil {
+					purged.Add(1)
+				}
+				if errors.Is(err, ErrNotFound) {
+					missing.Add(1)
+				} else if err != nil {
+					t.Errorf("%s: %v", entryID, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if retried.Load()+purged.Load() != 1 || missing.Load() != contenders-1 {
+			t.Fatalf("%s: %d retried, %d purged, %d not found, want exactly one winner",
+				entryID, retried.Load(), purged.Load(), missing.Load())
+		}
+		totalRetried += int64(retried.Load())
+	}
+
+	queued, _, dead := lengths(t, p)
+	if dead != 0 || queued != totalRetried {
+		t.Fatalf("%d queued & %d dead, want the %d retried queued once each & nothing dead", queued, dead, totalRetried)
+	}
+	if err := RetryDead(ctx, "0-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("retrying an unknown entry: %v, want ErrNotFound", err)
+	}
+}
+
+func TestRetryAllDeadStopsAtJobsDeadWhenStarted(t *testing.T) {
+	p := newTestPool(t)
+	jobType := registerTest(t, Options{}, func(context.Context, testPayload) error { return nil })
+	addDead(t, p, jobType, 250)
+
+	// Jobs keep dying while it runs, as when retried jobs fail straight away again
+	encoded, _ := json.Marshal(Job{ID: uuid.NewString(), Type: jobType, Payload: json.RawMessage(`{"n":1}`)})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.client.XAdd(context.Background(), &redis.XAddArgs{Stream: deadKey, Values: map[string]any{jobField: encoded}})
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	var retried int
+	var err error
+	go func() {
+		retried, err = RetryAllDead(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("RetryAllDead kept going while jobs kept dying")
+	}
+	close(stop)
+	wg.Wait()
+
+	if err != nil || retried != 250 {
+		t.Fatalf("retried %d (%v), want the 250 dead when it started", retried, err)
+	}
+	if queued, _, _ := lengths(t, p); queued != 250 {
+		t.Fatalf("%d jobs queued, want 250", queued)
+	}
+}
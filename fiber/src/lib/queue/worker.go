@@ -0,0 +1,370 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"api/src/constants"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	readBlock       = 2 * time.Second // How long an idle worker waits on the stream, and so the longest a drain waits on one
+	promoteInterval = time.Second
+	promoteBatch    = 100
+	reclaimBatch    = 50
+	errorBackoff    = time.Second // Pause after Redis errors, so an outage doesn't spin the workers
+)
+
+var errVisibilityTimeout = errors.New("visibility timeout exceeded, the worker running it stopped responding")
+
+// Moves due jobs from the delayed set onto the stream, atomically so two processes can't both promote one
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, job in ipairs(due) do
+	redis.call('ZREM', KEYS[1], job)
+	redis.call('XADD', KEYS[2], '*', ARGV[3], job)
+end
+return #due
+`)
+
+// Pool works jobs off the stream. Every process may run one, the consumer group hands each job to one worker
+// across all of them.
+type Pool struct {
+	client  *redis.Client
+	logger  *slog.Logger
+	workers int
+	host    string
+	wg      sync.WaitGroup
+}
+
+func NewPool(client *redis.Client, logger *slog.Logger, workers int) *Pool {
+	hostname, _ := os.Hostname()
+	return &Pool{
+		client:  client,
+		logger:  logger,
+		workers: workers,
+		host:    fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+}
+
+// Start runs the workers, along with promotion of delayed jobs & reclaiming of abandoned ones, until ctx is
+// cancelled. Jobs running then are finished, see Drain.
+func (p *Pool) Start(ctx context.Context) error {
+	if err := p.ensureGroup(ctx); err != nil {
+		return err
+	}
+
+	for i := range p.workers {
+		p.wg.Add(1)
+		go p.work(ctx, fmt.Sprintf("%s:%d", p.host, i))
+	}
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		p.every(ctx, promoteInterval, p.promote)
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.every(ctx, constants.QUEUE_VISIBILITY_TIMEOUT/4, p.reclaim)
+		p.removeConsumer(context.WithoutCancel(ctx), p.reclaimer())
+	}()
+
+	p.logger.InfoContext(ctx, "Job queue workers started", slog.Int("workers", p.workers), slog.String("host", p.host))
+	return nil
+}
+
+// Drain blocks until jobs running when Start's context was cancelled have finished, or ctx is done. Jobs not
+// finished by then are left pending, and retried elsewhere once their visibility timeout passes.
+func (p *Pool) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) ensureGroup(ctx context.Context) error {
+	// Looked up first, as the Redis hook logs the BUSYGROUP error every restart would otherwise get
+	if exists, err := p.client.Exists(ctx, streamKey).Result(); err == nil && exists > 0 {
+		groups, err := p.client.XInfoGroups(ctx, streamKey).Result()
+		if err == nil && slices.ContainsFunc(groups, func(group redis.XInfoGroup) bool { return group.Name == consumerGroup }) {
+			return nil
+		}
+	}
+
+	// From the start of the stream, so jobs enqueued before any worker ever ran aren't skipped
+	err := p.client.XGroupCreateMkStream(ctx, streamKey, consumerGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("could not create job queue consumer group: %w", err)
+	}
+	return nil
+}
+
+func (p *Pool) work(ctx context.Context, consumer string) {
+	defer p.wg.Done()
+
+	// Reads outlive ctx so a job delivered as shutdown starts is still processed, rather than stranded until
+	// its visibility timeout. Shutdown is noticed between reads instead.
+	readCtx := context.WithoutCancel(ctx)
+
+	for ctx.Err() == nil {
+		streams, err := p.client.XReadGroup(readCtx, &redis.XReadGroupArgs{
+			Group:    consumerGroup,
+			Consumer: consumer,
+			Streams:  []string{streamKey, ">"},
+			Count:    1,
+			Block:    readBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			p.logger.WarnContext(ctx, "Could not read from the job queue", slog.String("consumer", consumer), logging.Err(err))
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				p.ensureGroup(readCtx)
+			}
+			sleep(ctx, errorBackoff)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				p.process(readCtx, msg)
+			}
+		}
+	}
+
+	p.removeConsumer(readCtx, consumer)
+}
+
+// removeConsumer drops a stopped worker from the group, unless it still holds jobs (they'd be lost with it).
+func (p *Pool) removeConsumer(ctx context.Context, consumer string) {
+	pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   streamKey,
+		Group:    consumerGroup,
+		Consumer: consumer,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+	}).Result()
+	if err != nil || len(pending) > 0 {
+		return
+	}
+	p.client.XGroupDelConsumer(ctx, streamKey, consumerGroup, consumer)
+}
+
+// process runs one delivered job & settles it: acknowledged on success, otherwise retried or dead lettered.
+func (p *Pool) process(ctx context.Context, msg redis.XMessage) {
+	job, err := decodeJob(msg)
+	if err != nil {
+		// Only Enqueue writes the stream, an entry nothing can read is dropped rather than retried forever
+		p.logger.ErrorContext(ctx, "Dropping unreadable job", slog.String("entry_id", msg.ID), logging.Err(err), logging.Persist())
+		p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(ctx, streamKey, consumerGroup, msg.ID)
+			pipe.XDel(ctx, streamKey, msg.ID)
+			return nil
+		})
+		return
+	}
+
+	h, ok := lookup(job.Type)
+	if !ok {
+		p.fail(ctx, msg.ID, job, Options{}, Permanent(fmt.Errorf("%w: %s", ErrUnknownType, job.Type)))
+		return
+	}
+
+	start := time.Now()
+	runCtx, cancel := context.WithTimeout(ctx, h.Timeout)
+	err = safeRun(runCtx, h.run, job.Payload)
+	cancel()
+
+	if err != nil {
+		p.fail(ctx, msg.ID, job, h.Options, err)
+		return
+	}
+
+	if _, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, streamKey, consumerGroup, msg.ID)
+		pipe.XDel(ctx, streamKey, msg.ID)
+		return nil
+	}); err != nil {
+		// It's reclaimed & run again after the visibility timeout
+		p.logger.WarnContext(ctx, "Could not acknowledge finished job", jobAttrs(job, logging.Err(err))...)
+	}
+
+	metrics.QueueJobs.WithLabelValues(job.Type, metrics.QueueSucceeded).Inc()
+	p.logger.DebugContext(ctx, "Job finished", jobAttrs(job, slog.Duration("duration", time.Since(start)))...)
+}
+
+func safeRun(ctx context.Context, run func(context.Context, json.RawMessage) error, payload json.RawMessage) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+	return run(ctx, payload)
+}
+
+// fail counts a failed attempt, scheduling a retry with backoff or moving the job to the dead letter queue once
+// it's out of attempts. The stream entry is acknowledged in the same transaction, so the job is never lost or doubled.
+func (p *Pool) fail(ctx context.Context, entryID string, job Job, opts Options, runErr error) {
+	job.Attempts++
+	job.LastError = runErr.Error()
+
+	if isPermanent(runErr) || job.Attempts >= opts.MaxAttempts {
+		now := time.Now()
+		job.FailedAt = &now
+		encoded, err := json.Marshal(job)
+		if err == nil {
+			_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.XAdd(ctx, &redis.XAddArgs{
+					Stream: deadKey,
+					MaxLen: constants.QUEUE_DEAD_LETTER_MAX,
+					Approx: true,
+					Values: map[string]any{jobField: encoded},
+				})
+				pipe.XAck(ctx, streamKey, consumerGroup, entryID)
+				pipe.XDel(ctx, streamKey, entryID)
+				return nil
+			})
+		}
+		if err != nil {
+			p.logger.ErrorContext(ctx, "Could not dead letter job", jobAttrs(job, logging.Err(err))...)
+			return
+		}
+
+		metrics.QueueJobs.WithLabelValues(job.Type, metrics.QueueDead).Inc()
+		p.logger.ErrorContext(ctx, "Job failed for good, moved to the dead letter queue",
+			jobAttrs(job, logging.Err(runErr), logging.Persist())...,
+		)
+		return
+	}
+
+	delay := backoff(job.Attempts)
+	if _, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := schedule(ctx, pipe, job, time.Now().Add(delay)); err != nil {
+			return err
+		}
+		pipe.XAck(ctx, streamKey, consumerGroup, entryID)
+		pipe.XDel(ctx, streamKey, entryID)
+		return nil
+	}); err != nil {
+		p.logger.ErrorContext(ctx, "Could not schedule job retry", jobAttrs(job, logging.Err(err))...)
+		return
+	}
+
+	metrics.QueueJobs.WithLabelValues(job.Type, metrics.QueueRetried).Inc()
+	p.logger.WarnContext(ctx, "Job failed, retrying",
+		jobAttrs(job, slog.Duration("retry_in", delay), logging.Err(runErr))...,
+	)
+}
+
+// backoff doubles from QUEUE_RETRY_BASE_DELAY per failed attempt up to QUEUE_RETRY_MAX_DELAY, then picks a point
+// in its upper half so jobs that failed together don't retry together.
+func backoff(attempts int) time.Duration {
+	delay := constants.QUEUE_RETRY_MAX_DELAY
+	if attempts < 32 {
+		delay = min(constants.QUEUE_RETRY_BASE_DELAY<<(attempts-1), constants.QUEUE_RETRY_MAX_DELAY)
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+func (p *Pool) every(ctx context.Context, interval time.Duration, task func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			task(ctx)
+		}
+	}
+}
+
+func (p *Pool) promote(ctx context.Context) {
+	if err := promoteScript.Run(ctx, p.client, []string{delayedKey, streamKey},
+		time.Now().UnixMilli(), promoteBatch, jobField,
+	).Err(); err != nil && ctx.Err() == nil {
+		p.logger.WarnContext(ctx, "Could not promote delayed jobs", logging.Err(err))
+	}
+}
+
+// reclaim takes over jobs delivered longer than the visibility timeout ago without an ack, their worker having
+// crashed or lost Redis, and counts each as a failed attempt.
+func (p *Pool) reclaim(ctx context.Context) {
+	// Claimed jobs are settled even if shutdown starts meanwhile, or they'd wait out another visibility timeout
+	settleCtx := context.WithoutCancel(ctx)
+
+	start := "0-0"
+	for ctx.Err() == nil {
+		msgs, next, err := p.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   streamKey,
+			Group:    consumerGroup,
+			Consumer: p.reclaimer(),
+			MinIdle:  constants.QUEUE_VISIBILITY_TIMEOUT,
+			Start:    start,
+			Count:    reclaimBatch,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				p.logger.WarnContext(ctx, "Could not reclaim abandoned jobs", logging.Err(err))
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			job, err := decodeJob(msg)
+			if err != nil {
+				p.process(settleCtx, msg) // Drops it
+				continue
+			}
+			h, _ := lookup(job.Type)
+			p.fail(settleCtx, msg.ID, job, h.Options, errVisibilityTimeout)
+		}
+
+		if next == "0-0" {
+			return
+		}
+		start = next
+	}
+}
+
+func (p *Pool) reclaimer() string {
+	return p.host + ":reclaimer"
+}
+
+func jobAttrs(job Job, extra ...any) []any {
+	return append([]any{
+		slog.String("job_id", job.ID),
+		slog.String("job_type", job.Type),
+		slog.Int("attempts", job.Attempts),
+	}, extra...)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
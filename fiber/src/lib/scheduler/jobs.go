@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/models"
+)
+
+var logRetention = logging.RetentionPolicy{
+	Months:         general.GetEnv("LOG_RETENTION_MONTHS", 6),
+	PartitionAhead: general.GetEnv("LOG_PARTITIONS_AHEAD", 2),
+}
+
+// BuiltinJobs are the jobs the API ships with.
+func BuiltinJobs() []Job {
+	return []Job{
+		{
+			// CoreMiddleware checks expiry itself, this only keeps the table small
+			Name:     "session-cleanup",
+			Schedule: "* * * * *",
+			Jitter:   10 * time.Second,
+			Run: func(ctx context.Context) (string, error) {
+				result := config.DB.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&models.Sessions{})
+				return fmt.Sprintf("deleted %d sessions", result.RowsAffected), result.Error
+			},
+		},
+		{
+			// At startup too, so this month's partition exists before anything is logged to it
+			Name:         "log-retention",
+			Schedule:     "@hourly",
+			Jitter:       time.Minute,
+			RunAtStartup: true,
+			Run: func(ctx context.Context) (string, error) {
+				dropped, err := logging.MaintainLogPartitions(ctx, config.DB, logRetention, time.Now().UTC())
+				if len(dropped) == 0 {
+					return "no partitions dropped", err
+				}
+				return "dropped " + strings.Join(dropped, ", "), err
+			},
+		},
+		{
+			Name:     "token-purge",
+			Schedule: "*/15 * * * *",
+			Jitter:   time.Minute,
+			Run: func(ctx context.Context) (string, error) {
+				// Kept an hour past expiry, they still count towards MAGIC_LINK_MAX_PER_HOUR
+				links := config.DB.WithContext(ctx).
+					Where("expires_at < ?", time.Now().Add(-time.Hour)).
+					Delete(&models.MagicLinks{})
+				if links.Error != nil {
+					return "", links.Error
+				}
+
+				// Spent refresh tokens are kept until they expire, a replay must still be recognised as reuse
+				refreshTokens := config.DB.WithContext(ctx).
+					Where("expires_at < ?", time.Now()).
+					Delete(&models.OauthRefreshTokens{})
+
+				return fmt.Sprintf("deleted %d magic links & %d refresh tokens", links.RowsAffected, refreshTokens.RowsAffected), refreshTokens.Error
+			},
+		},
+		{
+			Name:     "job-run-purge",
+			Schedule: "@daily",
+			Jitter:   5 * time.Minute,
+			Run: func(ctx context.Context) (string, error) {
+				result := config.DB.WithContext(ctx).
+					Where("started_at < ?", time.Now().Add(-constants.JOB_RUN_RETENTION)).
+					Delete(&models.JobRuns{})
+				return fmt.Sprintf("deleted %d job runs", result.RowsAffected), result.Error
+			},
+		},
+	}
+}
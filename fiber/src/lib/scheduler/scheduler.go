@@ -0,0 +1,263 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"api/src/constants"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+	"api/src/models"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Run statuses, as stored in job_runs
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped" // The job's previous run was still going
+)
+
+const DefaultTimeout = 5 * time.Minute
+
+// Job is a task run on a cron schedule, by exactly one process across every replica & prefork child.
+type Job struct {
+	Name         string
+	Schedule     string        // Standard 5 field cron expression or a descriptor (@hourly, @every 10m)
+	Jitter       time.Duration // Random delay of up to this much per run, so jobs sharing a schedule don't start at once
+	Timeout      time.Duration // 0 uses DefaultTimeout
+	RunAtStartup bool          // Also run when the scheduler starts, every process does so the job must be idempotent
+
+	// Run does the work, returning a short summary for the run history (i.e. "deleted 12 sessions")
+	Run func(ctx context.Context) (string, error)
+}
+
+// NextRun is when a job is next due after now.
+func NextRun(job Job, now time.Time) (time.Time, error) {
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(now), nil
+}
+
+type scheduledJob struct {
+	Job
+	schedule cron.Schedule
+}
+
+// Scheduler runs registered jobs on their schedules. Every process may run one: each scheduled run is claimed
+// with a unique (job, scheduled_at) row in job_runs, so only the first process to claim it runs it, and a
+// Postgres advisory lock keeps a job from overlapping a previous run that's still going elsewhere.
+type Scheduler struct {
+	db     *gorm.DB
+	logger *slog.Logger
+	host   string
+	jobs   []scheduledJob
+	wg     sync.WaitGroup
+}
+
+func New(db *gorm.DB, logger *slog.Logger) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		db:     db,
+		logger: logger,
+		host:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+}
+
+// Register adds a job, before Start.
+func (s *Scheduler) Register(job Job) error {
+	if job.Name == "" || job.Run == nil {
+		return errors.New("a job needs a name & a run function")
+	}
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule for job %s: %w", job.Name, err)
+	}
+	if job.Timeout <= 0 {
+		job.Timeout = DefaultTimeout
+	}
+
+	s.jobs = append(s.jobs, scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// Start runs every job on its schedule until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, job)
+	}
+	s.logger.InfoContext(ctx, "Scheduler started", slog.Int("jobs", len(s.jobs)), slog.String("host", s.host))
+}
+
+// Wait blocks until runs in progress when Start's context was cancelled have finished, or ctx is done.
+func (s *Scheduler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job scheduledJob) {
+	defer s.wg.Done()
+
+	if job.RunAtStartup {
+		s.run(ctx, job, time.Now().Truncate(time.Second))
+	}
+
+	for {
+		// Runs are sequential within a process, a run overlapping its next slot just skips it
+		next := job.schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.run(ctx, job, next)
+		}
+	}
+}
+
+// run claims one scheduled run of a job & carries it out if the claim (and the job's lock) are ours.
+func (s *Scheduler) run(ctx context.Context, job scheduledJob, slot time.Time) {
+	// The slot stays the scheduled time, so every process competes for the same row
+	if job.Jitter > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rand.N(job.Jitter)):
+		}
+	}
+
+	attrs := []any{slog.String("job", job.Name), slog.Time("scheduled_at", slot)}
+
+	record := models.JobRuns{
+		Job:         job.Name,
+		ScheduledAt: slot,
+		StartedAt:   time.Now(),
+		Status:      StatusRunning,
+		Host:        s.host,
+	}
+	claim := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if claim.Error != nil {
+		s.logger.WarnContext(ctx, "Could not claim scheduled job run", append(attrs, logging.Err(claim.Error))...)
+		return
+	} else if claim.RowsAffected == 0 {
+		return // Another process has it
+	}
+
+	// Runs in progress finish on shutdown, bounded by their timeout
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), job.Timeout)
+	defer cancel()
+
+	unlock, locked, err := s.lock(runCtx, job.Name)
+	if err != nil {
+		s.finish(runCtx, record, StatusFailed, "", err, attrs)
+		return
+	} else if !locked {
+		s.finish(runCtx, record, StatusSkipped, "previous run still in progress", nil, attrs)
+		return
+	}
+	defer unlock()
+
+	summary, err := safeRun(runCtx, job.Run)
+	if err != nil {
+		s.finish(runCtx, record, StatusFailed, summary, err, attrs)
+		return
+	}
+	s.finish(runCtx, record, StatusSucceeded, summary, nil, attrs)
+}
+
+func safeRun(ctx context.Context, run func(context.Context) (string, error)) (summary string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+	return run(ctx)
+}
+
+// finish records the outcome of a run in job_runs, the logs & metrics.
+func (s *Scheduler) finish(ctx context.Context, record models.JobRuns, status string, summary string, runErr error, attrs []any) {
+	metrics.ScheduledJobRuns.WithLabelValues(record.Job, status).Inc()
+
+	updates := map[string]any{
+		"status":      status,
+		"finished_at": time.Now(),
+		"result":      summary,
+	}
+	if runErr != nil {
+		updates["error"] = runErr.Error()
+	}
+	if err := s.db.WithContext(ctx).Model(&models.JobRuns{}).Where("id = ?", record.Id).Updates(updates).Error; err != nil {
+		s.logger.WarnContext(ctx, "Could not record scheduled job run", append(attrs, logging.Err(err))...)
+	}
+
+	attrs = append(attrs, slog.String("status", status), slog.Duration("duration", time.Since(record.StartedAt)))
+	switch status {
+	case StatusFailed:
+		s.logger.ErrorContext(ctx, "Scheduled job failed", append(attrs, logging.Err(runErr), logging.Persist())...)
+	case StatusSkipped:
+		s.logger.WarnContext(ctx, "Scheduled job skipped, its previous run is still going", attrs...)
+	default:
+		s.logger.InfoContext(ctx, "Scheduled job finished", append(attrs, slog.String("result", summary))...)
+	}
+}
+
+// lock takes the job's session level advisory lock on a dedicated connection, held until unlock is called.
+func (s *Scheduler) lock(ctx context.Context, name string) (func(), bool, error) {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, hashtext($2))", constants.LOCK_SCHEDULED_JOB, name).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	unlock := func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock($1, hashtext($2))", constants.LOCK_SCHEDULED_JOB, name); err != nil {
+			// The lock lives as long as the connection, so discard it rather than return it to the pool
+			s.logger.WarnContext(unlockCtx, "Could not release scheduled job lock, closing its connection", slog.String("job", name), logging.Err(err))
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
@@ -0,0 +1,63 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// API keys look like ak_<prefix>_<secret>. The prefix is stored in the clear to find the key, only a Hash512
+// digest of the secret is stored.
+const APIKeyMarker = "ak_"
+
+var ErrMalformedAPIKey = errors.New("malformed api key")
+
+type APIKey struct {
+	Raw    string // Shown to the user once, never stored
+	Prefix string
+	Digest string
+	Salt   string
+}
+
+// GenerateAPIKey creates a new random key, 64 bits of prefix & 256 bits of secret.
+func GenerateAPIKey() (APIKey, error) {
+	prefixBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return APIKey{}, errors.New("byte rand.Read failure of api key prefix")
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return APIKey{}, errors.New("byte rand.Read failure of api key secret")
+	}
+
+	prefix := hex.EncodeToString(prefixBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	digest, err := Hash512(secret, nil)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return APIKey{
+		Raw:    APIKeyMarker + prefix + "_" + secret,
+		Prefix: prefix,
+		Digest: digest.HashHex,
+		Salt:   *digest.Salt,
+	}, nil
+}
+
+// IsAPIKey reports whether a bearer token is an API key rather than a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyMarker)
+}
+
+// SplitAPIKey returns the lookup prefix & secret of a raw key.
+func SplitAPIKey(raw string) (string, string, error) {
+	prefix, secret, ok := strings.Cut(strings.TrimPrefix(raw, APIKeyMarker), "_")
+	if !ok || len(prefix) != 16 || secret == "" {
+		return "", "", ErrMalformedAPIKey
+	}
+	return prefix, secret, nil
+}
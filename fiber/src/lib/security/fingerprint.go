@@ -0,0 +1,88 @@
+package security
+
+import (
+	"net"
+	"strings"
+)
+
+// Fingerprint is what a session knows about the client it was created on. It's coarse on purpose: browsers
+// update their version & mobile clients hop between addresses, neither of which should look like a new client.
+type Fingerprint struct {
+	IP        string
+	UserAgent string
+	Device    string // i.e. "Firefox on Linux"
+}
+
+func NewFingerprint(ip string, userAgent string) Fingerprint {
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	return Fingerprint{IP: ip, UserAgent: userAgent, Device: DeviceName(userAgent)}
+}
+
+// Differs reports whether two fingerprints look like different clients: another browser or OS, or when
+// checkNetwork is set, another network (/24 for IPv4, /48 for IPv6).
+func (f Fingerprint) Differs(other Fingerprint, checkNetwork bool) bool {
+	if f.Device != other.Device {
+		return true
+	}
+	return checkNetwork && IPNetwork(f.IP) != IPNetwork(other.IP)
+}
+
+// DeviceName reduces a User-Agent to its browser & OS family, versions are dropped.
+func DeviceName(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown"
+	}
+
+	browser := "Other"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/") || strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(userAgent, "curl/"):
+		browser = "curl"
+	case strings.HasPrefix(userAgent, "Go-http-client/"):
+		browser = "Go"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
+
+// IPNetwork is the network an address belongs to for fingerprinting, unparseable addresses are compared as is.
+func IPNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
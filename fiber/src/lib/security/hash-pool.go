@@ -0,0 +1,148 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+
+	"api/src/lib/general"
+	"api/src/lib/metrics"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrHashPoolSaturated is returned when the queue is full, callers should answer 503 with Retry-After.
+var ErrHashPoolSaturated = errors.New("password hashing queue is full")
+
+// HashPool runs password hashing on a fixed number of workers behind a bounded queue, so a burst of logins
+// or registrations waits (or is turned away) instead of every request burning a core at once.
+type HashPool struct {
+	jobs chan hashJob
+}
+
+type hashJob struct {
+	ctx      context.Context
+	run      func()
+	done     chan struct{}
+	queuedAt time.Time
+}
+
+// NewHashPool starts workers goroutines sharing a queue of up to queueSize waiting jobs.
+func NewHashPool(workers int, queueSize int) *HashPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &HashPool{jobs: make(chan hashJob, queueSize)}
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+func (p *HashPool) work() {
+	for job := range p.jobs {
+		metrics.HashPoolQueued.Dec()
+
+		// The caller gave up while this was queued, don't spend seconds of CPU on an answer nobody reads.
+		// done stays open, the caller returns on its context so never mistakes the job for finished.
+		if job.ctx.Err() != nil {
+			metrics.HashPoolDropped.WithLabelValues(metrics.HashPoolCanceled).Inc()
+			continue
+		}
+
+		metrics.HashPoolWait.Observe(time.Since(job.queuedAt).Seconds())
+		metrics.HashPoolBusy.Inc()
+		job.run()
+		metrics.HashPoolBusy.Dec()
+		close(job.done)
+	}
+}
+
+// Do queues fn and waits for it to finish. It fails fast with ErrHashPoolSaturated when the queue is full,
+// and returns ctx's error if ctx ends first (a job that already started still runs to completion).
+func (p *HashPool) Do(ctx context.Context, fn func()) error {
+	job := hashJob{ctx: ctx, run: fn, done: make(chan struct{}), queuedAt: time.Now()}
+
+	// Counted before the send, a worker picking the job up straight away decrements it
+	metrics.HashPoolQueued.Inc()
+	select {
+	case p.jobs <- job:
+	default:
+		metrics.HashPoolQueued.Dec()
+		metrics.HashPoolDropped.WithLabelValues(metrics.HashPoolSaturated).Inc()
+		return ErrHashPoolSaturated
+	}
+
+	select {
+	case <-job.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shared pool for request handlers, one worker per core by default.
+var hashPool = NewHashPool(
+	general.GetEnv("HASH_WORKERS", runtime.NumCPU()),
+	general.GetEnv("HASH_QUEUE_SIZE", 64),
+)
+
+// HashPassword hashes a password with Argon2id on the shared pool.
+func HashPassword(ctx context.Context, text string) (string, error) {
+	var hash string
+	var hashErr error
+
+	if err := hashPool.Do(ctx, func() { hash, hashErr = HashArgon2id(text) }); err != nil {
+		return "", err
+	}
+	return hash, hashErr
+}
+
+// CheckPassword verifies a password against its hash (any supported format) on the shared pool, see VerifyPassword.
+func CheckPassword(ctx context.Context, text string, hash string) (bool, bool, error) {
+	var valid, needsRehash bool
+	var checkErr error
+
+	if err := hashPool.Do(ctx, func() { valid, needsRehash, checkErr = VerifyPassword(text, hash) }); err != nil {
+		return false, false, err
+	}
+	return valid, needsRehash, checkErr
+}
+
+// CalibrateArgon2Time times one hash at each iteration count from 1 up to maxTime, using the configured memory &
+// threads, returning the highest count that stays within target & how long it took. Run it on the hardware
+// that will serve logins.
+func CalibrateArgon2Time(target time.Duration, maxTime uint32) (uint32, time.Duration) {
+	params := argon2Params
+	sample := []byte("calibration-password-sample")
+	salt := make([]byte, params.SaltLen)
+
+	bestTime, bestElapsed := uint32(1), time.Duration(0)
+
+	for t := uint32(1); t <= maxTime; t++ {
+		start := time.Now()
+		argon2.IDKey(sample, salt, t, params.Memory, params.Threads, params.KeyLen)
+		elapsed := time.Since(start)
+
+		if elapsed > target {
+			if t == 1 {
+				// Even a single pass is too slow, report it rather than pretend (lower ARGON2_MEMORY instead)
+				return t, elapsed
+			}
+			break
+		}
+		bestTime, bestElapsed = t, elapsed
+	}
+
+	return bestTime, bestElapsed
+}
+
+// CurrentArgon2Params returns the parameters new hashes are made with.
+func CurrentArgon2Params() Argon2Params {
+	return argon2Params
+}
@@ -2,11 +2,21 @@ package security
 
 import (
 	"api/src/lib/general"
+	"api/src/lib/keyring"
+	"api/src/lib/metrics"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -15,9 +25,6 @@ type Hash512Result struct {
 	Salt    *string `json:"salt,omitempty"`
 }
 
-var pepper = general.GetEnv("HASH_PEPPER", "")
-var cost = general.GetEnv("BCRYPT_COST", 16)
-
 func Hash512(text string, salt *string) (Hash512Result, error) {
 	// Takes in text, and an optional salt
 	// If salt does not exist/ is not passed in, generate one and include in output
@@ -26,7 +33,7 @@ func Hash512(text string, salt *string) (Hash512Result, error) {
 	// Hash standard is 512-bit
 	// Salt is a 256-bit random value
 
-	if pepper == "" {
+	if Peppers.Len() == 0 {
 		return Hash512Result{}, errors.New("no HASH_PEPPER specified in .env")
 	}
 
@@ -77,7 +84,7 @@ func CheckHash512(text string, hashHex string, salt string) (bool, error) {
 		return false, err
 	}
 
-	if a.HashHex == hashHex {
+	if subtle.ConstantTimeCompare([]byte(a.HashHex), []byte(hashHex)) == 1 {
 		return true, nil
 	}
 
@@ -85,29 +92,135 @@ func CheckHash512(text string, hashHex string, salt string) (bool, error) {
 
 }
 
-func HashBcrypt(text string) (string, error) {
-	if cost == 0 {
-		return "", errors.New("no BCRYPT_COST specified in .env")
+// Argon2id parameters for new hashes. Hashes made with other parameters still verify, and are upgraded on login.
+var argon2Params = Argon2Params{
+	Memory:  uint32(general.GetEnv("ARGON2_MEMORY", 64*1024)), // KiB
+	Time:    uint32(general.GetEnv("ARGON2_TIME", 3)),
+	Threads: uint8(general.GetEnv("ARGON2_THREADS", 2)),
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+type Argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+var ErrUnknownHashFormat = errors.New("unrecognised password hash format")
+
+// Password hashes are stored as "<pepper key id>:<hash>". Hashes without an id predate key ids & used the
+// legacy pepper (keyring.LegacyID).
+func splitKeyID(stored string) (string, string) {
+	if strings.HasPrefix(stored, "$") {
+		return keyring.LegacyID, stored
+	}
+	if id, hash, ok := strings.Cut(stored, ":"); ok {
+		return id, hash
 	}
+	return "", stored
+}
+
+// PasswordKeyID returns the id of the pepper a stored password hash was made with.
+func PasswordKeyID(stored string) string {
+	id, _ := splitKeyID(stored)
+	return id
+}
+
+// The pepper is mixed in with HMAC-SHA256 rather than appended, so its length never eats into the password
+// and the hasher always sees a fixed 32 byte input.
+func pepperPassword(text string, pepper []byte) []byte {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(text))
+	return mac.Sum(nil)
+}
 
-	if pepper == "" {
+// HashArgon2id hashes a password with the current pepper, returning "<key id>:<PHC string>",
+// i.e. 1:$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashArgon2id(text string) (string, error) {
+	pepper, err := Peppers.Current()
+	if err != nil {
 		return "", errors.New("no HASH_PEPPER specified in .env")
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(text+pepper), cost)
+	hash, err := hashArgon2id(pepperPassword(text, pepper.Secret), argon2Params)
 	if err != nil {
-		return "", errors.New("failed to hash password")
+		return "", err
+	}
+	return pepper.ID + ":" + hash, nil
+}
+
+func hashArgon2id(password []byte, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.New("byte rand.Read failure of salt")
 	}
 
-	return string(hash), nil
+	defer metrics.ObservePasswordHash("argon2id", "hash", time.Now())
+	key := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
 }
 
-func CheckHashBcrypt(text string, hash string) (bool, error) {
-	if pepper == "" {
-		return false, errors.New("no HASH_PEPPER specified in .env")
+// checkArgon2id verifies a peppered password against a PHC encoded Argon2id hash, reporting whether the hash
+// was made with parameters other than the current ones.
+func checkArgon2id(password []byte, encoded string) (valid bool, outdated bool, err error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, false, err
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(text+pepper))
+	defer metrics.ObservePasswordHash("argon2id", "verify", time.Now())
+	candidate := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	outdated = params != argon2Params
+	return subtle.ConstantTimeCompare(candidate, key) == 1, outdated, nil
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// checkBcrypt verifies legacy bcrypt hashes, which had the pepper appended to the password. New hashes are
+// never bcrypt, a successful check should be followed by a rehash.
+func checkBcrypt(text string, pepper []byte, hash string) (bool, error) {
+	defer metrics.ObservePasswordHash("bcrypt", "verify", time.Now())
+	err := bcrypt.CompareHashAndPassword([]byte(hash), append([]byte(text), pepper...))
 	if err != nil {
 		if err == bcrypt.ErrMismatchedHashAndPassword {
 			return false, nil
@@ -116,3 +229,26 @@ func CheckHashBcrypt(text string, hash string) (bool, error) {
 	}
 	return true, nil
 }
+
+// VerifyPassword checks a password against any supported stored hash, using whichever pepper it was made with.
+// needsRehash is set when the password matched but the hash uses a legacy algorithm, outdated parameters or a
+// retired pepper.
+func VerifyPassword(text string, stored string) (valid bool, needsRehash bool, err error) {
+	keyID, hash := splitKeyID(stored)
+	pepper, ok := Peppers.Get(keyID)
+	if !ok {
+		return false, false, fmt.Errorf("password hash uses unknown pepper key %q", keyID)
+	}
+	retired := !Peppers.IsCurrent(keyID)
+
+	switch {
+	case strings.HasPrefix(hash, argon2idPrefix):
+		valid, outdated, err := checkArgon2id(pepperPassword(text, pepper.Secret), hash)
+		return valid, valid && (outdated || retired), err
+	case strings.HasPrefix(hash, "$2"):
+		valid, err := checkBcrypt(text, pepper.Secret, hash)
+		return valid, valid, err
+	default:
+		return false, false, ErrUnknownHashFormat
+	}
+}
@@ -1,51 +1,146 @@
 package security
 
 import (
-	"log"
-	"os"
+	"errors"
+	"fmt"
 	"time"
 
+	"api/src/config"
 	"api/src/constants"
+	"api/src/lib/general"
+	"api/src/lib/keyring"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Issuer & audience stamped into (and required of) every token. Services verifying our tokens via the JWKS
+// should check both as well.
+var (
+	jwtIssuer   = general.GetEnv("JWT_ISSUER", "accord-api")
+	jwtAudience = general.GetEnv("JWT_AUDIENCE", "accord")
 )
 
 type JWTClaims struct {
-	UID string `json:"uid"`
-	SID string `json:"sid"`
+	UID string       `json:"uid"`
+	SID string       `json:"sid"`
+	Act *ActorClaims `json:"act,omitempty"` // Set while an admin impersonates UID (RFC 8693 actor claim)
 	jwt.RegisteredClaims
 }
 
+// ActorClaims identify who is really making requests with an impersonation token.
+type ActorClaims struct {
+	Sub string `json:"sub"`
+}
+
+// ActorID is the impersonating admin's user id, "" for ordinary tokens.
+func (c *JWTClaims) ActorID() string {
+	if c.Act == nil {
+		return ""
+	}
+	return c.Act.Sub
+}
+
 func GenerateJWT(uid, sid string) (string, error) {
 	return GenerateJWTWithDuration(uid, sid, constants.JWT_DURATION)
 }
 
+// GenerateImpersonationJWT issues a token for uid's impersonation session, naming the admin behind it.
+func GenerateImpersonationJWT(uid, sid, actorID string) (string, error) {
+	return generateJWT(uid, sid, &ActorClaims{Sub: actorID}, constants.JWT_DURATION)
+}
+
+// RefreshJWT reissues a token for the same user & session, keeping its actor.
+func RefreshJWT(claims *JWTClaims) (string, error) {
+	return generateJWT(claims.UID, claims.SID, claims.Act, constants.JWT_DURATION)
+}
+
 func GenerateJWTWithDuration(uid, sid string, duration time.Duration) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("[ERROR] No JWT_SECRET found in .env")
-		return "", os.ErrNotExist
-	}
+	return generateJWT(uid, sid, nil, duration)
+}
 
+func generateJWT(uid, sid string, act *ActorClaims, duration time.Duration) (string, error) {
 	claims := JWTClaims{
 		UID: uid,
 		SID: sid,
+		Act: act,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ID:        uuid.NewString(), // jti, lets a single token be revoked (see caching.DenyToken)
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signClaims(claims)
+}
+
+// NewJWTParser returns a parser enforcing our issuer & audience, requiring exp & iat, and allowing
+// constants.JWT_LEEWAY of clock skew between us and whoever minted / checks the token.
+func NewJWTParser() *jwt.Parser {
+	return jwt.NewParser(
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithAudience(jwtAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(constants.JWT_LEEWAY),
+	)
+}
 
-	// Sign token with secret
-	signedToken, err := token.SignedString([]byte(secret))
+// signClaims signs with the current asymmetric key when JWT_SIGNING_KEYS is set, otherwise with the current
+// HMAC secret. The kid header tells verifiers which key to use.
+func signClaims(claims jwt.Claims) (string, error) {
+	if len(SigningKeys) > 0 {
+		key := SigningKeys[0]
+		token := jwt.NewWithClaims(key.Method, claims)
+		token.Header["kid"] = key.ID
+		return token.SignedString(key.Private)
+	}
+
+	key, err := JWTSecrets.Current()
 	if err != nil {
+		config.Fatal("No JWT_SECRET found in .env")
 		return "", err
 	}
 
-	return signedToken, nil
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+// JWTKeyFunc picks the verification key from the token's alg & kid headers. HMAC tokens use JWT_SECRETS
+// (tokens without a kid predate key ids & use the legacy secret), EdDSA / ES256 tokens use JWT_SIGNING_KEYS.
+// The alg must match the key's own algorithm, so a public key can never be passed off as an HMAC secret.
+func JWTKeyFunc(token *jwt.Token) (interface{}, error) {
+	keyID := keyring.LegacyID
+	if kid, ok := token.Header["kid"]; ok {
+		if keyID, ok = kid.(string); !ok {
+			return nil, errors.New("kid header is not a string")
+		}
+	}
 
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		key, ok := JWTSecrets.Get(keyID)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+		return key.Secret, nil
+
+	case *jwt.SigningMethodEd25519, *jwt.SigningMethodECDSA:
+		key, ok := findSigningKey(keyID)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+		if key.Method.Alg() != token.Method.Alg() {
+			return nil, fmt.Errorf("signing key %q is %s, token claims %s", keyID, key.Method.Alg(), token.Method.Alg())
+		}
+		return key.Public, nil
+
+	default:
+		// Not a token we issued
+		return nil, fmt.Errorf("Incorrect/unexpected signing method - %v", token.Header["alg"])
+	}
 }
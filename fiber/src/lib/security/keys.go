@@ -0,0 +1,24 @@
+package security
+
+import (
+	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/keyring"
+	"api/src/lib/logging"
+)
+
+// Pepper & JWT secret keyrings, HASH_PEPPERS / JWT_SECRETS as "id:secret,id:secret" (current first).
+// The single HASH_PEPPER / JWT_SECRET values still work, as key id "0".
+var (
+	Peppers    = loadKeyring("HASH_PEPPERS", "HASH_PEPPER")
+	JWTSecrets = loadKeyring("JWT_SECRETS", "JWT_SECRET")
+)
+
+func loadKeyring(listKey string, legacyKey string) *keyring.Keyring {
+	ring, err := keyring.FromValues(general.GetEnv(listKey, ""), general.GetEnv(legacyKey, ""))
+	if err != nil {
+		config.Fatal("Invalid "+listKey, logging.Err(err))
+		ring, _ = keyring.FromValues("", "")
+	}
+	return ring
+}
@@ -0,0 +1,155 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"api/src/constants"
+	"api/src/lib/general"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// OIDCIssuer is our issuer URL as an OpenID Connect provider. It must be the public URL the discovery document
+// is served under (<issuer>/.well-known/openid-configuration), relying parties compare it exactly.
+var OIDCIssuer = strings.TrimSuffix(general.GetEnv("OIDC_PROVIDER_ISSUER", "http://localhost:8080"), "/")
+
+// ErrNoSigningKey means JWT_SIGNING_KEYS isn't set. Other apps verify ID tokens with our JWKS, which an HMAC
+// secret can't be published in, so the provider is unavailable without asymmetric keys.
+var ErrNoSigningKey = errors.New("OIDC tokens need an asymmetric key in JWT_SIGNING_KEYS")
+
+// IDTokenClaims are the claims of an ID token issued to a client app.
+type IDTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time"`
+	SID               string `json:"sid"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// OIDCAccessTokenClaims are the claims of an access token issued to a client app. Its audience is our issuer,
+// not JWT_AUDIENCE, so it's only good for userinfo & never for our own private routes.
+type OIDCAccessTokenClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	SID      string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// signWithSigningKey signs with the current asymmetric key, there's no HMAC fallback for tokens other apps verify.
+func signWithSigningKey(claims jwt.Claims, typ string) (string, error) {
+	if len(SigningKeys) == 0 {
+		return "", ErrNoSigningKey
+	}
+
+	key := SigningKeys[0]
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	return token.SignedString(key.Private)
+}
+
+// OIDCProviderEnabled reports whether ID tokens can be signed.
+func OIDCProviderEnabled() bool {
+	return len(SigningKeys) > 0
+}
+
+// GenerateIDToken issues an ID token for a client, carrying the nonce it sent to the authorize endpoint.
+func GenerateIDToken(clientID string, uid string, sid string, nonce string, authTime time.Time, username string) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Nonce:             nonce,
+		AuthTime:          authTime.Unix(),
+		SID:               sid,
+		PreferredUsername: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    OIDCIssuer,
+			Subject:   uid,
+			Audience:  jwt.ClaimStrings{clientID},
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(constants.OIDC_ID_TOKEN_DURATION)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return signWithSigningKey(claims, "JWT")
+}
+
+// GenerateOIDCAccessToken issues a short lived access token for a client's calls to userinfo.
+func GenerateOIDCAccessToken(clientID string, uid string, sid string, scope string) (string, error) {
+	now := time.Now()
+	claims := OIDCAccessTokenClaims{
+		ClientID: clientID,
+		Scope:    scope,
+		SID:      sid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    OIDCIssuer,
+			Subject:   uid,
+			Audience:  jwt.ClaimStrings{OIDCIssuer},
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(constants.OIDC_ACCESS_TOKEN_DURATION)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return signWithSigningKey(claims, "at+jwt")
+}
+
+// ParseOIDCAccessToken verifies an access token we issued to a client app.
+func ParseOIDCAccessToken(raw string) (*OIDCAccessTokenClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithIssuer(OIDCIssuer),
+		jwt.WithAudience(OIDCIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(constants.JWT_LEEWAY),
+	)
+
+	token, err := parser.ParseWithClaims(raw, &OIDCAccessTokenClaims{}, JWTKeyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := token.Header["typ"].(string); typ != "at+jwt" {
+		return nil, errors.New("not an access token")
+	}
+
+	claims, ok := token.Claims.(*OIDCAccessTokenClaims)
+	if !ok || claims.Subject == "" || claims.SID == "" {
+		return nil, errors.New("invalid access token claims")
+	}
+	return claims, nil
+}
+
+// GenerateOpaqueToken returns a random token (authorization codes, refresh tokens, client ids & secrets) and
+// the SHA-256 digest it's stored & looked up by. It has 256 bits of entropy, so no salt or slow hash is needed.
+func GenerateOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("byte rand.Read failure of opaque token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, DigestOpaqueToken(token), nil
+}
+
+// DigestOpaqueToken is the lookup digest of a token made by GenerateOpaqueToken.
+func DigestOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyPKCE checks a code_verifier against the S256 code_challenge sent to the authorize endpoint.
+func VerifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
@@ -0,0 +1,29 @@
+package security
+
+import (
+	"time"
+
+	"api/src/constants"
+)
+
+// SessionExpiry is when a session created at now expires: after its idle timeout, and at the latest its
+// absolute lifetime.
+func SessionExpiry(rememberMe bool, now time.Time) (expiresAt time.Time, absoluteExpiresAt time.Time) {
+	if rememberMe {
+		return now.Add(constants.SESSION_REMEMBER_IDLE_TIMEOUT), now.Add(constants.SESSION_REMEMBER_ABSOLUTE_LIFETIME)
+	}
+	return now.Add(constants.SESSION_IDLE_TIMEOUT), now.Add(constants.SESSION_ABSOLUTE_LIFETIME)
+}
+
+// SlideSessionExpiry is a session's new expiry after activity at now, never past its absolute expiry.
+func SlideSessionExpiry(rememberMe bool, absoluteExpiresAt time.Time, now time.Time) time.Time {
+	idle := constants.SESSION_IDLE_TIMEOUT
+	if rememberMe {
+		idle = constants.SESSION_REMEMBER_IDLE_TIMEOUT
+	}
+
+	if expiresAt := now.Add(idle); expiresAt.Before(absoluteExpiresAt) {
+		return expiresAt
+	}
+	return absoluteExpiresAt
+}
@@ -0,0 +1,158 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is an asymmetric JWT key, anyone holding the public half (see JWKS) can verify our tokens.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod // EdDSA or ES256, decided by the key type
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// SigningKeys from JWT_SIGNING_KEYS as "id:/path/key.pem,id:/path/key.pem", current key first. When set, new
+// tokens are signed with the current key, HMAC (JWT_SECRETS) tokens are still accepted until they expire.
+var SigningKeys = loadSigningKeys()
+
+func loadSigningKeys() []SigningKey {
+	keys, err := LoadSigningKeys(general.GetEnv("JWT_SIGNING_KEYS", ""))
+	if err != nil {
+		config.Fatal("Invalid JWT_SIGNING_KEYS", logging.Err(err))
+		return nil
+	}
+	return keys
+}
+
+// LoadSigningKeys reads PKCS#8 (or SEC 1 EC) PEM private keys, Ed25519 keys sign EdDSA & P-256 keys sign ES256.
+func LoadSigningKeys(spec string) ([]SigningKey, error) {
+	var keys []SigningKey
+	seen := map[string]bool{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, path, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || path == "" {
+			return nil, errors.New("signing key entry must be id:path")
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate signing key id %q", id)
+		}
+		seen[id] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read signing key %q: %w", id, err)
+		}
+		key, err := parseSigningKeyPEM(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", id, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func parseSigningKeyPEM(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM block found")
+	}
+
+	var private any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported PEM block %q, expected a private key", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Private: private, Public: private.Public()}, nil
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return SigningKey{}, errors.New("only P-256 EC keys are supported (ES256)")
+		}
+		return SigningKey{ID: id, Method: jwt.SigningMethodES256, Private: private, Public: private.Public()}, nil
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported key type %T, expected Ed25519 or P-256", private)
+	}
+}
+
+func findSigningKey(id string) (SigningKey, bool) {
+	for _, key := range SigningKeys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// JWK is the public half of a signing key, as published on /.well-known/jwks.json (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists every signing key (current & retired), so tokens signed before a rotation keep verifying.
+func JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+
+	for _, key := range SigningKeys {
+		jwk := JWK{Kid: key.ID, Alg: key.Method.Alg(), Use: "sig"}
+
+		switch public := key.Public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *ecdsa.PublicKey:
+			jwk.Kty, jwk.Crv = "EC", "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
@@ -0,0 +1,193 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Provider is an external OpenID Connect identity provider users can log in with. Its endpoints & signing keys
+// come from the issuer's discovery document, fetched on first use so a provider being down doesn't stop startup.
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+
+	mu       sync.Mutex
+	oidc     *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// Claims we read from a verified ID token (and userinfo, when the token is missing them).
+type Identity struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// Providers from OIDC_PROVIDERS ("google,gitlab"), each configured by OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET & optionally _SCOPES. Callbacks land on OIDC_REDIRECT_BASE_URL/<name>/callback.
+var Providers = loadProviders()
+
+func loadProviders() map[string]*Provider {
+	providers := map[string]*Provider{}
+	defaultBase := fmt.Sprintf("http://localhost:8080/api/v%s/public/auth/oidc", general.GetEnv("VERSION", "0"))
+	redirectBase := strings.TrimSuffix(general.GetEnv("OIDC_REDIRECT_BASE_URL", defaultBase), "/")
+
+	for _, name := range strings.Split(general.GetEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &Provider{
+			Name:         name,
+			Issuer:       general.GetEnv(prefix+"ISSUER", ""),
+			ClientID:     general.GetEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: general.GetEnv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(general.GetEnv(prefix+"SCOPES", "openid email profile")),
+			RedirectURL:  fmt.Sprintf("%s/%s/callback", redirectBase, name),
+		}
+
+		if provider.Issuer == "" || provider.ClientID == "" {
+			config.Fatal("OIDC provider is missing its issuer or client id", slog.String("provider", name))
+			continue
+		}
+		providers[name] = provider
+	}
+
+	return providers
+}
+
+// GetProvider finds a configured provider by name.
+func GetProvider(name string) (*Provider, error) {
+	provider, ok := Providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
+
+// ProviderNames lists the configured providers, for the frontend's login buttons.
+func ProviderNames() []string {
+	names := make([]string, 0, len(Providers))
+	for name := range Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// discover fetches (once) the provider's discovery document, a failure is retried on the next login.
+func (p *Provider) discover(ctx context.Context) (*oidc.Provider, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oidc != nil {
+		return p.oidc, p.verifier, nil
+	}
+
+	// The key set fetches keys lazily with the context it was built with, so it mustn't be the request's
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.WithoutCancel(ctx), nil), p.Issuer)
+	if err != nil {
+		config.Logger.WarnContext(ctx, "OIDC discovery failed", slog.String("provider", p.Name), logging.Err(err))
+		return nil, nil, fmt.Errorf("discovery for %s failed: %w", p.Name, err)
+	}
+
+	p.oidc = provider
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	return p.oidc, p.verifier, nil
+}
+
+func (p *Provider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  p.RedirectURL,
+		Scopes:       p.Scopes,
+	}
+}
+
+// AuthCodeURL is where the browser is sent to log in, carrying our state, nonce & PKCE (S256) challenge.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	provider, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return p.oauth2Config(provider).AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	), nil
+}
+
+// Exchange redeems an authorization code (with the PKCE verifier) and verifies the returned ID token's
+// signature, issuer, audience, expiry & nonce.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (Identity, error) {
+	provider, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	oauthConfig := p.oauth2Config(provider)
+
+	token, err := oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Identity{}, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return Identity{}, errors.New("id_token nonce mismatch")
+	}
+
+	var identity Identity
+	if err := idToken.Claims(&identity); err != nil {
+		return Identity{}, fmt.Errorf("could not read id_token claims: %w", err)
+	}
+
+	// Some providers keep profile claims out of the ID token, userinfo fills them in (never the subject)
+	if identity.Email == "" && provider.UserInfoEndpoint() != "" {
+		if info, err := provider.UserInfo(ctx, oauthConfig.TokenSource(ctx, token)); err == nil && info.Subject == identity.Subject {
+			identity.Email, identity.EmailVerified = info.Email, info.EmailVerified
+			var profile Identity
+			if err := info.Claims(&profile); err == nil {
+				if identity.PreferredUsername == "" {
+					identity.PreferredUsername = profile.PreferredUsername
+				}
+				if identity.Name == "" {
+					identity.Name = profile.Name
+				}
+			}
+		}
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"api/src/lib/general"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireAdmin blocks the request unless the user attached by CoreMiddleware is an admin.
+// Must be registered after CoreMiddleware.
+func RequireAdmin() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := general.GetReqUser(c)
+		if err != nil {
+			return err
+		}
+
+		if !user.IsAdmin {
+			return general.SendError(c, fiber.StatusForbidden, "Admin access required")
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+	"api/src/lib/security"
+	"api/src/lib/tracing"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// authenticateAPIKey is CoreMiddleware's path for personal API keys. It attaches the owning user, the key and
+// its scopes to c.Locals, but no session.
+func authenticateAPIKey(c *fiber.Ctx, raw string) error {
+	ctx := c.UserContext()
+
+	prefix, secret, err := security.SplitAPIKey(raw)
+	if err != nil {
+		config.Logger.WarnContext(ctx, "Malformed API key", logging.Persist())
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid API key")
+	}
+
+	ctx, span := tracing.Start(ctx, "auth.load_api_key", attribute.String("api_key_prefix", prefix))
+	key, err := loadAPIKey(ctx, prefix)
+	span.End()
+	if err != nil {
+		config.Logger.WarnContext(ctx, "Unknown API key used", slog.String("api_key_prefix", prefix), logging.Persist())
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid API key")
+	}
+
+	if valid, err := security.CheckHash512(secret, key.Digest, key.Salt); err != nil || !valid {
+		config.Logger.WarnContext(ctx, "API key secret does not match",
+			slog.String("api_key_prefix", prefix), slog.String(logging.KeyUserID, key.UserId), logging.Err(err), logging.Persist(),
+		)
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid API key")
+	}
+
+	// Checked on every request, cached records included
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthExpired).Inc()
+		return general.SendError(c, fiber.StatusUnauthorized, "API key has expired")
+	}
+
+	user, err := loadAPIKeyUser(ctx, key.UserId)
+	if err != nil {
+		config.Logger.WarnContext(ctx, "Could not find user attached to API key",
+			slog.String(logging.KeyUserID, key.UserId), logging.Persist(),
+		)
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+		return general.SendError(c, fiber.StatusUnauthorized, "Invalid API key")
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > constants.API_KEY_LAST_USED_THROTTLE {
+		go touchAPIKey(context.WithoutCancel(ctx), *key)
+	}
+
+	metrics.AuthOutcomes.WithLabelValues(metrics.AuthValid).Inc()
+
+	c.Locals("user", *user)
+	c.Locals("api_key", *key)
+	c.Locals("scopes", strings.Fields(key.Scopes))
+	c.Locals("credential_kind", CredentialAPIKey)
+	c.SetUserContext(logging.WithAttrs(ctx,
+		slog.String(logging.KeyUserID, user.Id),
+		slog.String("api_key_id", key.Id),
+	))
+
+	return c.Next()
+}
+
+func loadAPIKey(ctx context.Context, prefix string) (*models.ApiKeys, error) {
+	// Try Redis cache first
+	if cachedKey, err := caching.GetCachedAPIKey(ctx, prefix); err == nil {
+		return cachedKey, nil
+	} else if err != redis.Nil {
+		config.Logger.ErrorContext(ctx, "Redis could not fetch api key", slog.String("api_key_prefix", prefix), logging.Err(err))
+	}
+
+	var key models.ApiKeys
+	dbCtx, cancel := context.WithTimeout(ctx, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+
+	if err := config.DB.WithContext(dbCtx).First(&key, "prefix = ?", prefix).Error; err != nil {
+		return nil, err
+	}
+
+	if cacheErr := caching.CacheAPIKey(ctx, prefix, key); cacheErr != nil {
+		config.Logger.InfoContext(ctx, "Failed to cache api key", slog.String("api_key_prefix", prefix), logging.Err(cacheErr))
+	}
+	return &key, nil
+}
+
+func loadAPIKeyUser(ctx context.Context, uid string) (*models.Users, error) {
+	if cachedUser, err := caching.GetCachedUser(ctx, uid); err == nil {
+		return cachedUser, nil
+	} else if err != redis.Nil {
+		config.Logger.ErrorContext(ctx, "Redis could not fetch user", slog.String(logging.KeyUserID, uid), logging.Err(err))
+	}
+
+	var user models.Users
+	dbCtx, cancel := context.WithTimeout(ctx, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+
+	if err := config.DB.WithContext(dbCtx).First(&user, "id = ?", uid).Error; err != nil {
+		return nil, err
+	}
+
+	if cacheErr := caching.CacheUser(ctx, uid, user); cacheErr != nil {
+		config.Logger.InfoContext(ctx, "Failed to cache user", slog.String(logging.KeyUserID, uid), logging.Err(cacheErr))
+	}
+	return &user, nil
+}
+
+// Records last use, throttled so a busy key doesn't write on every request. The cached copy is updated too,
+// otherwise it would keep reporting the old time & trigger a write each request until it expires. Only its
+// last_used_at is touched & only while still cached, writing the whole record back could re-cache a key revoked
+// in the meantime.
+func touchAPIKey(parent context.Context, key models.ApiKeys) {
+	ctx, cancel := context.WithTimeout(parent, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	result := config.DB.WithContext(ctx).Model(&models.ApiKeys{}).Where("id = ?", key.Id).Update("last_used_at", now)
+	if result.Error != nil {
+		config.Logger.InfoContext(ctx, "Could not record api key use", slog.String("api_key_id", key.Id), logging.Err(result.Error))
+		return
+	}
+	if result.RowsAffected == 0 {
+		return // Revoked since it was loaded
+	}
+
+	if err := caching.TouchCachedAPIKey(ctx, key.Prefix, now); err != nil {
+		config.Logger.InfoContext(ctx, "Failed to update cached api key", slog.String("api_key_prefix", key.Prefix), logging.Err(err))
+	}
+}
+
+// RequireScope limits a route to API keys holding scope. Session (cookie / bearer JWT) requests carry the
+// user's full access and always pass.
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if GetCredentialKind(c) != CredentialAPIKey {
+			return c.Next()
+		}
+
+		scopes, _ := c.Locals("scopes").([]string)
+		for _, granted := range scopes {
+			if granted == scope {
+				return c.Next()
+			}
+		}
+		return general.SendError(c, fiber.StatusForbidden, "API key is missing the "+scope+" scope")
+	}
+}
+
+// RequireSession blocks API keys from routes that manage the account's credentials (i.e. creating more keys).
+func RequireSession() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if GetCredentialKind(c) == CredentialAPIKey {
+			return general.SendError(c, fiber.StatusForbidden, "This route requires a logged in session, not an API key")
+		}
+		return c.Next()
+	}
+}
@@ -2,75 +2,117 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"api/src/config"
 	"api/src/constants"
+	"api/src/lib/audit"
 	"api/src/lib/caching"
 	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
 	"api/src/lib/security"
+	"api/src/lib/tracing"
 	"api/src/models"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// Get secret from .env
-var jwtSecret = general.GetEnv("JWT_SECRET", "")
 var httpsOn = general.GetEnv("NODE_ENV", "") == "production"
 
 func CoreMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		reqIP := c.IP() // Get request IP
-
-		// Extract JWT from request cookie ------------------------------
-		jwtTokenString := c.Cookies("jwt_token")
-		if jwtTokenString == "" {
-			config.Log("No JWT Token in request cookies, can not authorise", 1, false, false)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "No JWT Token found",
-			})
+		ctx := c.UserContext()
+
+		// Extract JWT from Authorization header or cookie ---------------
+		credential, credentialErr := ExtractCredential(c)
+		if errors.Is(credentialErr, ErrUnsupportedAuthScheme) {
+			config.Logger.InfoContext(ctx, "Unsupported Authorization header, can not authorise")
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthMissing).Inc()
+			return general.SendError(c, fiber.StatusUnauthorized, "Authorization header must be a Bearer token")
+		} else if credentialErr != nil {
+			config.Logger.InfoContext(ctx, "No JWT Token in request, can not authorise")
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthMissing).Inc()
+			return general.SendError(c, fiber.StatusUnauthorized, "No JWT Token found")
 		}
 
-		// Verify JWT -----------------------------------------------------
-		parser := jwt.Parser{}
+		// Personal API keys take their own path, there's no JWT or session behind them
+		if credential.Kind == CredentialAPIKey {
+			return authenticateAPIKey(c, credential.Token)
+		}
 
-		// Parse token
-		token, tokenErr := parser.ParseWithClaims(jwtTokenString, &security.JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			// If the signing methods is not HMAC, then this is not a token we issued - don't bother continuing, log error & block req
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Incorrect/unexpected signing method - %v", token.Header["alg"])
-			}
+		jwtTokenString := credential.Token
 
-			return []byte(jwtSecret), nil
-		})
+		// Verify JWT (signature, iss, aud, exp, nbf & iat) ----------------
+		parser := security.NewJWTParser()
+
+		// Parse token
+		_, parseSpan := tracing.Start(ctx, "auth.parse_jwt")
+		// Anything not HMAC signed by one of our keys is not a token we issued - log error & block req
+		token, tokenErr := parser.ParseWithClaims(jwtTokenString, &security.JWTClaims{}, security.JWTKeyFunc)
+		tracing.End(parseSpan, tokenErr)
 
 		// If there was an error, or the token is invlaid - log error & block req
 		if tokenErr != nil || !token.Valid {
-			config.Log(fmt.Sprintf("Token failed to parse: %s. Invalid or manipulated token (IP: %s)", tokenErr, reqIP), 2, false, true)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Token failed to parse",
-			})
+			config.Logger.WarnContext(ctx, "Token failed to parse, invalid or manipulated token",
+				logging.Err(tokenErr), logging.Persist(),
+			)
+			// An expired token is routine, anything else (bad signature, algorithm, malformed) points at tampering
+			if errors.Is(tokenErr, jwt.ErrTokenExpired) {
+				metrics.AuthOutcomes.WithLabelValues(metrics.AuthExpired).Inc()
+			} else {
+				metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+				audit.RecordUnauthenticatedAsync(ctx, audit.NewEvent(c, audit.KindTokenTampered, audit.OutcomeBlocked).
+					With("reason", "token_invalid"),
+				)
+			}
+			return general.SendError(c, fiber.StatusUnauthorized, "Token failed to parse")
 		}
 
 		// Get Token Claims (data) ----------------------------------------
 		claims, claimsOk := token.Claims.(*security.JWTClaims)
 
 		if !claimsOk {
-			config.Log(fmt.Sprintf("Invalid token claims. Invalid or manipulated token (IP: %s)", reqIP), 2, false, true)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Token failed to parse",
-			})
-		} else if claims == nil || claims.ExpiresAt == nil {
-
-			config.Log(fmt.Sprintf("No expiry found in token claims, or claims is null. Invalid or manipulated token (IP: %s)", reqIP), 2, false, true)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Token failed to parse",
-			})
+			config.Logger.WarnContext(ctx, "Invalid token claims, invalid or manipulated token",
+				logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+			audit.RecordUnauthenticatedAsync(ctx, audit.NewEvent(c, audit.KindTokenTampered, audit.OutcomeBlocked).
+				With("reason", "claims_invalid"),
+			)
+			return general.SendError(c, fiber.StatusUnauthorized, "Token failed to parse")
+		} else if claims == nil || claims.ExpiresAt == nil || claims.ID == "" {
+
+			config.Logger.WarnContext(ctx, "No expiry or jti found in token claims, or claims is null. Invalid or manipulated token",
+				logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+			audit.RecordUnauthenticatedAsync(ctx, audit.NewEvent(c, audit.KindTokenTampered, audit.OutcomeBlocked).
+				With("reason", "claims_missing_expiry_or_jti"),
+			)
+			return general.SendError(c, fiber.StatusUnauthorized, "Token failed to parse")
 		}
 
+		// Start async check of the jti denylist (individually revoked tokens) ---
+		awaitDenied := make(chan bool, 1)
+		go func() {
+			ctx, span := tracing.Start(ctx, "auth.check_denylist")
+			defer span.End()
+
+			denied, err := caching.IsTokenDenied(ctx, claims.ID)
+			if err != nil {
+				// Fail open, the session check still applies & a Redis outage shouldn't log everyone out
+				config.Logger.ErrorContext(ctx, "Redis could not check token denylist", logging.Err(err))
+			}
+			awaitDenied <- denied
+		}()
+
 		// TODO: Check claims.UID against rate limiting.
 
 		// Start async check if session already exists  ----------------------
@@ -80,29 +122,32 @@ func CoreMiddleware() fiber.Handler {
 		}
 		awaitSession := make(chan awaitSessionReturn, 1)
 		go func() {
+			ctx, span := tracing.Start(ctx, "auth.load_session", attribute.String(logging.KeySessionID, claims.SID))
+			defer span.End()
+
 			// Try Redis cache first
-			if cachedSession, err := caching.GetCachedSession(claims.SID); err == nil {
+			if cachedSession, err := caching.GetCachedSession(ctx, claims.SID); err == nil {
 				// Cache hit! Return cached session
 				awaitSession <- awaitSessionReturn{*cachedSession, ""}
 				return
 			} else if err != redis.Nil {
 				// Redis error (not a cache miss), log it but continue to database
-				config.Log(fmt.Sprintf("Redis could not fetch session %s: %v", claims.SID, err), 3, false, false)
+				config.Logger.ErrorContext(ctx, "Redis could not fetch session", slog.String(logging.KeySessionID, claims.SID), logging.Err(err))
 			}
 
 			// Cache miss or Redis error - fetch from database
 			var existingSession models.Sessions
-			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+			dbCtx, cancel := context.WithTimeout(ctx, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
 			defer cancel()
 
-			if err := config.DB.WithContext(ctx).First(&existingSession, "id = ?", claims.SID).Error; err != nil {
+			if err := config.DB.WithContext(dbCtx).First(&existingSession, "id = ?", claims.SID).Error; err != nil {
 				awaitSession <- awaitSessionReturn{existingSession, fmt.Sprintf("Could not find session (%s), likely expired", claims.SID)}
 				return
 			}
 
 			// Cache the session for future requests
-			if cacheErr := caching.CacheSession(claims.SID, existingSession); cacheErr != nil {
-				config.Log(fmt.Sprintf("Failed to cache session %s: %v", claims.SID, cacheErr), 1, false, false)
+			if cacheErr := caching.CacheSession(ctx, claims.SID, existingSession); cacheErr != nil {
+				config.Logger.InfoContext(ctx, "Failed to cache session", slog.String(logging.KeySessionID, claims.SID), logging.Err(cacheErr))
 			}
 
 			awaitSession <- awaitSessionReturn{existingSession, ""}
@@ -115,29 +160,32 @@ func CoreMiddleware() fiber.Handler {
 		}
 		awaitUser := make(chan awaitUserReturn, 1)
 		go func() {
+			ctx, span := tracing.Start(ctx, "auth.load_user", attribute.String(logging.KeyUserID, claims.UID))
+			defer span.End()
+
 			// Try Redis cache first
-			if cachedUser, err := caching.GetCachedUser(claims.UID); err == nil {
+			if cachedUser, err := caching.GetCachedUser(ctx, claims.UID); err == nil {
 				// Cache hit! Return cached user
 				awaitUser <- awaitUserReturn{*cachedUser, ""}
 				return
 			} else if err != redis.Nil {
 				// Redis error (not a cache miss), log it but continue to database
-				config.Log(fmt.Sprintf("Redis could not fetch user %s: %v", claims.UID, err), 3, false, false)
+				config.Logger.ErrorContext(ctx, "Redis could not fetch user", slog.String(logging.KeyUserID, claims.UID), logging.Err(err))
 			}
 
 			// Cache miss or Redis error - fetch from database
 			var existingUser models.Users
-			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+			dbCtx, cancel := context.WithTimeout(ctx, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
 			defer cancel()
 
-			if err := config.DB.WithContext(ctx).First(&existingUser, "id = ?", claims.UID).Error; err != nil {
+			if err := config.DB.WithContext(dbCtx).First(&existingUser, "id = ?", claims.UID).Error; err != nil {
 				awaitUser <- awaitUserReturn{existingUser, fmt.Sprintf("Could not find user (%s) attached to request", claims.UID)}
 				return
 			}
 
 			// Cache the user for future requests
-			if cacheErr := caching.CacheUser(claims.UID, existingUser); cacheErr != nil {
-				config.Log(fmt.Sprintf("Failed to cache user %s: %v", claims.UID, cacheErr), 1, false, false)
+			if cacheErr := caching.CacheUser(ctx, claims.UID, existingUser); cacheErr != nil {
+				config.Logger.InfoContext(ctx, "Failed to cache user", slog.String(logging.KeyUserID, claims.UID), logging.Err(cacheErr))
 			}
 
 			awaitUser <- awaitUserReturn{existingUser, ""}
@@ -153,68 +201,188 @@ func CoreMiddleware() fiber.Handler {
 		var newToken string = ""
 		if jwtRequiresRefresh {
 
-			if token, err := security.GenerateJWT(claims.UID, claims.SID); err != nil {
+			if token, err := security.RefreshJWT(claims); err != nil {
 				errMsg := fmt.Sprintf("Internal Server Error when trying to refresh JWT for UserId: %s", claims.UID)
-				config.Log(errMsg, 2, false, true)
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": errMsg,
-				})
+				config.Logger.WarnContext(ctx, "Could not refresh JWT",
+					slog.String(logging.KeyUserID, claims.UID), logging.Err(err), logging.Persist(),
+				)
+				return general.SendError(c, fiber.StatusInternalServerError, errMsg)
 			} else {
 				newToken = token
 			}
 		}
 
+		// Await denylist check  -----------------------------------------
+		if <-awaitDenied {
+			config.Logger.WarnContext(ctx, "Revoked token used",
+				slog.String(logging.KeySessionID, claims.SID), logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthRevoked).Inc()
+			return general.SendError(c, fiber.StatusUnauthorized, "Token has been revoked")
+		}
+
 		// Await session & verify  ----------------------------------------
 		var session models.Sessions
 		if sessionRes := <-awaitSession; sessionRes.errMsg != "" {
 			// An error here means no session, so wipe the cookie (logout).
-			c.Cookie(&fiber.Cookie{
-				Name:     "jwt_token",
-				Value:    "",
-				Expires:  time.Now().Add(-(5 * time.Minute)),
-				HTTPOnly: true,
-				Secure:   httpsOn,
-				SameSite: "Strict",
-				Path:     "/",
-			})
-			config.Log(sessionRes.errMsg, 2, false, true)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": sessionRes.errMsg,
-			})
+			if credential.Kind == CredentialCookie {
+				c.Cookie(&fiber.Cookie{
+					Name:     "jwt_token",
+					Value:    "",
+					Expires:  time.Now().Add(-(5 * time.Minute)),
+					HTTPOnly: true,
+					Secure:   httpsOn,
+					SameSite: "Strict",
+					Path:     "/",
+				})
+			}
+			config.Logger.WarnContext(ctx, sessionRes.errMsg,
+				slog.String(logging.KeySessionID, claims.SID), logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+			return general.SendError(c, fiber.StatusUnauthorized, sessionRes.errMsg)
 		} else {
-			// Expired sessions are deleted from the database every minute, so it's best to just allow a minute
-			// of tolerance instead of preforming a series of checks against expiry and edge conditons.
 			session = sessionRes.session
 		}
 
+		// Expiry is checked exactly, expires_at slides with activity & a cached copy can outlive it
+		if time.Now().After(session.ExpiresAt) {
+			if credential.Kind == CredentialCookie {
+				c.Cookie(&fiber.Cookie{
+					Name:     "jwt_token",
+					Value:    "",
+					Expires:  time.Now().Add(-(5 * time.Minute)),
+					HTTPOnly: true,
+					Secure:   httpsOn,
+					SameSite: "Strict",
+					Path:     "/",
+				})
+			}
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+			if session.ImpersonatorId != nil {
+				return general.SendError(c, fiber.StatusUnauthorized, "Impersonation session has ended")
+			}
+			return general.SendError(c, fiber.StatusUnauthorized, "Session has expired")
+		}
+
+		// An impersonation token & its session must agree on the admin behind them
+		impersonatorID := claims.ActorID()
+		if impersonatorID != sessionImpersonator(session.ImpersonatorId) {
+			config.Logger.WarnContext(ctx, "Token actor does not match its session's impersonator",
+				slog.String(logging.KeySessionID, session.Id), logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthTampered).Inc()
+			audit.RecordAsync(ctx, audit.NewEvent(c, audit.KindTokenTampered, audit.OutcomeBlocked).
+				WithTarget(claims.UID).
+				With("reason", "actor_mismatch"),
+			)
+			return general.SendError(c, fiber.StatusUnauthorized, "Token failed to parse")
+		}
+
+		// The admin's own session must still be live, its cascade removes the row but not a cached copy of this one
+		if impersonatorID != "" {
+			if active, err := impersonatorSessionActive(ctx, session); err != nil {
+				config.Logger.ErrorContext(ctx, "Could not check the impersonating admin's session",
+					slog.String(logging.KeySessionID, session.Id), logging.Err(err),
+				)
+				return general.SendError(c, fiber.StatusInternalServerError, "Could not verify impersonation session")
+			} else if !active {
+				if err := caching.DropCachedSession(ctx, session.Id); err != nil {
+					config.Logger.InfoContext(ctx, "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+				}
+				if credential.Kind == CredentialCookie {
+					c.Cookie(&fiber.Cookie{
+						Name:     "jwt_token",
+						Value:    "",
+						Expires:  time.Now().Add(-(5 * time.Minute)),
+						HTTPOnly: true,
+						Secure:   httpsOn,
+						SameSite: "Strict",
+						Path:     "/",
+					})
+				}
+				metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+				return general.SendError(c, fiber.StatusUnauthorized, "Impersonation session has ended")
+			}
+		}
+
+		// Compare the client with the one the session was created on --
+		if refused, err := enforceSessionBinding(c, credential, claims, session); refused {
+			return err
+		}
+
 		// Await user & verify  ----------------------------------------
 		var user models.Users
 		if userRes := <-awaitUser; userRes.errMsg != "" {
-			config.Log(userRes.errMsg, 2, false, true)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": userRes.errMsg,
-			})
+			config.Logger.WarnContext(ctx, userRes.errMsg,
+				slog.String(logging.KeyUserID, claims.UID), logging.Persist(),
+			)
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthRejected).Inc()
+			return general.SendError(c, fiber.StatusUnauthorized, userRes.errMsg)
 		} else {
 			user = userRes.user
 		}
 
-		// Attach new JWT to cookie response, if needed -------------------
-		if jwtRequiresRefresh {
+		// Slide the session's expiry with activity (never for impersonation) --
+		sessionSlid := false
+		if impersonatorID == "" && time.Since(session.LastUpdatedAt) >= constants.SESSION_ACTIVITY_THROTTLE {
+			session, sessionSlid = slideSession(ctx, session)
+		}
+
+		// Attach new JWT to the response the way it came in, if needed --
+		// The cookie's expiry follows the session row's, so it's set again whenever that moves too.
+		if jwtRequiresRefresh && credential.Kind == CredentialBearer {
+			c.Set(RefreshedTokenHeader, newToken)
+		} else if credential.Kind == CredentialCookie && (jwtRequiresRefresh || sessionSlid) {
+			cookieToken := credential.Token
+			if jwtRequiresRefresh {
+				cookieToken = newToken
+			}
 			c.Cookie(&fiber.Cookie{
 				Name:     "jwt_token",
-				Value:    newToken,
-				Expires:  time.Now().Add(constants.SESSION_DURATION),
+				Value:    cookieToken,
+				Expires:  session.ExpiresAt,
 				HTTPOnly: true,
 				Secure:   httpsOn,
 				SameSite: "Strict",
 				Path:     "/",
 			})
+			ExtendCSRFToken(c, session.ExpiresAt)
+		}
+
+		metrics.AuthOutcomes.WithLabelValues(metrics.AuthValid).Inc()
+		if jwtRequiresRefresh {
+			metrics.AuthOutcomes.WithLabelValues(metrics.AuthRefreshed).Inc()
 		}
 
 		c.Locals("user", user)
 		c.Locals("session", session)
+		c.Locals("claims", claims)
+		c.Locals("credential_kind", credential.Kind)
+		c.SetUserContext(logging.WithAttrs(ctx,
+			slog.String(logging.KeyUserID, user.Id),
+			slog.String(logging.KeySessionID, session.Id),
+		))
+
+		if impersonatorID == "" {
+			return c.Next()
+		}
 
-		return c.Next()
+		// Every impersonated request is marked, in the response, the logs & the audit trail
+		c.Locals("impersonator_id", impersonatorID)
+		c.Set(ImpersonatedByHeader, impersonatorID)
+		c.SetUserContext(logging.WithAttrs(c.UserContext(), slog.String(logging.KeyImpersonatorID, impersonatorID)))
+
+		err := c.Next()
+		audit.RecordAsync(c.UserContext(), audit.NewEvent(c, audit.KindImpersonatedAction, audit.OutcomeSuccess).
+			WithActor(impersonatorID).
+			WithTarget(user.Id).
+			With("session_id", session.Id).
+			With("method", c.Method()).
+			With("route", c.Route().Path).
+			With("status", c.Response().StatusCode()),
+		)
+		return err
 	}
 }
 
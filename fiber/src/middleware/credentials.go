@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+
+	"api/src/lib/security"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// How a request authenticated, stored in c.Locals("credential_kind").
+const (
+	CredentialCookie = "cookie"  // jwt_token cookie, set for the Next.js frontend
+	CredentialBearer = "bearer"  // Authorization: Bearer <jwt>, for apps, CLIs & services
+	CredentialAPIKey = "api_key" // Authorization: Bearer ak_..., personal API keys
+)
+
+// Header a refreshed JWT is returned in for bearer clients, cookie clients get a new cookie instead.
+const RefreshedTokenHeader = "X-Refreshed-Token"
+
+type Credential struct {
+	Kind  string
+	Token string
+}
+
+var (
+	ErrNoCredential          = errors.New("no credential in request")
+	ErrUnsupportedAuthScheme = errors.New("unsupported Authorization scheme")
+)
+
+// ExtractCredential is the single place deciding which credential a request authenticates with.
+// An Authorization header wins over the cookie: it is explicit, never sent ambiently by a browser, and a
+// client sending one means it. A malformed or non Bearer header is an error rather than a silent fall back
+// to the cookie.
+func ExtractCredential(c *fiber.Ctx) (Credential, error) {
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return Credential{}, ErrUnsupportedAuthScheme
+		}
+		if security.IsAPIKey(token) {
+			return Credential{Kind: CredentialAPIKey, Token: token}, nil
+		}
+		return Credential{Kind: CredentialBearer, Token: token}, nil
+	}
+
+	if token := c.Cookies("jwt_token"); token != "" {
+		return Credential{Kind: CredentialCookie, Token: token}, nil
+	}
+
+	return Credential{}, ErrNoCredential
+}
+
+// GetCredentialKind returns how the current request authenticated, "" before CoreMiddleware has run.
+func GetCredentialKind(c *fiber.Ctx) string {
+	kind, _ := c.Locals("credential_kind").(string)
+	return kind
+}
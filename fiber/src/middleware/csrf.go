@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Double submit CSRF protection. The csrf_token cookie is readable by our frontend (not HttpOnly), which echoes
+// it in the X-CSRF-Token header. Another site can make the browser send the cookie, but can't read it.
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// Origins allowed to make cookie authenticated mutations. SOCKETIO_URL is deliberately not one of them.
+var csrfTrustedOrigins = trustedOrigins(
+	general.GetEnv("FRONTEND_URL", "http://localhost:3000"),
+	general.GetEnv("CSRF_TRUSTED_ORIGINS", ""),
+)
+
+func trustedOrigins(values ...string) map[string]bool {
+	origins := map[string]bool{}
+	for _, value := range values {
+		for _, origin := range strings.Split(value, ",") {
+			if origin = normaliseOrigin(strings.TrimSpace(origin)); origin != "" {
+				origins[origin] = true
+			}
+		}
+	}
+	return origins
+}
+
+// Reduces a URL to scheme://host[:port], "" if it isn't an absolute http(s) URL.
+func normaliseOrigin(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
+
+// CSRF guards cookie authenticated private routes, run it before CoreMiddleware. Safe methods pass (and are
+// given a token if they lack one), anything else needs a trusted Origin / Referer & a matching X-CSRF-Token.
+// Bearer & API key requests are exempt, browsers never attach those on their own.
+func CSRF() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		credential, err := ExtractCredential(c)
+		if err != nil || credential.Kind != CredentialCookie {
+			return c.Next()
+		}
+
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+			// Sessions from before CSRF tokens existed pick one up on their next read, its expiry is matched to the
+			// session's by CoreMiddleware when it next sets the jwt_token cookie
+			if c.Cookies(csrfCookieName) == "" {
+				if err := IssueCSRFToken(c, time.Now().Add(constants.SESSION_REMEMBER_ABSOLUTE_LIFETIME)); err != nil {
+					config.Logger.WarnContext(c.UserContext(), "Could not issue CSRF token", logging.Err(err))
+				}
+			}
+			return c.Next()
+		}
+
+		// Browsers always send Origin on non GET requests (Referer as a fallback), when present it must be ours.
+		// Neither being sent means a non browser client, which the token check still covers.
+		source := c.Get(fiber.HeaderOrigin)
+		if source == "" {
+			source = c.Get(fiber.HeaderReferer)
+		}
+		if source != "" && !csrfTrustedOrigins[normaliseOrigin(source)] {
+			config.Logger.WarnContext(c.UserContext(), "Cross origin request blocked",
+				slog.String("origin", source), logging.Persist(),
+			)
+			return general.SendError(c, fiber.StatusForbidden, "Untrusted request origin")
+		}
+
+		cookieToken := c.Cookies(csrfCookieName)
+		headerToken := c.Get(csrfHeaderName)
+		if cookieToken == "" || subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+			config.Logger.WarnContext(c.UserContext(), "CSRF token missing or mismatched", logging.Persist())
+			return general.SendError(c, fiber.StatusForbidden, "Invalid CSRF token")
+		}
+
+		return c.Next()
+	}
+}
+
+// IssueCSRFToken sets a fresh csrf_token cookie, call it wherever the jwt_token cookie is set.
+func IssueCSRFToken(c *fiber.Ctx, expires time.Time) error {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(tokenBytes),
+		Expires:  expires,
+		HTTPOnly: false, // The frontend has to read it
+		Secure:   httpsOn,
+		SameSite: "Strict",
+		Path:     "/",
+	})
+	return nil
+}
+
+// ExtendCSRFToken sets the csrf_token cookie's expiry to the session's, keeping its value so pages already
+// holding it keep working.
+func ExtendCSRFToken(c *fiber.Ctx, expires time.Time) {
+	token := c.Cookies(csrfCookieName)
+	if token == "" {
+		if err := IssueCSRFToken(c, expires); err != nil {
+			config.Logger.WarnContext(c.UserContext(), "Could not issue CSRF token", logging.Err(err))
+		}
+		return
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Expires:  expires,
+		HTTPOnly: false,
+		Secure:   httpsOn,
+		SameSite: "Strict",
+		Path:     "/",
+	})
+}
+
+// ClearCSRFToken expires the csrf_token cookie, on logout.
+func ClearCSRFToken(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookieName,
+		Value:    "",
+		Expires:  time.Now().Add(-(5 * time.Minute)),
+		HTTPOnly: false,
+		Secure:   httpsOn,
+		SameSite: "Strict",
+		Path:     "/",
+	})
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/general"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ImpersonatedByHeader carries the impersonating admin's id on every response to an impersonated request, so the
+// frontend can show a banner.
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// GetImpersonatorID is the admin behind the request when it's made through an impersonation session, otherwise "".
+func GetImpersonatorID(c *fiber.Ctx) string {
+	impersonatorID, _ := c.Locals("impersonator_id").(string)
+	return impersonatorID
+}
+
+// BlockImpersonation refuses routes an admin must never use as someone else (deleting the account, minting
+// credentials, consenting to apps). Must be registered after CoreMiddleware.
+func BlockImpersonation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if GetImpersonatorID(c) != "" {
+			return general.SendError(c, fiber.StatusForbidden, "Not allowed while impersonating")
+		}
+		return c.Next()
+	}
+}
+
+// sessionImpersonator is the admin a session was started for, "" for ordinary sessions.
+func sessionImpersonator(impersonatorID *string) string {
+	if impersonatorID == nil {
+		return ""
+	}
+	return *impersonatorID
+}
+
+// impersonatorSessionActive checks the admin's session behind an impersonation session is still live. Always
+// read from the database, the admin logging out or being revoked doesn't touch the impersonation session's cache.
+func impersonatorSessionActive(parent context.Context, session models.Sessions) (bool, error) {
+	if session.ImpersonatorSessionId == nil || session.ImpersonatorId == nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(parent, time.Duration(constants.DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+
+	var count int64
+	err := config.DB.WithContext(ctx).Model(&models.Sessions{}).
+		Where("id = ? AND user_id = ? AND expires_at > ?", *session.ImpersonatorSessionId, *session.ImpersonatorId, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
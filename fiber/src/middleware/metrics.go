@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"time"
+
+	"api/src/lib/general"
+	"api/src/lib/metrics"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsToken = general.GetEnv("METRICS_TOKEN", "")
+
+	// Without a token, scrapes are refused in production unless explicitly opened up (e.g. a private network only)
+	metricsOpen = general.GetEnv("METRICS_ALLOW_UNAUTHENTICATED", fmt.Sprint(general.GetEnv("NODE_ENV", "") != "production")) == "true"
+)
+
+// Metrics records request counts & latency per route pattern. Must run outside AccessLog so errors are
+// already resolved to their final status.
+func Metrics() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		route := c.Route().Path
+		if status == fiber.StatusNotFound {
+			route = "unmatched" // Keeps random paths from blowing up label cardinality
+		}
+		labels := []string{c.Method(), route, strconv.Itoa(status)}
+
+		metrics.HTTPRequests.WithLabelValues(labels...).Inc()
+		metrics.HTTPDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// MetricsHandler serves the Prometheus text format. If METRICS_TOKEN is set, scrapers must send it as a bearer token.
+// Without one it's only open where METRICS_ALLOW_UNAUTHENTICATED is (by default outside production).
+func MetricsHandler() fiber.Handler {
+	handler := adaptor.HTTPHandler(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	return func(c *fiber.Ctx) error {
+		if metricsToken == "" && !metricsOpen {
+			return general.SendError(c, fiber.StatusForbidden, "Metrics require METRICS_TOKEN")
+		}
+		if metricsToken != "" {
+			expected := "Bearer " + metricsToken
+			if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte(expected)) != 1 {
+				return general.SendError(c, fiber.StatusUnauthorized, "Invalid metrics token")
+			}
+		}
+		return handler(c)
+	}
+}
+
+// MetricsUnprotected reports whether /metrics is served to anyone, without a token.
+func MetricsUnprotected() bool {
+	return metricsToken == "" && metricsOpen
+}
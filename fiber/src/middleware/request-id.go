@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"log/slog"
+
+	"api/src/lib/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestID accepts an incoming X-Request-ID (i.e. nginx's $request_id) or generates one, then makes it available
+// via c.Locals("request_id") & c.UserContext(), and echoes it on the response.
+// The client IP & route are attached to the context as well, so every log line for the request carries them.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		requestID := c.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		c.Locals("request_id", requestID)
+		c.SetUserContext(logging.WithAttrs(logging.WithRequestID(c.UserContext(), requestID),
+			slog.String(logging.KeyIP, c.IP()),
+			slog.String(logging.KeyRoute, c.Method()+" "+c.Path()),
+		))
+		c.Set(requestIDHeader, requestID)
+
+		return c.Next()
+	}
+}
+
+// Only accept reasonably sized IDs made of URL safe characters, anything else is client controlled junk.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
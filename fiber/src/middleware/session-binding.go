@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/audit"
+	"api/src/lib/caching"
+	"api/src/lib/general"
+	"api/src/lib/logging"
+	"api/src/lib/metrics"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Header set on responses refused under the step_up policy, the client should confirm the password at /auth/step-up.
+const StepUpRequiredHeader = "X-Step-Up-Required"
+
+var (
+	// What happens when a session is used from a different client than it was created on (see constants.SESSION_BINDING_*)
+	sessionBindingPolicy = general.GetEnv("SESSION_BINDING_POLICY", constants.SESSION_BINDING_WARN)
+
+	// Whether another network counts as another client, off by default as mobile clients change address constantly
+	sessionBindingCheckIP = general.GetEnv("SESSION_BINDING_CHECK_IP", "false") == "true"
+)
+
+// Routes a session awaiting step-up can still use, to confirm the password or give up & log out
+var stepUpExemptRoutes = []string{"/auth/step-up", "/auth/logout"}
+
+// enforceSessionBinding compares the request's client with the session's fingerprint and applies
+// SESSION_BINDING_POLICY. It reports whether the request was refused, the response is written when it was.
+func enforceSessionBinding(c *fiber.Ctx, credential Credential, claims *security.JWTClaims, session models.Sessions) (bool, error) {
+	// Impersonation sessions are the admin's client, and sessions from before fingerprinting have nothing to compare
+	if sessionBindingPolicy == constants.SESSION_BINDING_IGNORE || session.ImpersonatorId != nil || session.Device == "" {
+		return false, nil
+	}
+
+	expected := security.Fingerprint{IP: session.Ip, UserAgent: session.UserAgent, Device: session.Device}
+	current := security.NewFingerprint(c.IP(), c.Get(fiber.HeaderUserAgent))
+	if !expected.Differs(current, sessionBindingCheckIP) {
+		return false, nil
+	}
+
+	ctx := c.UserContext()
+	metrics.AuthOutcomes.WithLabelValues(metrics.AuthAnomaly).Inc()
+
+	attrs := []any{
+		slog.String(logging.KeySessionID, session.Id),
+		slog.String(logging.KeyUserID, session.UserId),
+		slog.String("expected_device", expected.Device),
+		slog.String("device", current.Device),
+		slog.String("policy", sessionBindingPolicy),
+		logging.Persist(),
+	}
+	event := audit.NewEvent(c, audit.KindSessionAnomaly, audit.OutcomeSuccess).
+		WithActor(session.UserId).
+		WithTarget(session.UserId).
+		With("session_id", session.Id).
+		With("policy", sessionBindingPolicy).
+		With("expected_device", expected.Device).
+		With("expected_network", security.IPNetwork(expected.IP)).
+		With("device", current.Device)
+
+	// Revocations are always recorded, warnings & step-up refusals once per client (Redis down means every time)
+	if sessionBindingPolicy != constants.SESSION_BINDING_REVOKE {
+		client := current.Device + "|" + security.IPNetwork(current.IP)
+		if first, err := caching.MarkSessionAnomaly(ctx, session.Id, client); err == nil && !first {
+			attrs, event = nil, audit.Event{}
+		}
+	}
+	report := func(msg string, outcome audit.Outcome) {
+		if attrs == nil {
+			return
+		}
+		config.Logger.WarnContext(ctx, msg, attrs...)
+		event.Outcome = outcome
+		audit.RecordAsync(ctx, event)
+	}
+
+	switch sessionBindingPolicy {
+	case constants.SESSION_BINDING_REVOKE:
+		report("Session used from a different client, revoking it", audit.OutcomeBlocked)
+		revokeSession(c, credential, claims, session)
+		return true, general.SendError(c, fiber.StatusUnauthorized, "Session revoked, it was used from a different device")
+
+	case constants.SESSION_BINDING_STEP_UP:
+		if slices.ContainsFunc(stepUpExemptRoutes, func(route string) bool { return strings.HasSuffix(c.Path(), route) }) {
+			return false, nil
+		}
+		report("Session used from a different client, requiring step-up", audit.OutcomeBlocked)
+		c.Set(StepUpRequiredHeader, "true")
+		return true, general.SendError(c, fiber.StatusUnauthorized, "Confirm your password to continue on this device")
+
+	default:
+		report("Session used from a different client", audit.OutcomeSuccess)
+		return false, nil
+	}
+}
+
+// revokeSession deletes a session & everything that would keep it usable: the cached copy, the access token
+// and (for browsers) the cookie.
+func revokeSession(c *fiber.Ctx, credential Credential, claims *security.JWTClaims, session models.Sessions) {
+	ctx := c.UserContext()
+
+	if err := config.DB.WithContext(ctx).Delete(&models.Sessions{}, "id = ?", session.Id).Error; err != nil {
+		config.Logger.ErrorContext(ctx, "Could not delete session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+	if err := caching.DropCachedSession(ctx, session.Id); err != nil {
+		config.Logger.InfoContext(ctx, "Failed to drop cached session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+	if err := caching.DenyToken(ctx, claims.ID, claims.ExpiresAt.Time.Add(constants.JWT_LEEWAY)); err != nil {
+		config.Logger.WarnContext(ctx, "Could not revoke access token", logging.Err(err))
+	}
+
+	if credential.Kind == CredentialCookie {
+		c.Cookie(&fiber.Cookie{
+			Name:     "jwt_token",
+			Value:    "",
+			Expires:  time.Now().Add(-(5 * time.Minute)),
+			HTTPOnly: true,
+			Secure:   httpsOn,
+			SameSite: "Strict",
+			Path:     "/",
+		})
+		ClearCSRFToken(c)
+	}
+}
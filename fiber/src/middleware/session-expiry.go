@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/caching"
+	"api/src/lib/logging"
+	"api/src/lib/security"
+	"api/src/models"
+)
+
+// slideSession moves a session's expiry forward for activity now, up to its absolute expiry. The update is
+// conditional so concurrent requests write it once, and it reports whether this request did.
+func slideSession(ctx context.Context, session models.Sessions) (models.Sessions, bool) {
+	now := time.Now()
+	expiresAt := security.SlideSessionExpiry(session.RememberMe, session.AbsoluteExpiresAt, now)
+
+	// last_updated_at is set by the table's trigger
+	result := config.DB.WithContext(ctx).Model(&models.Sessions{}).
+		Where("id = ? AND last_updated_at < ?", session.Id, now.Add(-constants.SESSION_ACTIVITY_THROTTLE)).
+		Update("expires_at", expiresAt)
+	if result.Error != nil {
+		config.Logger.WarnContext(ctx, "Could not extend session", slog.String(logging.KeySessionID, session.Id), logging.Err(result.Error))
+		return session, false
+	} else if result.RowsAffected == 0 {
+		return session, false
+	}
+
+	session.ExpiresAt = expiresAt
+	session.LastUpdatedAt = now
+	if err := caching.CacheSession(ctx, session.Id, session); err != nil {
+		config.Logger.InfoContext(ctx, "Failed to cache session", slog.String(logging.KeySessionID, session.Id), logging.Err(err))
+	}
+	return session, true
+}
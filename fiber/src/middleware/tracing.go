@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"log/slog"
+	"strconv"
+
+	"api/src/lib/logging"
+	"api/src/lib/tracing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing opens the server span for each request, continuing the trace from an incoming traceparent header
+// (nginx / Next.js) when there is one. The span lives in c.UserContext(), so anything passed that context
+// (GORM, Redis, CoreMiddleware) shows up as a child. Place it after RequestID so the id is on the span.
+func Tracing() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		parent := otel.GetTextMapPropagator().Extract(c.UserContext(), requestHeaderCarrier{c})
+
+		ctx, span := tracing.Tracer().Start(parent, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Method()),
+				semconv.URLPath(c.Path()),
+				semconv.ClientAddress(c.IP()),
+				semconv.UserAgentOriginal(c.Get(fiber.HeaderUserAgent)),
+				attribute.String(logging.KeyRequestID, logging.RequestID(c.UserContext())),
+			),
+		)
+		defer span.End()
+
+		// Lets a log line be matched with its trace
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			ctx = logging.WithAttrs(ctx, slog.String(logging.KeyTraceID, traceID))
+		}
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+
+		// The route pattern is only known once routing has happened, it keeps span names low cardinality
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fiberErr, ok := err.(*fiber.Error); ok {
+				status = fiberErr.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		if status != fiber.StatusNotFound {
+			route := c.Route().Path
+			span.SetName(c.Method() + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+		if status >= fiber.StatusInternalServerError {
+			if err != nil {
+				span.RecordError(err)
+			}
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+
+		return err
+	}
+}
+
+// requestHeaderCarrier exposes fasthttp request headers to OpenTelemetry propagators.
+type requestHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h requestHeaderCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h requestHeaderCarrier) Set(key string, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h requestHeaderCarrier) Keys() []string {
+	keys := []string{}
+	h.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
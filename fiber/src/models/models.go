@@ -8,7 +8,9 @@ type Users struct {
 	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	Username	string	`json:"username" gorm:"not null"`
 	Password	string	`json:"password" gorm:"not null"`
+	Email	*string	`json:"email"`
 	IsVerified	bool	`json:"is_verified" gorm:"not null"`
+	IsAdmin	bool	`json:"is_admin" gorm:"not null"`
 	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
 	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
 }
@@ -20,7 +22,15 @@ func (Users) TableName() string {
 type Sessions struct {
 	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	ExpiresAt	time.Time	`json:"expires_at" gorm:"not null"`
+	AbsoluteExpiresAt	time.Time	`json:"absolute_expires_at" gorm:"not null"`
+	RememberMe	bool	`json:"remember_me" gorm:"not null"`
 	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	ImpersonatorId	*string	`json:"impersonator_id" gorm:"type:uuid"`
+	ImpersonatorSessionId	*string	`json:"impersonator_session_id" gorm:"type:uuid"`
+	Ip	string	`json:"ip" gorm:"not null"`
+	UserAgent	string	`json:"user_agent" gorm:"not null"`
+	Device	string	`json:"device" gorm:"not null"`
+	IsNewDevice	bool	`json:"is_new_device" gorm:"not null"`
 	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
 	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
 }
@@ -30,13 +40,166 @@ func (Sessions) TableName() string {
 }
 
 type Logs struct {
-	Id	int	`json:"id" gorm:"primaryKey"`
+	Id	int64	`json:"id" gorm:"primaryKey"`
 	Message	string	`json:"message" gorm:"not null"`
 	Level	int16	`json:"level" gorm:"not null"`
 	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	RequestId	string	`json:"request_id"`
+	UserId	*string	`json:"user_id" gorm:"type:uuid"`
+	Ip	string	`json:"ip"`
+	Route	string	`json:"route"`
+	Attributes	string	`json:"attributes" gorm:"not null"`
 }
 
 func (Logs) TableName() string {
 	return "logs"
 }
 
+type AuditEvents struct {
+	Id	int64	`json:"id" gorm:"primaryKey"`
+	Kind	string	`json:"kind" gorm:"not null"`
+	Outcome	string	`json:"outcome" gorm:"not null"`
+	ActorId	*string	`json:"actor_id" gorm:"type:uuid"`
+	TargetId	*string	`json:"target_id" gorm:"type:uuid"`
+	Ip	string	`json:"ip"`
+	UserAgent	string	`json:"user_agent"`
+	RequestId	string	`json:"request_id"`
+	Metadata	string	`json:"metadata" gorm:"not null"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	PrevHash	string	`json:"prev_hash" gorm:"not null"`
+	Hash	string	`json:"hash" gorm:"not null"`
+}
+
+func (AuditEvents) TableName() string {
+	return "audit_events"
+}
+
+type ApiKeys struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	Name	string	`json:"name" gorm:"not null"`
+	Prefix	string	`json:"prefix" gorm:"not null"`
+	Digest	string	`json:"digest" gorm:"not null"`
+	Salt	string	`json:"salt" gorm:"not null"`
+	Scopes	string	`json:"scopes" gorm:"not null"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (ApiKeys) TableName() string {
+	return "api_keys"
+}
+
+type UserIdentities struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	Provider	string	`json:"provider" gorm:"not null"`
+	Subject	string	`json:"subject" gorm:"not null"`
+	Email	*string	`json:"email"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (UserIdentities) TableName() string {
+	return "user_identities"
+}
+
+type OauthClients struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ClientId	string	`json:"client_id" gorm:"not null"`
+	Name	string	`json:"name" gorm:"not null"`
+	SecretDigest	string	`json:"secret_digest" gorm:"not null"`
+	SecretSalt	string	`json:"secret_salt" gorm:"not null"`
+	RedirectUris	string	`json:"redirect_uris" gorm:"not null"`
+	Scopes	string	`json:"scopes" gorm:"not null"`
+	SkipConsent	bool	`json:"skip_consent" gorm:"not null"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (OauthClients) TableName() string {
+	return "oauth_clients"
+}
+
+type OauthConsents struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	ClientId	string	`json:"client_id" gorm:"type:uuid;not null"`
+	Scopes	string	`json:"scopes" gorm:"not null"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (OauthConsents) TableName() string {
+	return "oauth_consents"
+}
+
+type OauthRefreshTokens struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	TokenDigest	string	`json:"token_digest" gorm:"not null"`
+	ClientId	string	`json:"client_id" gorm:"type:uuid;not null"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	SessionId	string	`json:"session_id" gorm:"type:uuid;not null"`
+	Scopes	string	`json:"scopes" gorm:"not null"`
+	ExpiresAt	time.Time	`json:"expires_at" gorm:"not null"`
+	UsedAt	*time.Time	`json:"used_at"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (OauthRefreshTokens) TableName() string {
+	return "oauth_refresh_tokens"
+}
+
+type MagicLinks struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	Purpose	string	`json:"purpose" gorm:"not null"`
+	Email	string	`json:"email" gorm:"not null"`
+	TokenDigest	string	`json:"token_digest" gorm:"not null"`
+	Ip	string	`json:"ip" gorm:"not null"`
+	UserAgent	string	`json:"user_agent" gorm:"not null"`
+	ExpiresAt	time.Time	`json:"expires_at" gorm:"not null"`
+	UsedAt	*time.Time	`json:"used_at"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (MagicLinks) TableName() string {
+	return "magic_links"
+}
+
+type UserDevices struct {
+	Id	string	`json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserId	string	`json:"user_id" gorm:"type:uuid;not null"`
+	Device	string	`json:"device" gorm:"not null"`
+	LastIp	string	`json:"last_ip" gorm:"not null"`
+	LastSeenAt	time.Time	`json:"last_seen_at" gorm:"not null"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (UserDevices) TableName() string {
+	return "user_devices"
+}
+
+type JobRuns struct {
+	Id	int64	`json:"id" gorm:"primaryKey"`
+	Job	string	`json:"job" gorm:"not null"`
+	ScheduledAt	time.Time	`json:"scheduled_at" gorm:"not null"`
+	StartedAt	time.Time	`json:"started_at" gorm:"not null"`
+	FinishedAt	*time.Time	`json:"finished_at"`
+	Status	string	`json:"status" gorm:"not null"`
+	Host	string	`json:"host" gorm:"not null"`
+	Result	string	`json:"result" gorm:"not null"`
+	Error	string	`json:"error" gorm:"not null"`
+	CreatedAt	time.Time	`json:"created_at" gorm:"not null"`
+	LastUpdatedAt	time.Time	`json:"last_updated_at" gorm:"not null"`
+}
+
+func (JobRuns) TableName() string {
+	return "job_runs"
+}
+
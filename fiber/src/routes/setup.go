@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"api/src/constants"
 	"api/src/handlers"
 	"api/src/lib/general"
 	"api/src/middleware"
@@ -18,27 +19,88 @@ func SetupRoutes(app *fiber.App) {
 	// Apply common security headers to all requests
 	app.Use(middleware.SecurityHeaders())
 
+	// Prometheus scrape endpoint, outside of the versioned API (keep it off the public nginx server).
+	app.Get("/metrics", middleware.MetricsHandler())
+
+	// Public JWT verification keys, for the Next.js server & internal services.
+	app.Get("/.well-known/jwks.json", handlers.GetJWKS)
+
+	// OpenID Connect provider for our other apps, at the issuer root (OIDC_PROVIDER_ISSUER) like the JWKS.
+	app.Get("/.well-known/openid-configuration", handlers.GetOpenIDConfiguration)
+
+	oauthGroup := app.Group("/oauth2")
+
+	oauthGroup.Get("/authorize", handlers.GetOAuthAuthorize)
+	oauthGroup.Post("/token", handlers.PostOAuthToken)
+	oauthGroup.Get("/userinfo", handlers.GetOAuthUserInfo)
+	oauthGroup.Post("/userinfo", handlers.GetOAuthUserInfo)
+
 	// Get API version from enviornment and apply to main route.
 	apiBase := app.Group(fmt.Sprintf("/api/%s", apiVersion))
 
 	// Seperate API into public and private segments, public avoids main middleware controls.
 	apiBasePublic := apiBase.Group("/public")
-	apiBasePrivate := apiBase.Group("/private", middleware.CoreMiddleware())
+	// CSRF checks cookie authenticated mutations before CoreMiddleware does any work.
+	apiBasePrivate := apiBase.Group("/private", middleware.CSRF(), middleware.CoreMiddleware())
 
 	// --- Main route setup ---
 
 	// Auth routes (Public) ---
 	apiBasePublic.Post("/auth/register", handlers.PostRegister)
 	apiBasePublic.Post("/auth/login", handlers.PostLogin)
+	apiBasePublic.Post("/auth/magic-link", handlers.PostMagicLink)
+	apiBasePublic.Post("/auth/magic-link/consume", handlers.PostMagicLinkConsume)
+	apiBasePublic.Post("/auth/email/verify", handlers.PostEmailVerify)
+	apiBasePublic.Get("/auth/oidc/providers", handlers.GetOIDCProviders)
+	apiBasePublic.Get("/auth/oidc/:provider/login", handlers.GetOIDCLogin)
+	apiBasePublic.Get("/auth/oidc/:provider/callback", handlers.GetOIDCCallback)
 
 	// Auth routes (Private) ---
-	apiBasePrivate.Delete("/auth/logout", handlers.DeleteLogout)
+	apiBasePrivate.Delete("/auth/logout", middleware.RequireSession(), handlers.DeleteLogout)
+	apiBasePrivate.Get("/auth/oidc/:provider/link", middleware.RequireSession(), middleware.BlockImpersonation(), handlers.GetOIDCLink)
+	apiBasePrivate.Delete("/auth/impersonation", middleware.RequireSession(), handlers.DeleteImpersonation)
+	apiBasePrivate.Post("/auth/step-up", middleware.RequireSession(), middleware.BlockImpersonation(), handlers.PostStepUp)
+	apiBasePrivate.Get("/auth/sessions", middleware.RequireSession(), handlers.GetSessions)
+	apiBasePrivate.Delete("/auth/sessions/:id", middleware.RequireSession(), handlers.DeleteSession)
 
 	// Users routes (Private) ---
 	usersGroup := apiBasePrivate.Group("/users")
 
-	usersGroup.Get("/me", handlers.GetMe) // -> Note: By default a user can only make requests regarding user data on their own data.
-	usersGroup.Patch("/me", handlers.PatchMe)
-	usersGroup.Delete("/me", handlers.DeleteMe)
+	usersGroup.Get("/me", middleware.RequireScope(constants.SCOPE_USERS_READ), handlers.GetMe) // -> Note: By default a user can only make requests regarding user data on their own data.
+	usersGroup.Patch("/me", middleware.RequireScope(constants.SCOPE_USERS_WRITE), handlers.PatchMe)
+	usersGroup.Delete("/me", middleware.RequireSession(), middleware.BlockImpersonation(), handlers.DeleteMe)
+
+	// API key routes (Private, sessions only - a key can't mint or revoke keys) ---
+	apiKeysGroup := apiBasePrivate.Group("/api-keys", middleware.RequireSession())
+
+	apiKeysGroup.Get("", handlers.GetApiKeys)
+	apiKeysGroup.Post("", middleware.BlockImpersonation(), handlers.PostApiKey)
+	apiKeysGroup.Delete("/:id", handlers.DeleteApiKey)
+
+	// OAuth consent routes (Private, sessions only - answering a client's authorization request) ---
+	oauthRequestsGroup := apiBasePrivate.Group("/oauth/requests", middleware.RequireSession())
+
+	oauthRequestsGroup.Get("/:id", handlers.GetOAuthRequest)
+	oauthRequestsGroup.Post("/:id", middleware.BlockImpersonation(), handlers.PostOAuthRequest)
+
+	// Admin routes (Private, admin only) ---
+	adminGroup := apiBasePrivate.Group("/admin", middleware.RequireSession(), middleware.RequireAdmin())
+
+	adminGroup.Get("/logs", handlers.GetAdminLogs)
+	adminGroup.Get("/audit/verify", handlers.GetAdminAuditVerify)
+	adminGroup.Get("/audit/export", handlers.GetAdminAuditExport)
+	adminGroup.Delete("/tokens/:jti", handlers.DeleteAdminToken)
+	adminGroup.Get("/oauth-clients", handlers.GetAdminOAuthClients)
+	adminGroup.Post("/oauth-clients", handlers.PostAdminOAuthClient)
+	adminGroup.Delete("/oauth-clients/:id", handlers.DeleteAdminOAuthClient)
+	adminGroup.Post("/impersonate/:id", handlers.PostAdminImpersonate)
+	adminGroup.Get("/scheduled-jobs", handlers.GetAdminScheduledJobs)
+	adminGroup.Get("/scheduled-jobs/runs", handlers.GetAdminScheduledJobRuns)
+	adminGroup.Get("/queue", handlers.GetAdminQueue)
+	adminGroup.Get("/queue/dead", handlers.GetAdminQueueDead)
+	adminGroup.Post("/queue/dead/retry", handlers.PostAdminQueueRetry)
+	adminGroup.Post("/queue/dead/:id/retry", handlers.PostAdminQueueRetry)
+	adminGroup.Delete("/queue/dead", handlers.DeleteAdminQueueDead)
+	adminGroup.Delete("/queue/dead/:id", handlers.DeleteAdminQueueDead)
 
 }
@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"api/src/config"
+	"api/src/lib/security"
+	"api/src/models"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const clientRedirectURI = "http://localhost:9999/callback"
+
+// createOAuthClient registers a confidential client, as the admin API would, returning its id & secret.
+func createOAuthClient(t *testing.T) (string, string) {
+	t.Helper()
+
+	secret := "integration-client-secret"
+	digest, err := security.Hash512(secret, nil)
+	if err != nil {
+		t.Fatalf("hash secret: %v", err)
+	}
+
+	client := models.OauthClients{
+		ClientId:     "it-" + strings.ReplaceAll(t.Name(), "/", "-"),
+		Name:         "Integration test client",
+		SecretDigest: digest.HashHex,
+		SecretSalt:   *digest.Salt,
+		RedirectUris: clientRedirectURI,
+		Scopes:       "offline_access openid profile",
+	}
+	if err := config.DB.Create(&client).Error; err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	t.Cleanup(func() { config.DB.Delete(&models.OauthClients{}, "id = ?", client.Id) })
+	return client.ClientId, secret
+}
+
+// csrfToken is the browser's csrf_token cookie, echoed in X-CSRF-Token as the frontend does.
+func csrfToken(t *testing.T, browser *http.Client, base string) string {
+	t.Helper()
+
+	u, _ := url.Parse(base)
+	for _, cookie := range browser.Jar.Cookies(u) {
+		if cookie.Name == "csrf_token" {
+			return cookie.Value
+		}
+	}
+	t.Fatalf("browser has no csrf_token cookie")
+	return ""
+}
+
+// redeemRefresh posts a refresh_token grant, returning the status & the decoded response.
+func redeemRefresh(t *testing.T, base string, clientID string, secret string, refreshToken string) (int, map[string]any) {
+	t.Helper()
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	req, _ := http.NewRequest(http.MethodPost, base+"/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	defer res.Body.Close()
+
+	body := map[string]any{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("refresh: decode response: %v", err)
+	}
+	return res.StatusCode, body
+}
+
+func TestOIDCProviderFlow(t *testing.T) {
+	base := startApp(t)
+	ctx := context.Background()
+
+	browser := newBrowser(t)
+	userID := register(t, browser, base)
+	clientID, secret := createOAuthClient(t)
+
+	// Discovery, the issuer must be exactly where it's served from
+	provider, err := oidc.NewProvider(ctx, base)
+	if err != nil {
+		t.Fatalf("discovery: %v", err)
+	}
+	conf := oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: secret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  clientRedirectURI,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", oidc.ScopeOfflineAccess},
+	}
+
+	// Authorize, the browser is sent to the consent page with the pending request
+	state, nonce, verifier := "client-state", "client-nonce", oauth2.GenerateVerifier()
+	authURL := conf.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	consentURL, err := url.Parse(get(t, browser, authURL, http.StatusFound).Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("consent redirect: %v", err)
+	}
+	requestURL := base + apiBase + "/private/oauth/requests/" + consentURL.Query().Get("request")
+
+	// Consent, first asked then approved
+	res, err := browser.Get(requestURL)
+	if err != nil {
+		t.Fatalf("GET consent request: %v", err)
+	}
+	var pending struct {
+		ConsentRequired bool     `json:"consent_required"`
+		Scopes          []string `json:"scopes"`
+	}
+	json.NewDecoder(res.Body).Decode(&pending)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !pending.ConsentRequired {
+		t.Fatalf("GET consent request: status %d, consent_required %v", res.StatusCode, pending.ConsentRequired)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader([]byte(`{"approve":true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", csrfToken(t, browser, base))
+	res, err = browser.Do(req)
+	if err != nil {
+		t.Fatalf("POST consent: %v", err)
+	}
+	var answer struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	json.NewDecoder(res.Body).Decode(&answer)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST consent: status %d", res.StatusCode)
+	}
+
+	callback, err := url.Parse(answer.RedirectTo)
+	if err != nil || !strings.HasPrefix(answer.RedirectTo, clientRedirectURI) || callback.Query().Get("state") != state {
+		t.Fatalf("consent redirects to %q, want the client's redirect URI with its state", answer.RedirectTo)
+	}
+	code := callback.Query().Get("code")
+
+	// Code exchange, the verifier has to match the challenge & a failed attempt spends the code
+	if _, err := conf.Exchange(ctx, code, oauth2.VerifierOption(oauth2.GenerateVerifier())); err == nil {
+		t.Fatalf("exchange with the wrong code_verifier succeeded")
+	}
+	if _, err := conf.Exchange(ctx, code, oauth2.VerifierOption(verifier)); err == nil {
+		t.Fatalf("a code redeemed with the wrong verifier was still usable")
+	}
+
+	// A fresh authorization, consent is remembered now so it's approved straight away
+	state, verifier = "client-state-2", oauth2.GenerateVerifier()
+	consentURL, _ = url.Parse(get(t, browser, conf.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound).Header.Get("Location"))
+	requestURL = base + apiBase + "/private/oauth/requests/" + consentURL.Query().Get("request")
+	res, _ = browser.Get(requestURL)
+	json.NewDecoder(res.Body).Decode(&pending)
+	res.Body.Close()
+	if pending.ConsentRequired {
+		t.Fatalf("consent asked again for scopes already approved")
+	}
+	req, _ = http.NewRequest(http.MethodPost, requestURL, bytes.NewReader([]byte(`{"approve":true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", csrfToken(t, browser, base))
+	res, _ = browser.Do(req)
+	json.NewDecoder(res.Body).Decode(&answer)
+	res.Body.Close()
+	callback, _ = url.Parse(answer.RedirectTo)
+
+	token, err := conf.Exchange(ctx, callback.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if _, err := conf.Exchange(ctx, callback.Query().Get("code"), oauth2.VerifierOption(verifier)); err == nil {
+		t.Fatalf("an authorization code was redeemed twice")
+	}
+
+	// The ID token verifies against the JWKS & carries the nonce
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: clientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		t.Fatalf("verify id_token: %v", err)
+	}
+	if idToken.Subject != userID || idToken.Nonce != nonce {
+		t.Fatalf("id_token for %s with nonce %q, want %s & %q", idToken.Subject, idToken.Nonce, userID, nonce)
+	}
+
+	// Userinfo
+	info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		t.Fatalf("userinfo: %v", err)
+	}
+	if info.Subject != userID {
+		t.Fatalf("userinfo for %s, want %s", info.Subject, userID)
+	}
+
+	// Refresh rotation, each refresh token is swapped for a new one
+	first := token.RefreshToken
+	if first == "" {
+		t.Fatalf("no refresh token despite offline_access")
+	}
+	status, rotated := redeemRefresh(t, base, clientID, secret, first)
+	second, _ := rotated["refresh_token"].(string)
+	if status != http.StatusOK || second == "" || second == first {
+		t.Fatalf("refresh: status %d, response %v", status, rotated)
+	}
+	if _, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: rotated["access_token"].(string), TokenType: "Bearer"})); err != nil {
+		t.Fatalf("userinfo with the refreshed access token: %v", err)
+	}
+
+	// Reusing the spent token is refused & revokes the whole family, the token it was swapped for included
+	if status, body := redeemRefresh(t, base, clientID, secret, first); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("reused refresh token: status %d, response %v", status, body)
+	}
+	if status, body := redeemRefresh(t, base, clientID, secret, second); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("refresh token from a reused family: status %d, response %v", status, body)
+	}
+
+	var remaining int64
+	config.DB.Model(&models.OauthRefreshTokens{}).Where("user_id = ?", userID).Count(&remaining)
+	if remaining != 0 {
+		t.Fatalf("%d refresh tokens left after reuse, want the family revoked", remaining)
+	}
+}
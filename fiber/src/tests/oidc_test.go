@@ -0,0 +1,387 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/caching"
+	"api/src/lib/sso"
+	"api/src/models"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+const (
+	mockClientID     = "integration-client"
+	mockClientSecret = "integration-secret"
+	mockKeyID        = "mock-1"
+)
+
+// mockIssuer is a minimal OpenID Connect provider: discovery, JWKS, an authorize endpoint that logs in whoever
+// the test says & a token endpoint that checks PKCE before signing the ID token.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	identity sso.Identity     // Who the next authorization logs in
+	badNonce bool             // Sign the next ID token with a nonce of our own
+	codes    map[string]grant // Issued codes, single use
+	rejected int              // Token requests refused for a PKCE mismatch
+}
+
+type grant struct {
+	identity  sso.Identity
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]grant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("GET /jwks", m.jwks)
+	mux.HandleFunc("GET /authorize", m.authorize)
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) next(identity sso.Identity, badNonce bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identity, m.badNonce = identity, badNonce
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &m.key.PublicKey, KeyID: mockKeyID, Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != mockClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code := uuid.NewString()
+	nonce := query.Get("nonce")
+	if m.badNonce {
+		nonce = "not-the-nonce-we-were-sent"
+	}
+	m.codes[code] = grant{identity: m.identity, nonce: nonce, challenge: query.Get("code_challenge")}
+	m.mu.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	values := callback.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	callback.RawQuery = values.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != mockClientID || secret != mockClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	m.mu.Lock()
+	g, found := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	pkceOK := base64.RawURLEncoding.EncodeToString(sum[:]) == g.challenge
+	if found && !pkceOK {
+		m.rejected++
+	}
+	m.mu.Unlock()
+
+	if !found || !pkceOK {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.URL,
+		"sub":            g.identity.Subject,
+		"aud":            mockClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.identity.Email,
+		"email_verified": g.identity.EmailVerified,
+	})
+	idToken.Header["kid"] = mockKeyID
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// setupOIDC registers the mock issuer as the "mock" provider.
+func setupOIDC(t *testing.T) (string, *mockIssuer) {
+	t.Helper()
+
+	base := startApp(t)
+	issuer := newMockIssuer(t)
+
+	previous := sso.Providers
+	sso.Providers = map[string]*sso.Provider{"mock": {
+		Name:         "mock",
+		Issuer:       issuer.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		RedirectURL:  base + apiBase + "/public/auth/oidc/mock/callback",
+	}}
+	t.Cleanup(func() { sso.Providers = previous })
+
+	return base, issuer
+}
+
+// authorize starts a login & lets the mock issuer log in, returning the callback URL it redirects back to.
+func authorize(t *testing.T, browser *http.Client, base string) string {
+	t.Helper()
+
+	login := get(t, browser, base+apiBase+"/public/auth/oidc/mock/login", http.StatusFound)
+	consent := get(t, browser, login.Header.Get("Location"), http.StatusFound)
+	return consent.Header.Get("Location")
+}
+
+func newIdentity(emailVerified bool) sso.Identity {
+	subject := uuid.NewString()
+	return sso.Identity{Subject: subject, Email: "oidc-" + subject + "@example.com", EmailVerified: emailVerified}
+}
+
+// createUser adds a password user with an email, removed again (identities & sessions too) after the test.
+func createUser(t *testing.T, email string, verified bool) models.Users {
+	t.Helper()
+
+	user := models.Users{Username: "it-" + uuid.NewString()[:8], Password: "unused", Email: &email, IsVerified: verified}
+	if err := config.DB.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	t.Cleanup(func() { config.DB.Delete(&models.Users{}, "id = ?", user.Id) })
+	return user
+}
+
+// identityOwner is the user an identity was linked to, cleaning that user up after the test when it was created
+// by the login.
+func identityOwner(t *testing.T, subject string) string {
+	t.Helper()
+
+	var identity models.UserIdentities
+	if err := config.DB.First(&identity, "provider = ? AND subject = ?", "mock", subject).Error; err != nil {
+		t.Fatalf("identity %s was not stored: %v", subject, err)
+	}
+	t.Cleanup(func() { config.DB.Delete(&models.Users{}, "id = ?", identity.UserId) })
+	return identity.UserId
+}
+
+func sessionCookie(t *testing.T, res *http.Response) {
+	t.Helper()
+
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "jwt_token" && cookie.Value != "" {
+			return
+		}
+	}
+	t.Fatalf("login set no jwt_token cookie")
+}
+
+func TestOIDCLoginRegistersNewUser(t *testing.T) {
+	base, issuer := setupOIDC(t)
+	browser := newBrowser(t)
+
+	identity := newIdentity(true)
+	issuer.next(identity, false)
+
+	callback := authorize(t, browser, base)
+	res := get(t, browser, callback, http.StatusFound)
+	sessionCookie(t, res)
+	userID := identityOwner(t, identity.Subject)
+
+	// The cookie is an ordinary session
+	me, err := browser.Get(base + apiBase + "/private/users/me")
+	if err != nil {
+		t.Fatalf("GET /users/me: %v", err)
+	}
+	defer me.Body.Close()
+
+	var user models.Users
+	if err := json.NewDecoder(me.Body).Decode(&user); err != nil || me.StatusCode != http.StatusOK {
+		t.Fatalf("GET /users/me: status %d, %v", me.StatusCode, err)
+	}
+	if user.Id != userID {
+		t.Fatalf("logged in as %s, want the identity's user %s", user.Id, userID)
+	}
+
+	// The state is single use
+	get(t, browser, callback, http.StatusBadRequest)
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+	base, issuer := setupOIDC(t)
+	issuer.next(newIdentity(true), false)
+
+	// A state that isn't the one this browser started with
+	browser := newBrowser(t)
+	callback, _ := url.Parse(authorize(t, browser, base))
+	query := callback.Query()
+	query.Set("state", "forged-state")
+	callback.RawQuery = query.Encode()
+	get(t, browser, callback.String(), http.StatusBadRequest)
+
+	// The right state finished in another browser (login CSRF)
+	callback, _ = url.Parse(authorize(t, newBrowser(t), base))
+	get(t, newBrowser(t), callback.String(), http.StatusBadRequest)
+}
+
+func TestOIDCCallbackRejectsBadNonce(t *testing.T) {
+	base, issuer := setupOIDC(t)
+	browser := newBrowser(t)
+
+	identity := newIdentity(true)
+	issuer.next(identity, true)
+
+	res := get(t, browser, authorize(t, browser, base), http.StatusUnauthorized)
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "jwt_token" && cookie.Value != "" {
+			t.Fatalf("a bad nonce still logged in")
+		}
+	}
+
+	var count int64
+	config.DB.Model(&models.UserIdentities{}).Where("subject = ?", identity.Subject).Count(&count)
+	if count != 0 {
+		t.Fatalf("a bad nonce still stored the identity")
+	}
+}
+
+func TestOIDCCallbackRejectsPKCEMismatch(t *testing.T) {
+	base, issuer := setupOIDC(t)
+	browser := newBrowser(t)
+	issuer.next(newIdentity(true), false)
+
+	callback, _ := url.Parse(authorize(t, browser, base))
+	state := callback.Query().Get("state")
+
+	// Swap the verifier we'll redeem the code with, as if the code had been intercepted into another flow
+	ctx := context.Background()
+	flow, err := caching.TakeOIDCFlow(ctx, state)
+	if err != nil {
+		t.Fatalf("load flow: %v", err)
+	}
+	flow.CodeVerifier = oauth2.GenerateVerifier()
+	if err := caching.SaveOIDCFlow(ctx, state, *flow, constants.OIDC_FLOW_TTL); err != nil {
+		t.Fatalf("save flow: %v", err)
+	}
+
+	get(t, browser, callback.String(), http.StatusUnauthorized)
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if issuer.rejected != 1 {
+		t.Fatalf("issuer refused %d token requests for PKCE, want 1", issuer.rejected)
+	}
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	base, issuer := setupOIDC(t)
+	browser := newBrowser(t)
+
+	identity := newIdentity(true)
+	existing := createUser(t, identity.Email, true)
+	issuer.next(identity, false)
+
+	sessionCookie(t, get(t, browser, authorize(t, browser, base), http.StatusFound))
+	if owner := identityOwner(t, identity.Subject); owner != existing.Id {
+		t.Fatalf("identity went to user %s, want the verified email's owner %s", owner, existing.Id)
+	}
+}
+
+func TestOIDCLoginNeverLinksUnverifiedEmail(t *testing.T) {
+	base, issuer := setupOIDC(t)
+
+	cases := []struct {
+		name             string
+		providerVerified bool
+		userVerified     bool
+	}{
+		{"unverified at the provider", false, true},
+		{"unverified here", true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			browser := newBrowser(t)
+
+			identity := newIdentity(tc.providerVerified)
+			existing := createUser(t, identity.Email, tc.userVerified)
+			issuer.next(identity, false)
+
+			sessionCookie(t, get(t, browser, authorize(t, browser, base), http.StatusFound))
+			if owner := identityOwner(t, identity.Subject); owner == existing.Id {
+				t.Fatalf("identity was linked to %s by an unverified email", existing.Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sync"
+	"testing"
+
+	"api/src/config"
+	"api/src/lib/general"
+	"api/src/lib/keyring"
+	"api/src/lib/security"
+	"api/src/middleware"
+	"api/src/models"
+	"api/src/routes"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// The integration tests run the full app against TEST_DATABASE_URL, a Postgres database created from
+// postgres/init.sql (i.e. docker compose's), & an in memory Redis. Without it they're skipped.
+const apiBase = "/api/v0"
+
+var (
+	startOnce sync.Once
+	startErr  error
+	baseURL   string
+)
+
+// startApp serves the app (routes & middleware as in main) on a local port, once for the whole package.
+func startApp(t *testing.T) string {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	startOnce.Do(func() { startErr = serve(dsn) })
+	if startErr != nil {
+		t.Fatalf("start app: %v", startErr)
+	}
+	return baseURL
+}
+
+func serve(dsn string) error {
+	var err error
+	config.DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		return fmt.Errorf("start redis: %w", err)
+	}
+	config.RedisClient = redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+
+	if security.JWTSecrets, err = keyring.Parse("t1:integration-test-jwt-secret"); err != nil {
+		return err
+	}
+	// An asymmetric key too, the OpenID Connect provider needs one to sign ID tokens
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	security.SigningKeys = []security.SigningKey{{ID: "it-1", Method: jwt.SigningMethodEdDSA, Private: private, Public: public}}
+
+	app := fiber.New(fiber.Config{
+		CaseSensitive:         true,
+		StrictRouting:         true,
+		ErrorHandler:          general.ErrorHandler,
+		DisableStartupMessage: true,
+	})
+	app.Use(middleware.RequestID())
+	routes.SetupRoutes(app)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	baseURL = "http://" + listener.Addr().String()
+	security.OIDCIssuer = baseURL
+
+	go app.Listener(listener)
+	return nil
+}
+
+// newBrowser keeps cookies like a browser but hands redirects back to the test, to follow step by step.
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookie jar: %v", err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// get requests url, expecting status & returning the response (its body already closed).
+func get(t *testing.T, client *http.Client, url string, status int) *http.Response {
+	t.Helper()
+
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != status {
+		t.Fatalf("GET %s: status %d, want %d", url, res.StatusCode, status)
+	}
+	return res
+}
+
+// register signs up a new user in the browser, removed again (sessions & grants too) after the test.
+func register(t *testing.T, browser *http.Client, base string) string {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"username": "it-" + uuid.NewString()[:8], "raw_password": "integration-password"})
+	res, err := browser.Post(base+apiBase+"/public/auth/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	defer res.Body.Close()
+
+	var user struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("register: status %d, %v", res.StatusCode, err)
+	}
+	t.Cleanup(func() { config.DB.Delete(&models.Users{}, "id = ?", user.ID) })
+	return user.ID
+}
@@ -2,11 +2,12 @@ package tools
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 
 	"api/src/config"
+	"api/src/lib/logging"
 )
 
 func GenerateModelsFromDatabase() error {
@@ -32,7 +33,7 @@ import (
 
 		modelStruct, err := generateStructFromTable(table)
 		if err != nil {
-			log.Printf("[WARN] Could not generate struct for table %s: %v", table, err)
+			config.Logger.Warn("Could not generate struct for table", slog.String("table", table), logging.Err(err))
 			continue
 		}
 
@@ -50,7 +51,7 @@ import (
 		return fmt.Errorf("[ERROR] Failed to write to models.go :%v", err)
 	}
 
-	log.Println("[NOTICE] Models generated successfully. Can be found in models/models.go")
+	config.Logger.Info("Models generated successfully. Can be found in models/models.go")
 	return nil
 }
 
@@ -149,7 +150,8 @@ func mapPostgresToGoType(pgType string, nullable bool) string {
 		goType = "interface{}" // fallback for unknown types
 	}
 
-	if nullable && goType != "string" {
+	// Nullable UUIDs must be pointers too, an empty string is not a valid UUID
+	if nullable && (goType != "string" || pgType == "uuid") {
 		return "*" + goType
 	}
 
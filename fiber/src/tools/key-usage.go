@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"api/src/config"
+	"api/src/constants"
+	"api/src/lib/keyring"
+	"api/src/lib/security"
+)
+
+// ReportKeyUsage logs how many password hashes use each pepper key, flagging retired & unknown keys, and lists
+// the JWT signing keys. It returns the number of records still on retired (or unknown) keys.
+func ReportKeyUsage() (int64, error) {
+	type keyCount struct {
+		KeyId string
+		Count int64
+	}
+
+	// Hashes are "<key id>:<hash>", unprefixed ones predate key ids & use the legacy pepper
+	var counts []keyCount
+	if err := config.DB.Raw(`
+		SELECT CASE WHEN password LIKE '$%' THEN ? ELSE split_part(password, ':', 1) END AS key_id, count(*) AS count
+		FROM users
+		WHERE password <> '' -- Social login only accounts
+		GROUP BY 1
+		ORDER BY 1`, keyring.LegacyID,
+	).Scan(&counts).Error; err != nil {
+		return 0, fmt.Errorf("[ERROR] Failed to count password hashes by key: %v", err)
+	}
+
+	var outstanding int64
+	used := map[string]bool{}
+	for _, count := range counts {
+		used[count.KeyId] = true
+		status := keyStatus(security.Peppers, count.KeyId)
+		if status != "current" {
+			outstanding += count.Count
+		}
+
+		config.Logger.Info("Password hashes by pepper key",
+			slog.String("key_id", count.KeyId),
+			slog.String("status", status),
+			slog.Int64("users", count.Count),
+		)
+	}
+
+	for _, id := range security.Peppers.IDs() {
+		if !security.Peppers.IsCurrent(id) && !used[id] {
+			config.Logger.Info("Retired pepper key is unused and can be removed from HASH_PEPPERS", slog.String("key_id", id))
+		}
+	}
+
+	// Tokens aren't stored, a retired JWT key is unused once the longest lived token signed with it has expired
+	ids := security.JWTSecrets.IDs()
+	if len(ids) > 0 {
+		config.Logger.Info("JWT signing keys",
+			slog.String("current", ids[0]),
+			slog.String("retired", strings.Join(ids[1:], ",")),
+			slog.String("retired_removable_after", constants.JWT_DURATION.String()+" from rotation"),
+		)
+	}
+
+	return outstanding, nil
+}
+
+func keyStatus(ring *keyring.Keyring, id string) string {
+	switch _, known := ring.Get(id); {
+	case !known:
+		return "unknown"
+	case ring.IsCurrent(id):
+		return "current"
+	default:
+		return "retired"
+	}
+}
@@ -0,0 +1,245 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"api/src/config"
+	"api/src/constants"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type OIDCCheckConfig struct {
+	Issuer       string // Our OIDC_PROVIDER_ISSUER
+	APIBase      string // i.e. http://localhost:8080/api/v1.0.0, for logging in & consenting
+	ClientID     string
+	ClientSecret string // Empty for public clients
+	RedirectURI  string // Must be registered for the client, it's never actually visited
+	Username     string
+	Password     string
+}
+
+// CheckOIDCProvider runs the authorization code flow against a running API the way a client app would:
+// discovery, login & consent (as the user, with a bearer token), code exchange with PKCE, ID token verification
+// against the JWKS, userinfo, then refresh token rotation & reuse detection when offline_access is allowed.
+func CheckOIDCProvider(parent context.Context, cfg OIDCCheckConfig) error {
+	ctx, cancel := context.WithTimeout(parent, time.Minute)
+	defer cancel()
+
+	// Never follow redirects, every hop is inspected
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ctx = oidc.ClientContext(ctx, httpClient)
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	config.Logger.Info("Discovery document loaded", slog.String("issuer", cfg.Issuer))
+
+	var discovery struct {
+		Scopes []string `json:"scopes_supported"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	scopes := []string{oidc.ScopeOpenID, constants.OIDC_SCOPE_PROFILE}
+	if slices.Contains(discovery.Scopes, constants.OIDC_SCOPE_OFFLINE_ACCESS) {
+		scopes = append(scopes, constants.OIDC_SCOPE_OFFLINE_ACCESS)
+	}
+
+	// Log in as the user, the consent API takes a bearer token like any private route
+	var login struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := postJSON(ctx, httpClient, cfg.APIBase+"/public/auth/login", "", map[string]string{
+		"username":     cfg.Username,
+		"raw_password": cfg.Password,
+		"client_type":  constants.CLIENT_TYPE_NATIVE,
+	}, &login); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	config.Logger.Info("Logged in", slog.String("username", cfg.Username))
+
+	oauthConfig := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  cfg.RedirectURI,
+		Scopes:       scopes,
+	}
+	state, nonce, verifier := randomString(), randomString(), oauth2.GenerateVerifier()
+
+	// Authorize, which hands the browser to the consent page
+	authorizeRes, err := doRequest(ctx, httpClient, http.MethodGet,
+		oauthConfig.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), "", nil)
+	if err != nil {
+		return fmt.Errorf("authorize: %w", err)
+	}
+	authorizeRes.Body.Close()
+	location, err := url.Parse(authorizeRes.Header.Get("Location"))
+	if authorizeRes.StatusCode != http.StatusFound || err != nil || location.Query().Get("request") == "" {
+		return fmt.Errorf("authorize: expected a redirect to the consent page, got %d %q", authorizeRes.StatusCode, authorizeRes.Header.Get("Location"))
+	}
+	requestID := location.Query().Get("request")
+
+	// Consent, as the consent page would
+	var consent struct {
+		ConsentRequired bool `json:"consent_required"`
+	}
+	if err := getJSON(ctx, httpClient, cfg.APIBase+"/private/oauth/requests/"+requestID, login.AccessToken, &consent); err != nil {
+		return fmt.Errorf("consent: %w", err)
+	}
+	var approval struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	if err := postJSON(ctx, httpClient, cfg.APIBase+"/private/oauth/requests/"+requestID, login.AccessToken,
+		map[string]bool{"approve": true}, &approval); err != nil {
+		return fmt.Errorf("consent: %w", err)
+	}
+	callback, err := url.Parse(approval.RedirectTo)
+	if err != nil || !strings.HasPrefix(approval.RedirectTo, cfg.RedirectURI) {
+		return fmt.Errorf("consent: redirect_to %q is not the redirect URI", approval.RedirectTo)
+	}
+	if callback.Query().Get("state") != state {
+		return errors.New("consent: state was not passed back")
+	}
+	config.Logger.Info("Consent given", slog.Bool("consent_required", consent.ConsentRequired))
+
+	// Code exchange & ID token verification
+	token, err := oauthConfig.Exchange(ctx, callback.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	idToken, err := verifyIDToken(ctx, provider, cfg.ClientID, token)
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return errors.New("token: id_token nonce does not match")
+	}
+	config.Logger.Info("ID token verified", slog.String("sub", idToken.Subject))
+
+	// A code is single use
+	if _, err := oauthConfig.Exchange(ctx, callback.Query().Get("code"), oauth2.VerifierOption(verifier)); err == nil {
+		return errors.New("token: authorization code was accepted twice")
+	}
+
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return fmt.Errorf("userinfo: %w", err)
+	}
+	if userInfo.Subject != idToken.Subject {
+		return fmt.Errorf("userinfo: sub %q does not match the id_token's %q", userInfo.Subject, idToken.Subject)
+	}
+	config.Logger.Info("Userinfo matches the ID token")
+
+	if token.RefreshToken == "" {
+		config.Logger.Info("No refresh token issued (client lacks offline_access), skipping refresh checks")
+		return nil
+	}
+
+	// Refresh, then replay the spent token, which must be refused
+	refreshed, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	if err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if refreshed.RefreshToken == "" || refreshed.RefreshToken == token.RefreshToken {
+		return errors.New("refresh: refresh token was not rotated")
+	}
+	if _, err := verifyIDToken(ctx, provider, cfg.ClientID, refreshed); err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	config.Logger.Info("Refresh token rotated")
+
+	if _, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token(); err == nil {
+		return errors.New("refresh: a spent refresh token was accepted")
+	}
+	if _, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshed.RefreshToken}).Token(); err == nil {
+		return errors.New("refresh: reuse of a spent token did not revoke its successor")
+	}
+	config.Logger.Info("Refresh token reuse detected & the chain revoked")
+
+	return nil
+}
+
+func verifyIDToken(ctx context.Context, provider *oidc.Provider, clientID string, token *oauth2.Token) (*oidc.IDToken, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in the token response")
+	}
+	return provider.Verifier(&oidc.Config{ClientID: clientID}).Verify(ctx, rawIDToken)
+}
+
+func doRequest(ctx context.Context, client *http.Client, method string, target string, bearer string, body any) (*http.Response, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return client.Do(req)
+}
+
+func getJSON(ctx context.Context, client *http.Client, target string, bearer string, out any) error {
+	return requestJSON(ctx, client, http.MethodGet, target, bearer, nil, out)
+}
+
+func postJSON(ctx context.Context, client *http.Client, target string, bearer string, body any, out any) error {
+	return requestJSON(ctx, client, http.MethodPost, target, bearer, body, out)
+}
+
+func requestJSON(ctx context.Context, client *http.Client, method string, target string, bearer string, body any, out any) error {
+	res, err := doRequest(ctx, client, method, target, bearer, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&failure)
+		return fmt.Errorf("%s %s: %d %s", method, target, res.StatusCode, failure.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"api/src/config"
+	"api/src/lib/queue"
+)
+
+// InspectQueue logs the job queue's counts, then up to count dead jobs oldest first. Sensitive payloads are
+// left out, as in the admin API.
+func InspectQueue(ctx context.Context, count int64) error {
+	stats, err := queue.GetStats(ctx)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to read job queue stats: %v", err)
+	}
+	config.Logger.Info("Job queue",
+		slog.Int64("queued", stats.Queued),
+		slog.Int64("running", stats.Running),
+		slog.Int64("delayed", stats.Delayed),
+		slog.Int64("dead", stats.Dead),
+	)
+
+	dead, err := queue.DeadJobs(ctx, "", count)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to list dead jobs: %v", err)
+	}
+	for _, entry := range dead {
+		attrs := []any{
+			slog.String("entry_id", entry.EntryID),
+			slog.String("job_id", entry.ID),
+			slog.String("type", entry.Type),
+			slog.Int("attempts", entry.Attempts),
+			slog.String("last_error", entry.LastError),
+		}
+		if entry.FailedAt != nil {
+			attrs = append(attrs, slog.Time("failed_at", *entry.FailedAt))
+		}
+		if !entry.Redacted {
+			attrs = append(attrs, slog.String("payload", string(entry.Payload)))
+		}
+		config.Logger.Info("Dead job", attrs...)
+	}
+	return nil
+}
+
+// RetryDeadJobs queues a dead job again by its entry ID, or every dead job for "all", returning how many were.
+func RetryDeadJobs(ctx context.Context, target string) (int64, error) {
+	if target == "all" {
+		retried, err := queue.RetryAllDead(ctx)
+		return int64(retried), err
+	}
+	if !queue.ValidEntryID(target) {
+		return 0, fmt.Errorf("[ERROR] %q is not a dead job entry id or all", target)
+	}
+	return 1, queue.RetryDead(ctx, target)
+}
+
+// PurgeDeadJobs deletes a dead job by its entry ID, or every dead job for "all", returning how many were.
+func PurgeDeadJobs(ctx context.Context, target string) (int64, error) {
+	if target == "all" {
+		return queue.PurgeAllDead(ctx)
+	}
+	if !queue.ValidEntryID(target) {
+		return 0, fmt.Errorf("[ERROR] %q is not a dead job entry id or all", target)
+	}
+	return 1, queue.PurgeDead(ctx, target)
+}
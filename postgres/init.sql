@@ -1,5 +1,4 @@
 -- Extension support
-CREATE EXTENSION IF NOT EXISTS pg_cron;
 CREATE EXTENSION IF NOT EXISTS "pgcrypto";
 
 -- Function to auto update the last_updated_at timestamp
@@ -17,12 +16,15 @@ CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     username VARCHAR(64) NOT NULL UNIQUE,
     password TEXT NOT NULL,
+    email VARCHAR(255) UNIQUE,
     is_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
 CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
 CREATE INDEX IF NOT EXISTS idx_users_last_updated_at ON users(last_updated_at);
 
@@ -34,13 +36,22 @@ UPDATE
 -- Sessions ------------------------------------------
 CREATE TABLE IF NOT EXISTS sessions (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    expires_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL, -- Slides forward with activity (idle timeout), up to absolute_expires_at
+    absolute_expires_at TIMESTAMPTZ NOT NULL,
+    remember_me BOOLEAN NOT NULL DEFAULT FALSE, -- Picks the long idle timeout & absolute lifetime
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    impersonator_id UUID REFERENCES users(id) ON DELETE CASCADE, -- Admin acting as user_id, see /admin/impersonate
+    impersonator_session_id UUID REFERENCES sessions(id) ON DELETE CASCADE, -- The admin's own session, restored afterwards
+    ip VARCHAR(64) NOT NULL DEFAULT '', -- Fingerprint of the client the session was created (or last stepped up) on,
+    user_agent TEXT NOT NULL DEFAULT '', -- checked on use according to SESSION_BINDING_POLICY
+    device VARCHAR(100) NOT NULL DEFAULT '', -- i.e. "Firefox on Linux", derived from user_agent
+    is_new_device BOOLEAN NOT NULL DEFAULT FALSE, -- First login from device for a user with other devices
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
 CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_impersonator_id ON sessions(impersonator_id);
 CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
 CREATE INDEX IF NOT EXISTS idx_sessions_created_at ON sessions(created_at);
 CREATE INDEX IF NOT EXISTS idx_sessions_last_updated_at ON sessions(last_updated_at);
@@ -51,20 +62,274 @@ UPDATE
 
 
 -- Logs -------------------------------------------
+-- Partitioned by month on created_at, partitions are created ahead of time & dropped
+-- once past the retention window by the API (see LOG_RETENTION_MONTHS).
 CREATE TABLE IF NOT EXISTS logs (
-    id SERIAL NOT NULL,
+    id BIGSERIAL NOT NULL,
     message TEXT NOT NULL,
     level SMALLINT NOT NULL,
-    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-);
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    request_id VARCHAR(128),
+    user_id UUID,
+    ip VARCHAR(64),
+    route VARCHAR(255),
+    attributes JSONB NOT NULL DEFAULT '{}',
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+-- Catches rows outside of any monthly partition, so inserts never fail.
+CREATE TABLE IF NOT EXISTS logs_default PARTITION OF logs DEFAULT;
+
+-- Creates the partition holding the month of the given timestamp, i.e. logs_2025_01. Rows for that month
+-- already caught by logs_default are moved into it, otherwise attaching the partition would fail.
+CREATE OR REPLACE FUNCTION create_logs_partition(month_start TIMESTAMPTZ)
+RETURNS VOID AS $$
+DECLARE
+    range_start DATE := date_trunc('month', month_start)::DATE;
+    range_end DATE := (date_trunc('month', month_start) + INTERVAL '1 month')::DATE;
+    partition_name TEXT := 'logs_' || to_char(range_start, 'YYYY_MM');
+BEGIN
+    IF to_regclass(partition_name) IS NOT NULL THEN
+        RETURN;
+    END IF;
+
+    -- Holds off inserts landing in logs_default for the month while its rows are moved
+    LOCK TABLE logs_default IN SHARE ROW EXCLUSIVE MODE;
+
+    EXECUTE format('CREATE TABLE %I (LIKE logs INCLUDING DEFAULTS)', partition_name);
+    EXECUTE format(
+        'WITH moved AS (DELETE FROM logs_default WHERE created_at >= %L AND created_at < %L RETURNING *)
+         INSERT INTO %I SELECT * FROM moved',
+        range_start, range_end, partition_name
+    );
+    EXECUTE format(
+        'ALTER TABLE logs ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+        partition_name, range_start, range_end
+    );
+END;
+$$ LANGUAGE 'plpgsql';
+
+SELECT create_logs_partition(NOW());
+SELECT create_logs_partition(NOW() + INTERVAL '1 month');
 
 CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level);
 CREATE INDEX IF NOT EXISTS idx_logs_created_at ON logs(created_at);
+CREATE INDEX IF NOT EXISTS idx_logs_request_id ON logs(request_id);
+CREATE INDEX IF NOT EXISTS idx_logs_user_id ON logs(user_id);
+
+
+-- Audit Events ----------------------------------
+-- Append only security trail. Each row's hash covers its contents & the previous row's hash,
+-- so any edit or deletion is detectable by re-walking the chain.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(64) NOT NULL,
+    outcome VARCHAR(16) NOT NULL,
+    actor_id UUID,
+    target_id UUID,
+    ip VARCHAR(64),
+    user_agent TEXT,
+    request_id VARCHAR(128),
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    prev_hash VARCHAR(64) NOT NULL,
+    hash VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_kind ON audit_events(kind);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target_id ON audit_events(target_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+
+CREATE OR REPLACE FUNCTION reject_audit_events_change()
+RETURNS TRIGGER AS $$
+BEGIN
+   RAISE EXCEPTION 'audit_events is append only';
+END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER audit_events_append_only BEFORE
+UPDATE OR DELETE
+    ON audit_events FOR EACH ROW EXECUTE FUNCTION reject_audit_events_change();
+
+CREATE TRIGGER audit_events_no_truncate BEFORE
+TRUNCATE
+    ON audit_events FOR EACH STATEMENT EXECUTE FUNCTION reject_audit_events_change();
+
 
+-- API Keys ----------------------------------------
+-- Personal keys for programmatic access, the raw key is only ever shown on creation.
+-- prefix identifies the key for lookup, digest & salt are its security.Hash512 digest.
+-- scopes are space separated, i.e. "users:read users:write".
+CREATE TABLE IF NOT EXISTS api_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(32) NOT NULL UNIQUE,
+    digest VARCHAR(128) NOT NULL,
+    salt VARCHAR(64) NOT NULL,
+    scopes VARCHAR(255) NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_keys_expires_at ON api_keys(expires_at);
+
+CREATE TRIGGER update_api_keys_last_updated_at BEFORE
+UPDATE
+    ON api_keys FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- User Identities ---------------------------------
+-- External OpenID Connect accounts (provider + subject) linked to a user, for social login.
+-- Users created through social login have an empty password until they set one.
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+CREATE TRIGGER update_user_identities_last_updated_at BEFORE
+UPDATE
+    ON user_identities FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- OAuth Clients -----------------------------------
+-- Apps that sign users in through this API as an OpenID Connect provider.
+-- Public clients (no secret) must use PKCE, as every client does. redirect_uris & scopes are space separated.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    client_id VARCHAR(64) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    secret_digest VARCHAR(128) NOT NULL DEFAULT '',
+    secret_salt VARCHAR(64) NOT NULL DEFAULT '',
+    redirect_uris TEXT NOT NULL,
+    scopes VARCHAR(255) NOT NULL DEFAULT 'openid',
+    skip_consent BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
 
--- Cronjob for auto deletion of expired sessions, checks every minute.
-SELECT cron.schedule(
-    'delete_expired_sessions',
-        '*/1 * * * *',
-        'DELETE FROM sessions WHERE expires_at <= NOW();'
-);
\ No newline at end of file
+CREATE TRIGGER update_oauth_clients_last_updated_at BEFORE
+UPDATE
+    ON oauth_clients FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- OAuth Consents ----------------------------------
+-- Scopes a user has granted a client, so they're only asked once.
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id UUID NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, client_id)
+);
+
+CREATE TRIGGER update_oauth_consents_last_updated_at BEFORE
+UPDATE
+    ON oauth_consents FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- OAuth Refresh Tokens ----------------------------
+-- Tied to the session that authorised the client, logging out (deleting the session) revokes them.
+-- Rotated on every use, used_at marks a spent token so its reuse can revoke the whole chain.
+-- token_digest is the SHA-256 of the (high entropy) token.
+CREATE TABLE IF NOT EXISTS oauth_refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_digest VARCHAR(64) NOT NULL UNIQUE,
+    client_id UUID NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    scopes VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_refresh_tokens_session_client ON oauth_refresh_tokens(session_id, client_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_refresh_tokens_expires_at ON oauth_refresh_tokens(expires_at);
+
+CREATE TRIGGER update_oauth_refresh_tokens_last_updated_at BEFORE
+UPDATE
+    ON oauth_refresh_tokens FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- Magic Links -------------------------------------
+-- Single use, short lived passwordless sign in (or email verification) links. token_digest is the SHA-256 of the emailed token.
+-- ip & user_agent are those of the request, checked on use according to MAGIC_LINK_BINDING.
+CREATE TABLE IF NOT EXISTS magic_links (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL DEFAULT 'sign_in' CHECK (purpose IN ('sign_in', 'verify_email')),
+    email TEXT NOT NULL, -- Address the link was sent to, it's only good while the account still has it
+    token_digest VARCHAR(64) NOT NULL UNIQUE,
+    ip VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_magic_links_user_id_created_at ON magic_links(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_magic_links_expires_at ON magic_links(expires_at);
+
+CREATE TRIGGER update_magic_links_last_updated_at BEFORE
+UPDATE
+    ON magic_links FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- User Devices ----------------------------------
+-- Devices each user has logged in from, outliving their sessions so a returning device isn't reported as new.
+CREATE TABLE IF NOT EXISTS user_devices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device VARCHAR(100) NOT NULL,
+    last_ip VARCHAR(64) NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, device)
+);
+
+CREATE TRIGGER update_user_devices_last_updated_at BEFORE
+UPDATE
+    ON user_devices FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
+
+
+-- Job Runs ---------------------------------------
+-- History of the API's scheduled jobs (see src/lib/scheduler). A run is claimed by inserting its row, the unique
+-- (job, scheduled_at) pair makes sure only one replica or prefork child runs each scheduled run.
+CREATE TABLE IF NOT EXISTS job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    job VARCHAR(100) NOT NULL,
+    scheduled_at TIMESTAMPTZ NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ,
+    status VARCHAR(20) NOT NULL, -- running, succeeded, failed or skipped
+    host VARCHAR(255) NOT NULL,
+    result TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (job, scheduled_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_runs_started_at ON job_runs(started_at);
+
+CREATE TRIGGER update_job_runs_last_updated_at BEFORE
+UPDATE
+    ON job_runs FOR EACH ROW EXECUTE FUNCTION update_last_updated_at_column();
\ No newline at end of file